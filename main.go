@@ -1,6 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/cnpg-broker/pkg/config"
 	"github.com/cnpg-broker/pkg/logger"
 	"github.com/cnpg-broker/pkg/router"
@@ -11,6 +19,22 @@ func main() {
 	logger.Init()
 	logger.Info("starting cnpg-broker on port %d", cfg.Port)
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	r := router.New()
-	logger.Fatal("failed to start HTTP router: %v", r.Start(cfg.Port))
+	go func() {
+		if err := r.Start(cfg.Port); !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal("failed to start HTTP router: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Info("shutting down cnpg-broker")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := r.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to shut down HTTP router: %v", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,231 @@
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/cnpg-broker/pkg/logger"
+)
+
+// maxRecent is the number of entries kept in memory per instance for the admin endpoint
+const maxRecent = 100
+
+// queueSize is the number of entries waiting to be written to the sinks before Record drops entries
+const queueSize = 1024
+
+// sensitiveKey matches parameter names whose values are redacted
+var sensitiveKey = regexp.MustCompile(`(?i)(password|passwd|token|credential|private_key|access_key|secret_key|^secret$)`)
+
+// Entry is the audit record of a state-changing broker operation. Entries are chained by hash, each
+// hash covers the entry and the hash of its predecessor, so removing or altering an entry is detectable.
+// With a key the hash is an HMAC, so the chain cannot be recomputed by someone without the key.
+type Entry struct {
+	Time       time.Time      `json:"time"`
+	RequestID  string         `json:"request_id,omitempty"`
+	Operation  string         `json:"operation"`
+	InstanceID string         `json:"instance_id"`
+	BindingID  string         `json:"binding_id,omitempty"`
+	ServiceID  string         `json:"service_id,omitempty"`
+	PlanID     string         `json:"plan_id,omitempty"`
+	User       string         `json:"user,omitempty"`
+	Identity   string         `json:"identity,omitempty"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+	Status     int            `json:"status"`
+	Objects    []string       `json:"objects,omitempty"`
+	PrevHash   string         `json:"prev_hash"`
+	Hash       string         `json:"hash"`
+}
+
+// Sink stores audit entries
+type Sink interface {
+	Write(ctx context.Context, entry *Entry) error
+}
+
+// VerifiableSink is a sink that can read back the entries it holds to verify their chain
+type VerifiableSink interface {
+	Sink
+	Verify(key []byte) error
+}
+
+// Auditor chains audit entries and writes them to its sinks
+type Auditor struct {
+	key   []byte
+	sinks []Sink
+	queue chan queuedEntry
+	done  chan struct{}
+
+	mu       sync.Mutex
+	lastHash string
+	recent   map[string][]Entry
+	dropped  int64
+}
+
+type queuedEntry struct {
+	ctx   context.Context
+	entry Entry
+}
+
+// New returns an Auditor hashing entries with key and writing them to sinks. If a sink reports the hash
+// of the last entry it holds, e.g. a file sink reopened after a restart, the chain is continued from there.
+func New(key []byte, sinks ...Sink) *Auditor {
+	a := &Auditor{
+		key:    key,
+		sinks:  sinks,
+		queue:  make(chan queuedEntry, queueSize),
+		done:   make(chan struct{}),
+		recent: make(map[string][]Entry),
+	}
+	for _, sink := range sinks {
+		if chained, ok := sink.(interface{ LastHash() string }); ok && len(chained.LastHash()) > 0 {
+			a.lastHash = chained.LastHash()
+		}
+	}
+	go a.write()
+	return a
+}
+
+// Record completes an entry with time and hash and queues it for the sinks, failures of a sink are
+// logged but do not fail the operation that is audited. If the sinks fall behind by more than queueSize
+// entries, the entry is dropped and logged instead of blocking the operation; it is left out of the chain,
+// so the chain held by the sinks stays verifiable.
+func (a *Auditor) Record(ctx context.Context, entry Entry) {
+	entry.Parameters = Redact(entry.Parameters)
+
+	// entries are queued while holding the lock, so the sinks receive them in chain order
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry.Time = time.Now().UTC()
+	entry.PrevHash = a.lastHash
+	entry.Hash = ""
+	entry.Hash = hashEntry(a.key, &entry)
+	select {
+	case a.queue <- queuedEntry{ctx: ctx, entry: entry}:
+	default:
+		a.dropped++
+		logger.ErrorContext(ctx, "dropped audit entry of %s of instance %s, %d audit entries dropped in total: sinks are falling behind",
+			entry.Operation, entry.InstanceID, a.dropped)
+		return
+	}
+	a.lastHash = entry.Hash
+	history := append(a.recent[entry.InstanceID], entry)
+	if len(history) > maxRecent {
+		history = history[len(history)-maxRecent:]
+	}
+	a.recent[entry.InstanceID] = history
+}
+
+// Dropped returns the number of entries dropped as the sinks fell behind
+func (a *Auditor) Dropped() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.dropped
+}
+
+// write writes the queued entries to all sinks, one after another
+func (a *Auditor) write() {
+	defer close(a.done)
+	for queued := range a.queue {
+		for _, sink := range a.sinks {
+			if err := sink.Write(queued.ctx, &queued.entry); err != nil {
+				logger.ErrorContext(queued.ctx, "failed to write audit entry to %T: %v", sink, err)
+			}
+		}
+	}
+}
+
+// Close writes the queued entries to the sinks and stops the Auditor, it must not record afterwards
+func (a *Auditor) Close() {
+	a.mu.Lock()
+	close(a.queue)
+	a.mu.Unlock()
+	<-a.done
+}
+
+// VerifySinks verifies the chain of the entries held by every sink that can read them back
+func (a *Auditor) VerifySinks() error {
+	for _, sink := range a.sinks {
+		if verifiable, ok := sink.(VerifiableSink); ok {
+			if err := verifiable.Verify(a.key); err != nil {
+				return fmt.Errorf("%T: %w", sink, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Recent returns the audit entries of an instance recorded since the broker started, oldest first
+func (a *Auditor) Recent(instanceId string) []Entry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]Entry{}, a.recent[instanceId]...)
+}
+
+// Verify checks the hash chain of consecutive entries hashed with key, starting from the hash preceding the first one
+func Verify(key []byte, entries []Entry) error {
+	for i := range entries {
+		entry := entries[i]
+		if i > 0 && entry.PrevHash != entries[i-1].Hash {
+			return fmt.Errorf("entry %d does not follow entry %d", i, i-1)
+		}
+		recorded := entry.Hash
+		entry.Hash = ""
+		if hashEntry(key, &entry) != recorded {
+			return fmt.Errorf("entry %d has been altered", i)
+		}
+	}
+	return nil
+}
+
+// hashEntry returns the HMAC-SHA256 of an entry with key, or its SHA-256 without key
+func hashEntry(key []byte, entry *Entry) string {
+	var h hash.Hash
+	if len(key) > 0 {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	// Entry only consists of JSON encodable types
+	data, _ := json.Marshal(entry)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Redact returns a copy of parameters with the values of sensitive keys replaced, nested objects and lists included
+func Redact(parameters map[string]any) map[string]any {
+	if parameters == nil {
+		return nil
+	}
+	redacted := make(map[string]any, len(parameters))
+	for key, value := range parameters {
+		if sensitiveKey.MatchString(key) {
+			redacted[key] = "[REDACTED]"
+		} else {
+			redacted[key] = redactValue(value)
+		}
+	}
+	return redacted
+}
+
+// redactValue redacts the objects in a value, which may be an object or a list of them
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		return Redact(v)
+	case []any:
+		redacted := make([]any, len(v))
+		for i, item := range v {
+			redacted[i] = redactValue(item)
+		}
+		return redacted
+	default:
+		return value
+	}
+}
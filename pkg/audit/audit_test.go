@@ -0,0 +1,163 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("audit-test-key")
+
+func TestVerify(t *testing.T) {
+	auditor := New(testKey)
+	defer auditor.Close()
+	for _, operation := range []string{"provision", "update", "deprovision"} {
+		auditor.Record(context.Background(), Entry{Operation: operation, InstanceID: "instance", Status: 202})
+	}
+	entries := auditor.Recent("instance")
+	if err := Verify(testKey, entries); err != nil {
+		t.Fatalf("expected a valid hash chain: %v", err)
+	}
+
+	altered := append([]Entry{}, entries...)
+	altered[1].Status = 200
+	if err := Verify(testKey, altered); err == nil || !strings.Contains(err.Error(), "altered") {
+		t.Errorf("expected an altered entry to be detected, got %v", err)
+	}
+	removed := []Entry{entries[0], entries[2]}
+	if err := Verify(testKey, removed); err == nil || !strings.Contains(err.Error(), "does not follow") {
+		t.Errorf("expected a removed entry to be detected, got %v", err)
+	}
+	// without the key an altered entry cannot be hashed to match again
+	rehashed := append([]Entry{}, entries...)
+	rehashed[2].Status = 200
+	rehashed[2].Hash = ""
+	rehashed[2].Hash = hashEntry(nil, &rehashed[2])
+	if err := Verify(testKey, rehashed); err == nil {
+		t.Error("expected an entry rehashed without the key to be detected")
+	}
+}
+
+// blockingSink holds entries until it is released
+type blockingSink struct {
+	release chan struct{}
+	entries []Entry
+}
+
+func (s *blockingSink) Write(_ context.Context, entry *Entry) error {
+	<-s.release
+	s.entries = append(s.entries, *entry)
+	return nil
+}
+
+func TestDroppedEntries(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	auditor := New(testKey, sink)
+	// the writer holds one entry, the queue the next queueSize entries, the rest are dropped
+	for range queueSize + 10 {
+		auditor.Record(context.Background(), Entry{Operation: "update", InstanceID: "instance", Status: 202})
+	}
+	if dropped := auditor.Dropped(); dropped < 9 || dropped > 10 {
+		t.Errorf("expected 9 or 10 dropped entries, got %d", dropped)
+	}
+	close(sink.release)
+	auditor.Close()
+	if len(sink.entries) != queueSize+10-int(auditor.Dropped()) {
+		t.Errorf("expected the entries that were not dropped to be written, got %d", len(sink.entries))
+	}
+	if err := Verify(testKey, sink.entries); err != nil {
+		t.Errorf("expected the written entries to form a valid chain: %v", err)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatalf("failed to create file sink: %v", err)
+	}
+	auditor := New(testKey, sink)
+	for _, operation := range []string{"provision", "update"} {
+		auditor.Record(context.Background(), Entry{Operation: operation, InstanceID: "instance", Status: 202})
+	}
+	auditor.Close()
+	if err := auditor.VerifySinks(); err != nil {
+		t.Fatalf("expected the audit file to be valid: %v", err)
+	}
+
+	// the chain is continued after a restart
+	sink, err = NewFileSink(path)
+	if err != nil {
+		t.Fatalf("failed to reopen file sink: %v", err)
+	}
+	auditor = New(testKey, sink)
+	auditor.Record(context.Background(), Entry{Operation: "deprovision", InstanceID: "instance", Status: 202})
+	auditor.Close()
+	if err := auditor.VerifySinks(); err != nil {
+		t.Fatalf("expected the continued audit file to be valid: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read audit file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(lines))
+	}
+	var entry Entry
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("failed to decode entry: %v", err)
+	}
+	entry.Status = 500
+	altered, _ := json.Marshal(entry)
+	lines[1] = string(altered)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write audit file: %v", err)
+	}
+	if err := auditor.VerifySinks(); err == nil {
+		t.Error("expected an altered audit file to fail verification")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	parameters := map[string]any{
+		"timezone": "UTC",
+		"password": "secret",
+		"restore": map[string]any{
+			"Access_Key": "key",
+			"bucket":     "backups",
+		},
+		"users": []any{
+			map[string]any{"name": "app", "password": "secret"},
+			[]any{map[string]any{"token": "abc"}},
+			"readonly",
+		},
+	}
+	want := map[string]any{
+		"timezone": "UTC",
+		"password": "[REDACTED]",
+		"restore": map[string]any{
+			"Access_Key": "[REDACTED]",
+			"bucket":     "backups",
+		},
+		"users": []any{
+			map[string]any{"name": "app", "password": "[REDACTED]"},
+			[]any{map[string]any{"token": "[REDACTED]"}},
+			"readonly",
+		},
+	}
+	if redacted := Redact(parameters); !reflect.DeepEqual(redacted, want) {
+		t.Errorf("expected %v, got %v", want, redacted)
+	}
+	if parameters["password"] != "secret" || parameters["users"].([]any)[0].(map[string]any)["password"] != "secret" {
+		t.Error("expected the parameters not to be modified")
+	}
+	if Redact(nil) != nil {
+		t.Error("expected nil parameters to stay nil")
+	}
+}
@@ -0,0 +1,51 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+type contextKey struct{}
+
+// objects collects the Kubernetes objects written while handling an audited request
+type objects struct {
+	mu    sync.Mutex
+	names []string
+}
+
+// NewContext returns a copy of ctx collecting the objects passed to Touched, see Objects
+func NewContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextKey{}, &objects{})
+}
+
+// Touched records that an object was created, updated or deleted while handling an audited request,
+// it does nothing if ctx is not audited
+func Touched(ctx context.Context, kind, namespace, name string) {
+	o, ok := ctx.Value(contextKey{}).(*objects)
+	if !ok {
+		return
+	}
+	object := fmt.Sprintf("%s %s", kind, name)
+	if len(namespace) > 0 {
+		object = fmt.Sprintf("%s %s/%s", kind, namespace, name)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !slices.Contains(o.names, object) {
+		o.names = append(o.names, object)
+	}
+}
+
+// Objects returns the objects recorded by Touched on ctx
+func Objects(ctx context.Context) []string {
+	o, ok := ctx.Value(contextKey{}).(*objects)
+	if !ok {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string{}, o.names...)
+}
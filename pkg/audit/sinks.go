@@ -0,0 +1,177 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// WriterSink writes entries as JSON lines to a writer, e.g. os.Stdout
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(_ context.Context, entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+// FileSink appends entries as JSON lines to a file, which is only ever opened for appending
+type FileSink struct {
+	WriterSink
+	path     string
+	lastHash string
+}
+
+// NewFileSink opens or creates the audit file at path, and reads the hash of its last entry to continue the chain
+func NewFileSink(path string) (*FileSink, error) {
+	lastHash, err := readLastHash(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file %s: %w", path, err)
+	}
+	return &FileSink{WriterSink: WriterSink{w: file}, path: path, lastHash: lastHash}, nil
+}
+
+// Verify reads the entries of the file and verifies their chain
+func (s *FileSink) Verify(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := readEntries(s.path)
+	if err != nil {
+		return err
+	}
+	return Verify(key, entries)
+}
+
+// LastHash is the hash of the last entry in the file when it was opened
+func (s *FileSink) LastHash() string {
+	return s.lastHash
+}
+
+func readLastHash(path string) (string, error) {
+	entries, err := readEntries(path)
+	if err != nil || len(entries) == 0 {
+		return "", err
+	}
+	return entries[len(entries)-1].Hash, nil
+}
+
+// readEntries reads the entries of an audit file, there are none if it does not exist
+func readEntries(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read audit file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal([]byte(text), &entry); err != nil {
+			return nil, fmt.Errorf("invalid entry in line %d of audit file %s: %w", line, path, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit file %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// EventSink records entries as Kubernetes Events in the namespace of the instance
+type EventSink struct {
+	clientset kubernetes.Interface
+}
+
+func NewEventSink(clientset kubernetes.Interface) *EventSink {
+	return &EventSink{clientset: clientset}
+}
+
+func (s *EventSink) Write(ctx context.Context, entry *Entry) error {
+	eventType := corev1.EventTypeNormal
+	if entry.Status >= http.StatusBadRequest {
+		eventType = corev1.EventTypeWarning
+	}
+	message := fmt.Sprintf("%s by %s returned %d", entry.Operation, entry.User, entry.Status)
+	if len(entry.Identity) > 0 {
+		message = fmt.Sprintf("%s by %s (%s) returned %d", entry.Operation, entry.User, entry.Identity, entry.Status)
+	}
+	if len(entry.Objects) > 0 {
+		message = fmt.Sprintf("%s, touched %s", message, strings.Join(entry.Objects, ", "))
+	}
+
+	now := metav1.NewTime(entry.Time)
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "cnpg-broker-audit-",
+			Namespace:    entry.InstanceID,
+			Labels: map[string]string{
+				"cnpg-broker.io/instance-id": entry.InstanceID,
+			},
+			Annotations: map[string]string{
+				"cnpg-broker.io/audit-hash": entry.Hash,
+			},
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Namespace",
+			Name:       entry.InstanceID,
+		},
+		Reason:              "BrokerAudit",
+		Message:             message,
+		Type:                eventType,
+		Source:              corev1.EventSource{Component: "cnpg-broker"},
+		ReportingController: "cnpg-broker.io/broker",
+		ReportingInstance:   hostname(),
+		Action:              entry.Operation,
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		EventTime:           metav1.NewMicroTime(entry.Time.Truncate(time.Microsecond)),
+		Count:               1,
+	}
+	_, err := s.clientset.CoreV1().Events(entry.InstanceID).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "cnpg-broker"
+	}
+	return name
+}
@@ -0,0 +1,113 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cnpg-broker/pkg/audit"
+	"github.com/cnpg-broker/pkg/identity"
+	"github.com/cnpg-broker/pkg/logger"
+	"github.com/cnpg-broker/pkg/validation"
+	"github.com/labstack/echo/v4"
+)
+
+// auditedOperations are the state-changing OSB and admin requests recorded in the audit log, by method and route
+var auditedOperations = map[string]string{
+	http.MethodPost + " /admin/orphans/cleanup":                                            "cleanup-orphans",
+	http.MethodPut + " /v2/service_instances/:instance_id":                                 "provision",
+	http.MethodPatch + " /v2/service_instances/:instance_id":                               "update",
+	http.MethodDelete + " /v2/service_instances/:instance_id":                              "deprovision",
+	http.MethodPut + " /v2/service_instances/:instance_id/service_bindings/:binding_id":    "bind",
+	http.MethodDelete + " /v2/service_instances/:instance_id/service_bindings/:binding_id": "unbind",
+}
+
+// auditRequests records an audit entry for every state-changing request once it has been handled,
+// including the Kubernetes objects written while handling it
+func auditRequests(auditor *audit.Auditor) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			operation, ok := auditedOperations[c.Request().Method+" "+c.Path()]
+			if !ok {
+				return next(c)
+			}
+
+			entry := audit.Entry{
+				Operation:  operation,
+				InstanceID: c.Param("instance_id"),
+				BindingID:  c.Param("binding_id"),
+				ServiceID:  c.QueryParam("service_id"),
+				PlanID:     c.QueryParam("plan_id"),
+			}
+			// the body is read twice, here and by the handler
+			if c.Request().Body != nil {
+				body, err := io.ReadAll(c.Request().Body)
+				if err != nil {
+					return brokerError(c, http.StatusBadRequest, "", err.Error())
+				}
+				c.Request().Body = io.NopCloser(bytes.NewReader(body))
+				var req struct {
+					ServiceID  string         `json:"service_id"`
+					PlanID     string         `json:"plan_id"`
+					Parameters map[string]any `json:"parameters"`
+				}
+				if json.Unmarshal(body, &req) == nil {
+					entry.ServiceID, entry.PlanID, entry.Parameters = req.ServiceID, req.PlanID, req.Parameters
+				}
+				// admin requests have no OSB parameters, their body is recorded instead
+				if strings.HasPrefix(c.Path(), "/admin/") {
+					_ = json.Unmarshal(body, &entry.Parameters)
+				}
+			}
+			entry.User, _, _ = c.Request().BasicAuth()
+			if originator := identity.FromContext(c.Request().Context()); originator != nil {
+				entry.Identity = originator.String()
+			}
+
+			ctx := audit.NewContext(c.Request().Context())
+			c.SetRequest(c.Request().WithContext(ctx))
+			err := next(c)
+
+			entry.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+			entry.Status = c.Response().Status
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				entry.Status = httpErr.Code
+			} else if err != nil {
+				entry.Status = http.StatusInternalServerError
+			}
+			entry.Objects = audit.Objects(ctx)
+			auditor.Record(context.WithoutCancel(ctx), entry)
+			return err
+		}
+	}
+}
+
+// VerifyAudit verifies the hash chain of the entries held by the audit sinks, e.g. the audit file
+func (h *Handler) VerifyAudit(c echo.Context) error {
+	if err := h.auditor.VerifySinks(); err != nil {
+		logger.ErrorContext(c.Request().Context(), "audit log failed verification: %v", err)
+		return c.JSON(http.StatusOK, map[string]any{
+			"valid": false,
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"valid": true,
+	})
+}
+
+// AuditEntries returns the audit entries recorded for an instance since the broker started
+func (h *Handler) AuditEntries(c echo.Context) error {
+	instanceId := c.Param("instance_id")
+	if err := validation.ValidateInstanceID(instanceId); err != nil {
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"entries": h.auditor.Recent(instanceId),
+	})
+}
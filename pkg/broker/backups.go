@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cnpg-broker/pkg/cnpg"
+	"github.com/cnpg-broker/pkg/logger"
+	"github.com/cnpg-broker/pkg/validation"
+	"github.com/labstack/echo/v4"
+)
+
+func (b *Broker) ListBackups(c echo.Context) error {
+	instanceId := c.Param("instance_id")
+	ctx := requestContext(c)
+
+	if err := validation.ValidateInstanceID(instanceId); err != nil {
+		logger.WarnContext(ctx, "invalid instance_id: %v", err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+
+	cluster, err := b.client.GetCluster(ctx, instanceId)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to get instance %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	if !cluster.Exists {
+		return brokerError(c, http.StatusNotFound, "", "instance not found")
+	}
+
+	backups, err := b.client.ListBackups(ctx, instanceId)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to list backups of instance %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"backups_enabled": cluster.BackupsEnabled,
+		"backups":         backups,
+	})
+}
+
+func (b *Broker) CreateBackup(c echo.Context) error {
+	instanceId := c.Param("instance_id")
+	ctx := requestContext(c)
+
+	if err := validation.ValidateInstanceID(instanceId); err != nil {
+		logger.WarnContext(ctx, "invalid instance_id: %v", err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+
+	cluster, err := b.client.GetCluster(ctx, instanceId)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to get instance %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	if !cluster.Exists {
+		return brokerError(c, http.StatusNotFound, "", "instance not found")
+	}
+
+	logger.InfoContext(ctx, "starting on-demand backup of instance %s", instanceId)
+	backup, err := b.client.CreateBackup(ctx, instanceId)
+	if err != nil {
+		if errors.Is(err, cnpg.ErrBackupsNotConfigured) {
+			logger.WarnContext(ctx, "attempted to back up instance %s without backups configured", instanceId)
+			return brokerError(c, http.StatusUnprocessableEntity, "", err.Error())
+		}
+		logger.ErrorContext(ctx, "failed to start backup of instance %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	return c.JSON(http.StatusAccepted, backup)
+}
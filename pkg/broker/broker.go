@@ -1,7 +1,7 @@
 package broker
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -11,147 +11,223 @@ import (
 	"github.com/cnpg-broker/pkg/logger"
 	"github.com/cnpg-broker/pkg/validation"
 	"github.com/labstack/echo/v4"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
 type Broker struct {
-	client *cnpg.Client
+	client cnpg.ClusterBackend
 }
 
-func NewBroker() *Broker {
+func NewBroker(client cnpg.ClusterBackend) *Broker {
 	return &Broker{
-		client: cnpg.NewClient(),
+		client: client,
 	}
 }
 
 func (b *Broker) GetCatalog(c echo.Context) error {
-	logger.Debug("catalog requested")
+	logger.DebugContext(requestContext(c), "catalog requested")
+	etag := catalog.ETag()
+	c.Response().Header().Set("ETag", etag)
+	if match := c.Request().Header.Get("If-None-Match"); len(match) > 0 && match == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
 	return c.JSON(http.StatusOK, catalog.GetCatalog())
 }
 
 func (b *Broker) ProvisionInstance(c echo.Context) error {
 	instanceId := c.Param("instance_id")
 	acceptsIncomplete := c.QueryParam("accepts_incomplete") == "true"
+	ctx := requestContext(c)
 
 	if err := validation.ValidateInstanceID(instanceId); err != nil {
-		logger.Warn("invalid instance_id: %v", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		logger.WarnContext(ctx, "invalid instance_id: %v", err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
 
 	var req struct {
-		ServiceID string         `json:"service_id"`
-		PlanID    string         `json:"plan_id"`
-		Context   map[string]any `json:"context"`
+		ServiceID  string         `json:"service_id"`
+		PlanID     string         `json:"plan_id"`
+		Context    map[string]any `json:"context"`
+		Parameters map[string]any `json:"parameters"`
 	}
 	if err := c.Bind(&req); err != nil {
-		logger.Error("failed to parse provision request for %s: %v", instanceId, err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		logger.ErrorContext(ctx, "failed to parse provision request for %s: %v", instanceId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
+	ctx = logger.With(ctx, "plan_id", req.PlanID)
 
 	if err := validation.ValidateServiceID(req.ServiceID); err != nil {
-		logger.Warn("invalid service_id [%s] for %s: %v", req.ServiceID, instanceId, err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		logger.WarnContext(ctx, "invalid service_id [%s] for %s: %v", req.ServiceID, instanceId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+	// only provisions fall back to the default plan, updates of unknown plans are rejected
+	if _, err := catalog.GetPlan(req.ServiceID, req.PlanID); len(req.PlanID) > 0 && errors.Is(err, catalog.ErrPlanNotFound) {
+		if defaultPlan, found := catalog.DefaultPlan(req.ServiceID); found {
+			logger.WarnContext(ctx, "plan %s not found for service %s, using default plan %s", req.PlanID, req.ServiceID, defaultPlan.ID)
+			req.PlanID = defaultPlan.ID
+		}
 	}
 	if err := validation.ValidatePlanID(req.ServiceID, req.PlanID); err != nil {
-		logger.Warn("invalid plan_id [%s] for %s: %v", req.PlanID, instanceId, err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		logger.WarnContext(ctx, "invalid plan_id [%s] for %s: %v", req.PlanID, instanceId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
 
-	clusterStatus, err := b.client.GetCluster(context.Background(), instanceId)
+	plan, err := catalog.GetPlan(req.ServiceID, req.PlanID)
 	if err != nil {
-		logger.Error("failed to check cluster status for %s: %v", instanceId, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		logger.WarnContext(ctx, "invalid plan_id [%s] for %s: %v", req.PlanID, instanceId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+	if errs := validation.ValidateParameters(plan.ProvisionSchema(), req.Parameters); len(errs) > 0 {
+		logger.WarnContext(ctx, "invalid provision parameters for %s: %v", instanceId, errs)
+		return invalidParameters(c, errs)
+	}
+	var params cnpg.InstanceParameters
+	if err := decodeParameters(req.Parameters, &params); err != nil {
+		logger.WarnContext(ctx, "failed to decode provision parameters for %s: %v", instanceId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+	if errs := validation.ValidatePostgresqlParameters(params.PostgresqlParameters); len(errs) > 0 {
+		logger.WarnContext(ctx, "invalid provision parameters for %s: %v", instanceId, errs)
+		return invalidParameters(c, errs)
+	}
+	if err := validatePostgresVersion(params.PostgresVersion); err != nil {
+		logger.WarnContext(ctx, "invalid provision parameters for %s: %v", instanceId, err)
+		return invalidParameters(c, []*validation.ValidationError{err})
+	}
+	// restores take the version of their source, which is checked with the source
+	if len(params.RestoreFromInstance) == 0 {
+		if err := validateExposureVersion(plan, params.PostgresVersion, plan.Metadata.PostgresVersion); err != nil {
+			logger.WarnContext(ctx, "invalid provision parameters for %s: %v", instanceId, err)
+			return invalidParameters(c, []*validation.ValidationError{err})
+		}
 	}
+	params.Owner = cnpg.Owner(req.Context)
 
-	if clusterStatus.Exists {
-		logger.Info("instance %s already exists, checking compatibility", instanceId)
-		instances, cpu, memory, storage := catalog.PlanSpec(req.PlanID)
+	nsStatus, err := b.client.GetNamespaceStatus(ctx, instanceId)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to check namespace status for %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	if nsStatus.IsTerminating {
+		logger.WarnContext(ctx, "attempted to provision instance %s while its deprovision is in progress", instanceId)
+		return concurrencyError(c, "Service instance deprovision is in progress")
+	}
 
-		if clusterStatus.Instances == instances &&
-			clusterStatus.CPU == cpu &&
-			clusterStatus.Memory == memory &&
-			clusterStatus.Storage == storage {
+	clusterStatus, err := b.client.GetCluster(ctx, instanceId)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to check cluster status for %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
 
+	if clusterStatus.Exists {
+		logger.InfoContext(ctx, "instance %s already exists, checking compatibility", instanceId)
+		if clusterStatus.Instances == plan.Metadata.Instances &&
+			clusterStatus.CPU == plan.Metadata.CPU &&
+			clusterStatus.Memory == plan.Metadata.Memory &&
+			clusterStatus.Storage == plan.Metadata.Storage {
+
+			// a retried provision converges an instance left half-built by a failed one, e.g. without its pooler,
+			// instances that are ready or failed are left untouched
+			if clusterStatus.PlanID == req.PlanID && clusterStatus.IsProvisioning {
+				if _, err := b.client.CreateCluster(ctx, instanceId, req.ServiceID, req.PlanID, params); err != nil {
+					logger.ErrorContext(ctx, "failed to converge instance %s: %v", instanceId, err)
+					return brokerError(c, http.StatusInternalServerError, "", err.Error())
+				}
+			}
 			if clusterStatus.IsReady {
-				logger.Info("instance %s already provisioned and ready", instanceId)
+				logger.InfoContext(ctx, "instance %s already provisioned and ready", instanceId)
 				return c.JSON(http.StatusOK, map[string]any{})
 			}
 			if clusterStatus.IsProvisioning {
 				if acceptsIncomplete {
-					logger.Info("instance %s provisioning in progress", instanceId)
-					return c.JSON(http.StatusAccepted, map[string]any{})
+					logger.InfoContext(ctx, "instance %s provisioning in progress", instanceId)
+					return c.JSON(http.StatusAccepted, operationResponse(b.inProgressOperation(ctx, instanceId, "")))
 				}
-				return c.JSON(http.StatusUnprocessableEntity, map[string]any{
-					"error":       "AsyncRequired",
-					"description": "Service instance provisioning is in progress and requires async support",
-				})
+				return asyncRequired(c, "Service instance provisioning is in progress and requires async support")
 			}
 			if clusterStatus.IsFailed {
-				logger.Warn("instance %s exists but in failed state", instanceId)
-				return c.JSON(http.StatusConflict, map[string]string{
-					"error": fmt.Sprintf("instance exists in failed state: %s", clusterStatus.FailureReason),
-				})
+				logger.WarnContext(ctx, "instance %s exists but in failed state", instanceId)
+				return brokerError(c, http.StatusConflict, "", fmt.Sprintf("instance exists in failed state: %s", clusterStatus.FailureReason))
 			}
 
 			return c.JSON(http.StatusOK, map[string]any{})
 
 		} else {
-			logger.Warn("instance %s exists but with different specs", instanceId)
-			return c.JSON(http.StatusConflict, map[string]string{
-				"error": "instance exists with different configuration",
-			})
+			logger.WarnContext(ctx, "instance %s exists but with different specs", instanceId)
+			return brokerError(c, http.StatusConflict, "", "instance exists with different configuration")
 		}
 	}
 
 	if !acceptsIncomplete {
-		return c.JSON(http.StatusUnprocessableEntity, map[string]any{
-			"error":       "AsyncRequired",
-			"description": "This service plan requires client support for asynchronous service operations",
-		})
+		return asyncRequired(c, "This service plan requires client support for asynchronous service operations")
 	}
 
-	logger.Info("starting async provisioning for instance %s with plan %s", instanceId, req.PlanID)
+	if err := b.client.ValidateRestore(ctx, instanceId, params, plan); err != nil {
+		if errors.Is(err, cnpg.ErrForeignSource) {
+			logger.WarnContext(ctx, "refused to restore %s from instance %s of another owner", instanceId, params.RestoreFromInstance)
+			return brokerError(c, http.StatusForbidden, "", err.Error())
+		}
+		var validationErr *validation.ValidationError
+		if errors.As(err, &validationErr) {
+			logger.WarnContext(ctx, "invalid restore parameters for %s: %v", instanceId, err)
+			return invalidParameters(c, []*validation.ValidationError{validationErr})
+		}
+		logger.ErrorContext(ctx, "failed to check restore source for %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+
+	logger.InfoContext(ctx, "starting async provisioning for instance %s with plan %s", instanceId, req.PlanID)
 
-	_, err = b.client.CreateCluster(context.Background(), instanceId, req.ServiceID, req.PlanID)
+	_, err = b.client.CreateCluster(ctx, instanceId, req.ServiceID, req.PlanID, params)
 	if err != nil {
-		if strings.Contains(err.Error(), "already exists") {
-			logger.Info("instance %s was created concurrently", instanceId)
-			return c.JSON(http.StatusAccepted, map[string]any{})
-		}
-		logger.Error("failed to start provisioning for instance %s: %v", instanceId, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		logger.ErrorContext(ctx, "failed to start provisioning for instance %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
 	}
 
-	logger.Info("provisioning initiated for instance %s", instanceId)
+	op, err := b.client.StartOperation(ctx, instanceId, cnpg.Operation{
+		Type:   cnpg.OperationProvision,
+		PlanID: req.PlanID,
+	})
+	if err != nil {
+		// last_operation falls back to evaluating the cluster without a journal
+		logger.ErrorContext(ctx, "failed to record provisioning of instance %s: %v", instanceId, err)
+	}
+
+	logger.InfoContext(ctx, "provisioning initiated for instance %s", instanceId)
 	response := c.Response()
 	response.Header().Set("Retry-After", "10")
-	return c.JSON(http.StatusAccepted, map[string]any{})
+	return c.JSON(http.StatusAccepted, operationResponse(op))
 }
 
 func (b *Broker) GetInstance(c echo.Context) error {
 	instanceId := c.Param("instance_id")
+	ctx := requestContext(c)
 
 	if err := validation.ValidateInstanceID(instanceId); err != nil {
-		logger.Warn("invalid instance_id: %v", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		logger.WarnContext(ctx, "invalid instance_id: %v", err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
 
-	logger.Debug("checking instance %s", instanceId)
-	cluster, err := b.client.GetCluster(context.Background(), instanceId)
+	logger.DebugContext(ctx, "checking instance %s", instanceId)
+	cluster, err := b.client.GetCluster(ctx, instanceId)
 	if err != nil {
 		if strings.Contains(err.Error(), fmt.Sprintf("\"%s\" not found", instanceId)) {
-			logger.Debug("instance %s not found", instanceId)
-			return c.JSON(http.StatusNotFound, map[string]any{})
+			logger.DebugContext(ctx, "instance %s not found", instanceId)
+			return brokerError(c, http.StatusNotFound, "", "instance not found")
 		} else {
-			logger.Error("failed to get instance %s: %v", instanceId, err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			logger.ErrorContext(ctx, "failed to get instance %s: %v", instanceId, err)
+			return brokerError(c, http.StatusInternalServerError, "", err.Error())
 		}
 	}
 	if !cluster.Exists {
-		logger.Debug("cluster for instance %s not found", instanceId)
-		return c.JSON(http.StatusNotFound, cluster)
+		logger.DebugContext(ctx, "cluster for instance %s not found", instanceId)
+		return brokerError(c, http.StatusNotFound, "", "instance not found")
 	}
 	if cluster.IsFailed {
-		logger.Warn("cluster for instance %s is in failed state: %s", instanceId, cluster.FailureReason)
+		logger.WarnContext(ctx, "cluster for instance %s is in failed state: %s", instanceId, cluster.FailureReason)
+	}
+	if cluster.Poolers, err = b.client.GetPoolers(ctx, instanceId); err != nil {
+		logger.WarnContext(ctx, "failed to get poolers of instance %s: %v", instanceId, err)
 	}
 
 	return c.JSON(http.StatusOK, cluster)
@@ -160,84 +236,187 @@ func (b *Broker) GetInstance(c echo.Context) error {
 func (b *Broker) DeprovisionInstance(c echo.Context) error {
 	instanceId := c.Param("instance_id")
 	acceptsIncomplete := c.QueryParam("accepts_incomplete") == "true"
+	ctx := requestContext(c)
 
 	if err := validation.ValidateInstanceID(instanceId); err != nil {
-		logger.Warn("invalid instance_id: %v", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		logger.WarnContext(ctx, "invalid instance_id: %v", err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
 
-	nsStatus, err := b.client.GetNamespaceStatus(context.Background(), instanceId)
+	nsStatus, err := b.client.GetNamespaceStatus(ctx, instanceId)
 	if err != nil {
-		logger.Error("failed to check namespace status for %s: %v", instanceId, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		logger.ErrorContext(ctx, "failed to check namespace status for %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
 	}
 	if !nsStatus.Exists {
-		logger.Warn("attempted to deprovision non-existent instance %s", instanceId)
+		logger.WarnContext(ctx, "attempted to deprovision non-existent instance %s", instanceId)
 		return c.JSON(http.StatusGone, map[string]any{})
 	}
 	if nsStatus.IsTerminating {
 		if acceptsIncomplete {
-			logger.Info("instance %s deprovision in progress", instanceId)
-			return c.JSON(http.StatusAccepted, map[string]any{})
+			logger.InfoContext(ctx, "instance %s deprovision in progress", instanceId)
+			return c.JSON(http.StatusAccepted, operationResponse(b.inProgressOperation(ctx, instanceId, "")))
 		}
-		return c.JSON(http.StatusUnprocessableEntity, map[string]any{
-			"error":       "AsyncRequired",
-			"description": "Service instance deprovision is in progress and requires async support",
-		})
+		return asyncRequired(c, "Service instance deprovision is in progress and requires async support")
 	}
 
 	if !acceptsIncomplete {
-		return c.JSON(http.StatusUnprocessableEntity, map[string]any{
-			"error":       "AsyncRequired",
-			"description": "This service plan requires client support for asynchronous service operations",
-		})
+		return asyncRequired(c, "This service plan requires client support for asynchronous service operations")
 	}
 
-	logger.Info("starting async deprovision for instance %s", instanceId)
-	err = b.client.DeleteCluster(context.Background(), instanceId)
+	logger.InfoContext(ctx, "starting async deprovision for instance %s", instanceId)
+	// record the operation first, the journal can't be created anymore once the namespace is terminating
+	op, err := b.client.StartOperation(ctx, instanceId, cnpg.Operation{
+		Type: cnpg.OperationDeprovision,
+	})
 	if err != nil {
-		logger.Error("failed to start deprovision for instance %s: %v", instanceId, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		logger.ErrorContext(ctx, "failed to record deprovision of instance %s: %v", instanceId, err)
+	}
+	err = b.client.DeleteCluster(ctx, instanceId)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to start deprovision for instance %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
 	}
 
-	logger.Info("deprovision initiated for instance %s", instanceId)
+	logger.InfoContext(ctx, "deprovision initiated for instance %s", instanceId)
 	response := c.Response()
 	response.Header().Set("Retry-After", "10")
-	return c.JSON(http.StatusAccepted, map[string]any{})
+	return c.JSON(http.StatusAccepted, operationResponse(op))
 }
 
 func (b *Broker) BindInstance(c echo.Context) error {
 	instanceId := c.Param("instance_id")
 	bindingId := c.Param("binding_id")
+	acceptsIncomplete := c.QueryParam("accepts_incomplete") == "true"
+	ctx := requestContext(c)
 
 	if err := validation.ValidateInstanceID(instanceId); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
 	if err := validation.ValidateBindingID(bindingId); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+
+	var req struct {
+		ServiceID  string         `json:"service_id"`
+		PlanID     string         `json:"plan_id"`
+		Context    map[string]any `json:"context"`
+		Parameters map[string]any `json:"parameters"`
+	}
+	if err := c.Bind(&req); err != nil {
+		logger.ErrorContext(ctx, "failed to parse bind request for %s: %v", bindingId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
+	ctx = logger.With(ctx, "plan_id", req.PlanID)
 
-	logger.Info("creating binding %s for instance %s", bindingId, instanceId)
-	_, err := b.client.GetCluster(context.Background(), instanceId)
+	logger.InfoContext(ctx, "creating binding %s for instance %s", bindingId, instanceId)
+	clusterStatus, err := b.client.GetCluster(ctx, instanceId)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			logger.Warn("attempted to bind non-existent instance %s", instanceId)
-			return c.JSON(http.StatusNotFound, map[string]string{
-				"error": "instance not found",
-			})
-		}
-		logger.Error("failed to check instance %s: %v", instanceId, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		logger.ErrorContext(ctx, "failed to check instance %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	if !clusterStatus.Exists {
+		logger.WarnContext(ctx, "attempted to bind non-existent instance %s", instanceId)
+		return brokerError(c, http.StatusNotFound, "", "instance not found")
+	}
+	nsStatus, err := b.client.GetNamespaceStatus(ctx, instanceId)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to check namespace status for %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	if nsStatus.IsTerminating {
+		logger.WarnContext(ctx, "attempted to bind instance %s while its deprovision is in progress", instanceId)
+		return concurrencyError(c, "Service instance deprovision is in progress")
+	}
+
+	plan, found := catalog.FindPlan(clusterStatus.PlanID)
+	if !found {
+		// the plan was removed from the catalog, there is no schema to check the parameters against
+		logger.ErrorContext(ctx, "plan %s of instance %s not found in the catalog", clusterStatus.PlanID, instanceId)
+		return brokerError(c, http.StatusUnprocessableEntity, "", fmt.Sprintf("plan %s of the instance is not in the catalog", clusterStatus.PlanID))
+	}
+	if errs := validation.ValidateParameters(plan.BindSchema(), req.Parameters); len(errs) > 0 {
+		logger.WarnContext(ctx, "invalid bind parameters for %s: %v", bindingId, errs)
+		return invalidParameters(c, errs)
+	}
+	var params cnpg.BindingParameters
+	if err := decodeParameters(req.Parameters, &params); err != nil {
+		logger.ErrorContext(ctx, "failed to decode bind parameters for %s: %v", bindingId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+	target, err := projectionTarget(req.Context, plan, params)
+	if err != nil {
+		logger.WarnContext(ctx, "invalid secret projection for binding %s: %v", bindingId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
 
-	credentials, err := b.client.GetCredentials(context.Background(), instanceId)
+	created, err := b.client.CreateBinding(ctx, instanceId, bindingId)
 	if err != nil {
-		logger.Error("failed to get credentials for instance %s: %v", instanceId, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		logger.ErrorContext(ctx, "failed to create role for binding %s of instance %s: %v", bindingId, instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
 	}
 
-	logger.Info("successfully created binding %s for instance %s", bindingId, instanceId)
-	return c.JSON(http.StatusOK, map[string]any{
+	var projected *cnpg.ProjectedSecret
+	if target != nil {
+		projected, err = b.client.ProjectBinding(ctx, instanceId, bindingId, *target)
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to project credentials of binding %s of instance %s: %v", bindingId, instanceId, err)
+			if created {
+				if _, err := b.client.DeleteBinding(ctx, instanceId, bindingId); err != nil {
+					logger.ErrorContext(ctx, "failed to roll back binding %s of instance %s: %v", bindingId, instanceId, err)
+				}
+			}
+			if errors.Is(err, cnpg.ErrProjectedSecretConflict) {
+				return brokerError(c, http.StatusConflict, "", err.Error())
+			}
+			return brokerError(c, http.StatusInternalServerError, "", err.Error())
+		}
+	}
+
+	// with async support, hand out the credentials only once CNPG has reconciled the role
+	if acceptsIncomplete {
+		status, err := b.client.GetBindingStatus(ctx, instanceId, bindingId)
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to check role of binding %s of instance %s: %v", bindingId, instanceId, err)
+			return brokerError(c, http.StatusInternalServerError, "", err.Error())
+		}
+		if status.State != cnpg.RoleReconciled {
+			op := b.inProgressOperation(ctx, instanceId, bindingId)
+			if created || op == nil {
+				op, err = b.client.StartOperation(ctx, instanceId, cnpg.Operation{
+					Type:      cnpg.OperationBind,
+					BindingID: bindingId,
+				})
+				if err != nil {
+					logger.ErrorContext(ctx, "failed to record binding %s of instance %s: %v", bindingId, instanceId, err)
+				}
+			}
+			logger.InfoContext(ctx, "binding %s for instance %s in progress, waiting for role", bindingId, instanceId)
+			response := c.Response()
+			response.Header().Set("Retry-After", "5")
+			return c.JSON(http.StatusAccepted, operationResponse(op))
+		}
+	}
+
+	var credentials map[string]string
+	if projected != nil {
+		credentials = projectedCredentials(projected)
+	} else {
+		credentials, err = b.client.GetCredentials(ctx, instanceId, bindingId)
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to get credentials for binding %s of instance %s: %v", bindingId, instanceId, err)
+			return brokerError(c, http.StatusInternalServerError, "", err.Error())
+		}
+	}
+
+	if !created {
+		logger.InfoContext(ctx, "binding %s for instance %s already exists", bindingId, instanceId)
+		return c.JSON(http.StatusOK, map[string]any{
+			"credentials": credentials,
+		})
+	}
+	logger.InfoContext(ctx, "successfully created binding %s for instance %s", bindingId, instanceId)
+	return c.JSON(http.StatusCreated, map[string]any{
 		"credentials": credentials,
 	})
 }
@@ -245,19 +424,43 @@ func (b *Broker) BindInstance(c echo.Context) error {
 func (b *Broker) GetBinding(c echo.Context) error {
 	instanceId := c.Param("instance_id")
 	bindingId := c.Param("binding_id")
+	ctx := requestContext(c)
 
 	if err := validation.ValidateInstanceID(instanceId); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
 	if err := validation.ValidateBindingID(bindingId); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+
+	logger.DebugContext(ctx, "retrieving binding %s for instance %s", bindingId, instanceId)
+	status, err := b.client.GetBindingStatus(ctx, instanceId, bindingId)
+	if err != nil && !apierrors.IsNotFound(err) {
+		logger.ErrorContext(ctx, "failed to check role of binding %s of instance %s: %v", bindingId, instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	if err != nil || !status.SecretExists || status.Ensure != "present" {
+		logger.DebugContext(ctx, "binding %s for instance %s not found", bindingId, instanceId)
+		return brokerError(c, http.StatusNotFound, "", "binding not found")
+	}
+	if status.State != cnpg.RoleReconciled {
+		logger.DebugContext(ctx, "binding %s for instance %s is still being created", bindingId, instanceId)
+		return brokerError(c, http.StatusNotFound, "", "binding is being created")
+	}
+	if status.ProjectedSecret != nil {
+		return c.JSON(http.StatusOK, map[string]any{
+			"credentials": projectedCredentials(status.ProjectedSecret),
+		})
 	}
 
-	logger.Debug("retrieving binding %s for instance %s", bindingId, instanceId)
-	credentials, err := b.client.GetCredentials(context.Background(), instanceId)
+	credentials, err := b.client.GetCredentials(ctx, instanceId, bindingId)
 	if err != nil {
-		logger.Error("failed to get credentials for instance %s: %v", instanceId, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		if apierrors.IsNotFound(err) {
+			logger.DebugContext(ctx, "binding %s for instance %s not found", bindingId, instanceId)
+			return brokerError(c, http.StatusNotFound, "", "binding not found")
+		}
+		logger.ErrorContext(ctx, "failed to get credentials for binding %s of instance %s: %v", bindingId, instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
 	}
 
 	return c.JSON(http.StatusOK, map[string]any{
@@ -268,41 +471,166 @@ func (b *Broker) GetBinding(c echo.Context) error {
 func (b *Broker) UnbindInstance(c echo.Context) error {
 	instanceId := c.Param("instance_id")
 	bindingId := c.Param("binding_id")
+	acceptsIncomplete := c.QueryParam("accepts_incomplete") == "true"
+	ctx := requestContext(c)
 
 	if err := validation.ValidateInstanceID(instanceId); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
 	if err := validation.ValidateBindingID(bindingId); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
 
-	logger.Info("unbinding %s from instance %s (no-op)", bindingId, instanceId)
+	logger.InfoContext(ctx, "unbinding %s from instance %s", bindingId, instanceId)
+	existed, err := b.client.DeleteBinding(ctx, instanceId, bindingId)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			logger.WarnContext(ctx, "attempted to unbind %s from non-existent instance %s", bindingId, instanceId)
+			return c.JSON(http.StatusGone, map[string]any{})
+		}
+		logger.ErrorContext(ctx, "failed to drop role for binding %s of instance %s: %v", bindingId, instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	if !existed {
+		logger.WarnContext(ctx, "attempted to unbind non-existent binding %s from instance %s", bindingId, instanceId)
+		return c.JSON(http.StatusGone, map[string]any{})
+	}
+
+	if acceptsIncomplete {
+		op, err := b.client.StartOperation(ctx, instanceId, cnpg.Operation{
+			Type:      cnpg.OperationUnbind,
+			BindingID: bindingId,
+		})
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to record unbinding %s from instance %s: %v", bindingId, instanceId, err)
+		}
+		logger.InfoContext(ctx, "unbinding %s from instance %s in progress, waiting for role to be dropped", bindingId, instanceId)
+		response := c.Response()
+		response.Header().Set("Retry-After", "5")
+		return c.JSON(http.StatusAccepted, operationResponse(op))
+	}
+
+	logger.InfoContext(ctx, "successfully removed binding %s from instance %s", bindingId, instanceId)
 	return c.JSON(http.StatusOK, map[string]any{})
 }
 
+func (b *Broker) BindingLastOperation(c echo.Context) error {
+	instanceId := c.Param("instance_id")
+	bindingId := c.Param("binding_id")
+	operationId := c.QueryParam("operation")
+	ctx := requestContext(c)
+
+	if err := validation.ValidateInstanceID(instanceId); err != nil {
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+	if err := validation.ValidateBindingID(bindingId); err != nil {
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+
+	logger.DebugContext(ctx, "checking last operation [%s] of binding %s for instance %s", operationId, bindingId, instanceId)
+	var op *cnpg.Operation
+	var err error
+	if len(operationId) > 0 {
+		op, err = b.client.GetOperation(ctx, instanceId, operationId)
+		if errors.Is(err, cnpg.ErrOperationNotFound) || (err == nil && op.BindingID != bindingId) {
+			logger.WarnContext(ctx, "operation %s of binding %s not found", operationId, bindingId)
+			return brokerError(c, http.StatusNotFound, "", fmt.Sprintf("operation %s not found", operationId))
+		}
+	} else {
+		op, err = b.client.LatestOperation(ctx, instanceId, bindingId)
+		if errors.Is(err, cnpg.ErrOperationNotFound) {
+			err = nil
+		}
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to read operations of instance %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	if op != nil && op.State != cnpg.OperationInProgress {
+		if op.Type == cnpg.OperationUnbind && op.State == cnpg.OperationSucceeded {
+			return c.JSON(http.StatusGone, operationStatus(op.Type, op.State, op.Description))
+		}
+		return c.JSON(http.StatusOK, operationStatus(op.Type, op.State, op.Description))
+	}
+
+	status, err := b.client.GetBindingStatus(ctx, instanceId, bindingId)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			logger.DebugContext(ctx, "instance %s of binding %s does not exist", instanceId, bindingId)
+			return c.JSON(http.StatusGone, operationStatus(cnpg.OperationUnbind, cnpg.OperationSucceeded, "Service binding has been deleted"))
+		}
+		logger.ErrorContext(ctx, "failed to check role of binding %s of instance %s: %v", bindingId, instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	// a role CNPG dropped is removed from the managed roles, one it cannot drop is disabled instead
+	if status.Ensure == "absent" && status.State != cnpg.RolePending {
+		if pruned, err := b.client.PruneBindingRoles(ctx, instanceId); err != nil {
+			logger.ErrorContext(ctx, "failed to prune roles of instance %s: %v", instanceId, err)
+			return brokerError(c, http.StatusInternalServerError, "", err.Error())
+		} else if pruned > 0 {
+			if status, err = b.client.GetBindingStatus(ctx, instanceId, bindingId); err != nil {
+				logger.ErrorContext(ctx, "failed to check role of binding %s of instance %s: %v", bindingId, instanceId, err)
+				return brokerError(c, http.StatusInternalServerError, "", err.Error())
+			}
+		}
+	}
+
+	opType, state, description := cnpg.OperationBind, cnpg.OperationInProgress, "Binding in progress - waiting for role"
+	httpStatus := http.StatusOK
+	switch {
+	case status.Ensure == "present" && status.State == cnpg.RoleReconciled && status.SecretExists:
+		state, description = cnpg.OperationSucceeded, "Binding succeeded - role created"
+	case status.Ensure == "present" && status.State == cnpg.RoleFailed:
+		state, description = cnpg.OperationFailed, fmt.Sprintf("Binding failed: %s", status.Message)
+	case status.Ensure != "present" && status.State == cnpg.RoleReconciled:
+		opType, state, description = cnpg.OperationUnbind, cnpg.OperationSucceeded, "Service binding has been deleted"
+		httpStatus = http.StatusGone
+	case status.Ensure != "present" && status.State == cnpg.RoleFailed:
+		opType, state, description = cnpg.OperationUnbind, cnpg.OperationFailed, fmt.Sprintf("Unbinding failed: %s", status.Message)
+	case status.Ensure != "present":
+		opType, description = cnpg.OperationUnbind, "Unbinding in progress - waiting for role to be dropped"
+	}
+
+	if state == cnpg.OperationInProgress {
+		response := c.Response()
+		response.Header().Set("Retry-After", "5")
+		return c.JSON(httpStatus, operationStatus(opType, state, description))
+	}
+	if op != nil {
+		if err := b.client.FinishOperation(ctx, instanceId, op.ID, state, description); err != nil {
+			logger.WarnContext(ctx, "failed to record final state of operation %s of instance %s: %v", op.ID, instanceId, err)
+		}
+	}
+	return c.JSON(httpStatus, operationStatus(opType, state, description))
+}
+
 func (b *Broker) LastOperation(c echo.Context) error {
 	instanceID := c.Param("instance_id")
+	operationID := c.QueryParam("operation")
+	ctx := requestContext(c)
 
 	if err := validation.ValidateInstanceID(instanceID); err != nil {
-		logger.Warn("invalid instance_id: %v", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		logger.WarnContext(ctx, "invalid instance_id: %v", err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
 
-	logger.Debug("checking last operation for instance %s", instanceID)
-	nsStatus, err := b.client.GetNamespaceStatus(context.Background(), instanceID)
+	logger.DebugContext(ctx, "checking last operation [%s] for instance %s", operationID, instanceID)
+	nsStatus, err := b.client.GetNamespaceStatus(ctx, instanceID)
 	if err != nil {
-		logger.Error("failed to check namespace status for %s: %v", instanceID, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		logger.ErrorContext(ctx, "failed to check namespace status for %s: %v", instanceID, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
 	}
 	if !nsStatus.Exists {
-		logger.Debug("namespace for instance %s does not exist", instanceID)
+		logger.DebugContext(ctx, "namespace for instance %s does not exist", instanceID)
 		return c.JSON(http.StatusGone, map[string]any{
 			"state":       "succeeded",
 			"description": "Service instance has been deleted",
 		})
 	}
+
+	// the operation journal is deleted with the namespace, a terminating namespace is a deprovision in progress
 	if nsStatus.IsTerminating {
-		logger.Debug("namespace for instance %s is terminating", instanceID)
+		logger.DebugContext(ctx, "namespace for instance %s is terminating", instanceID)
 		response := c.Response()
 		response.Header().Set("Retry-After", "10")
 		return c.JSON(http.StatusOK, map[string]any{
@@ -311,157 +639,211 @@ func (b *Broker) LastOperation(c echo.Context) error {
 		})
 	}
 
-	clusterStatus, err := b.client.GetCluster(context.Background(), instanceID)
+	// evaluate the requested operation, or the latest one if the platform did not send a token
+	var op *cnpg.Operation
+	if len(operationID) > 0 {
+		op, err = b.client.GetOperation(ctx, instanceID, operationID)
+		if errors.Is(err, cnpg.ErrOperationNotFound) {
+			logger.WarnContext(ctx, "operation %s of instance %s not found", operationID, instanceID)
+			return brokerError(c, http.StatusNotFound, "", fmt.Sprintf("operation %s not found", operationID))
+		}
+	} else {
+		op, err = b.client.LatestOperation(ctx, instanceID, "")
+		if errors.Is(err, cnpg.ErrOperationNotFound) {
+			// instance without journal, e.g. provisioned by an older broker version
+			err = nil
+		}
+	}
 	if err != nil {
-		logger.Error("failed to check cluster status for %s: %v", instanceID, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		logger.ErrorContext(ctx, "failed to read operations of instance %s: %v", instanceID, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
 	}
-	if !clusterStatus.Exists {
-		logger.Debug("cluster for instance %s does not exist yet", instanceID)
+	if op != nil && op.State != cnpg.OperationInProgress {
+		return c.JSON(http.StatusOK, operationStatus(op.Type, op.State, op.Description))
+	}
+
+	clusterStatus, err := b.client.GetCluster(ctx, instanceID)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to check cluster status for %s: %v", instanceID, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+
+	opType := cnpg.OperationProvision
+	if op != nil {
+		opType = op.Type
+	}
+	state, description := b.operationState(ctx, instanceID, op, clusterStatus)
+	if state == cnpg.OperationInProgress {
+		logger.DebugContext(ctx, "%s of instance %s in progress: %s", opType, instanceID, description)
 		response := c.Response()
 		response.Header().Set("Retry-After", "10")
-		return c.JSON(http.StatusOK, map[string]any{
-			"state":       "in progress",
-			"description": "Provisioning in progress - waiting for cluster creation",
-		})
+		return c.JSON(http.StatusOK, operationStatus(opType, state, description))
 	}
-	if clusterStatus.IsFailed {
-		logger.Warn("cluster for instance %s is in failed state: %s", instanceID, clusterStatus.FailureReason)
-		return c.JSON(http.StatusOK, map[string]any{
-			"state":       "failed",
-			"description": fmt.Sprintf("Operation failed: %s", clusterStatus.FailureReason),
-		})
-	}
-	if clusterStatus.IsReady {
-		servicesReady, err := b.client.CheckServicesReady(context.Background(), instanceID)
-		if err != nil {
-			logger.Error("failed to check services for %s: %v", instanceID, err)
-			servicesReady = true
+
+	if state == cnpg.OperationFailed {
+		logger.WarnContext(ctx, "%s of instance %s failed: %s", opType, instanceID, description)
+	} else {
+		logger.DebugContext(ctx, "%s of instance %s succeeded: %s", opType, instanceID, description)
+		if opType == cnpg.OperationProvision {
+			if err := b.client.RemoveRestoreCopies(ctx, instanceID); err != nil {
+				logger.WarnContext(ctx, "failed to remove the restore copies of instance %s: %v", instanceID, err)
+			}
 		}
-		if !servicesReady {
-			logger.Debug("cluster for instance %s is ready but services not ready", instanceID)
-			response := c.Response()
-			response.Header().Set("Retry-After", "10")
-			return c.JSON(http.StatusOK, map[string]any{
-				"state": "in progress",
-				"description": fmt.Sprintf("Provisioning in progress - %d/%d instances ready, waiting for services",
-					clusterStatus.ReadyInstances, clusterStatus.Instances),
-			})
+	}
+	if op != nil {
+		if err := b.client.FinishOperation(ctx, instanceID, op.ID, state, description); err != nil {
+			logger.WarnContext(ctx, "failed to record final state of operation %s of instance %s: %v", op.ID, instanceID, err)
 		}
-
-		logger.Debug("cluster for instance %s is fully ready", instanceID)
-		return c.JSON(http.StatusOK, map[string]any{
-			"state": "succeeded",
-			"description": fmt.Sprintf("Operation succeeded - %d/%d instances ready",
-				clusterStatus.ReadyInstances, clusterStatus.Instances),
-		})
 	}
-
-	logger.Debug("cluster for instance %s is provisioning: %d/%d instances ready",
-		instanceID, clusterStatus.ReadyInstances, clusterStatus.Instances)
-	response := c.Response()
-	response.Header().Set("Retry-After", "10")
-	return c.JSON(http.StatusOK, map[string]any{
-		"state": "in progress",
-		"description": fmt.Sprintf("Operation in progress - %d/%d instances ready",
-			clusterStatus.ReadyInstances, clusterStatus.Instances),
-	})
+	return c.JSON(http.StatusOK, operationStatus(opType, state, description))
 }
 
 func (b *Broker) UpdateInstance(c echo.Context) error {
 	instanceId := c.Param("instance_id")
 	acceptsIncomplete := c.QueryParam("accepts_incomplete") == "true"
+	ctx := requestContext(c)
 
 	if err := validation.ValidateInstanceID(instanceId); err != nil {
-		logger.Warn("invalid instance_id: %v", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		logger.WarnContext(ctx, "invalid instance_id: %v", err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
 
 	var req struct {
-		ServiceID string         `json:"service_id"`
-		PlanID    string         `json:"plan_id"`
-		Context   map[string]any `json:"context"`
+		ServiceID  string         `json:"service_id"`
+		PlanID     string         `json:"plan_id"`
+		Context    map[string]any `json:"context"`
+		Parameters map[string]any `json:"parameters"`
 	}
 	if err := c.Bind(&req); err != nil {
-		logger.Error("failed to parse update request for %s: %v", instanceId, err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		logger.ErrorContext(ctx, "failed to parse update request for %s: %v", instanceId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+	if len(req.PlanID) > 0 {
+		ctx = logger.With(ctx, "plan_id", req.PlanID)
 	}
 
 	if err := validation.ValidateServiceID(req.ServiceID); err != nil {
-		logger.Warn("invalid service_id [%s] for %s: %v", req.ServiceID, instanceId, err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		logger.WarnContext(ctx, "invalid service_id [%s] for %s: %v", req.ServiceID, instanceId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
 	}
 	if err := validation.ValidatePlanID(req.ServiceID, req.PlanID); err != nil {
-		logger.Warn("invalid plan_id [%s] for %s: %v", req.PlanID, instanceId, err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		logger.WarnContext(ctx, "invalid plan_id [%s] for %s: %v", req.PlanID, instanceId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+
+	plan, err := catalog.GetPlan(req.ServiceID, req.PlanID)
+	if err != nil {
+		logger.WarnContext(ctx, "invalid plan_id [%s] for %s: %v", req.PlanID, instanceId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+	if errs := validation.ValidateParameters(plan.UpdateSchema(), req.Parameters); len(errs) > 0 {
+		logger.WarnContext(ctx, "invalid update parameters for %s: %v", instanceId, errs)
+		return invalidParameters(c, errs)
+	}
+	var params cnpg.InstanceParameters
+	if err := decodeParameters(req.Parameters, &params); err != nil {
+		logger.WarnContext(ctx, "failed to decode update parameters for %s: %v", instanceId, err)
+		return brokerError(c, http.StatusBadRequest, "", err.Error())
+	}
+	if errs := validation.ValidatePostgresqlParameters(params.PostgresqlParameters); len(errs) > 0 {
+		logger.WarnContext(ctx, "invalid update parameters for %s: %v", instanceId, errs)
+		return invalidParameters(c, errs)
+	}
+	if err := validatePostgresVersion(params.PostgresVersion); err != nil {
+		logger.WarnContext(ctx, "invalid update parameters for %s: %v", instanceId, err)
+		return invalidParameters(c, []*validation.ValidationError{err})
 	}
 
-	existingCluster, err := b.client.GetCluster(context.Background(), instanceId)
+	existingCluster, err := b.client.GetCluster(ctx, instanceId)
 	if err != nil {
-		logger.Error("failed to get instance %s: %v", instanceId, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		logger.ErrorContext(ctx, "failed to get instance %s: %v", instanceId, err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
 	}
 	if !existingCluster.Exists {
-		logger.Warn("attempted to update non-existent instance %s", instanceId)
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "instance not found"})
+		logger.WarnContext(ctx, "attempted to update non-existent instance %s", instanceId)
+		return brokerError(c, http.StatusNotFound, "", "instance not found")
 	}
 	if len(existingCluster.ServiceID) > 0 && existingCluster.ServiceID != req.ServiceID {
-		logger.Warn("cannot change service_id for %s: %s -> %s", instanceId, existingCluster.ServiceID, req.ServiceID)
-		return c.JSON(http.StatusUnprocessableEntity, map[string]string{
-			"error": "cannot change service_id",
-		})
+		logger.WarnContext(ctx, "cannot change service_id for %s: %s -> %s", instanceId, existingCluster.ServiceID, req.ServiceID)
+		return updateError(c, http.StatusUnprocessableEntity, "cannot change service_id", true, false)
+	}
+	currentVersion := existingCluster.PostgresVersion
+	if len(currentVersion) == 0 {
+		currentVersion = existingCluster.Parameters.PostgresVersion
+	}
+	if err := validateExposureVersion(plan, params.PostgresVersion, currentVersion); err != nil {
+		logger.WarnContext(ctx, "invalid update of %s: %v", instanceId, err)
+		return invalidParameters(c, []*validation.ValidationError{err})
 	}
 
-	newInstances, newCPU, newMemory, newStorage := catalog.PlanSpec(req.PlanID)
+	newInstances, newStorage := plan.Metadata.Instances, plan.Metadata.Storage
 	if newInstances < existingCluster.Instances {
-		logger.Warn("cannot downgrade number of instances for %s: %d -> %d", instanceId, existingCluster.Instances, newInstances)
-		return c.JSON(http.StatusUnprocessableEntity, map[string]string{
-			"error": "cannot decrease number of instances",
-		})
+		logger.WarnContext(ctx, "cannot downgrade number of instances for %s: %d -> %d", instanceId, existingCluster.Instances, newInstances)
+		return updateError(c, http.StatusUnprocessableEntity, "cannot decrease number of instances", true, false)
 	}
 
 	existingStorage := parseStorage(existingCluster.Storage)
 	newStorageBytes := parseStorage(newStorage)
 	if newStorageBytes < existingStorage {
-		logger.Warn("cannot downgrade storage for %s: %s -> %s", instanceId, existingCluster.Storage, newStorage)
-		return c.JSON(http.StatusUnprocessableEntity, map[string]string{
-			"error": "cannot decrease storage size",
-		})
+		logger.WarnContext(ctx, "cannot downgrade storage for %s: %s -> %s", instanceId, existingCluster.Storage, newStorage)
+		return updateError(c, http.StatusUnprocessableEntity, "cannot decrease storage size", true, false)
 	}
 
-	if existingCluster.PlanID == req.PlanID && existingCluster.IsReady {
-		logger.Info("instance %s already at target plan %s and ready", instanceId, req.PlanID)
+	if existingCluster.PlanID == req.PlanID && len(req.Parameters) == 0 && existingCluster.IsReady {
+		logger.InfoContext(ctx, "instance %s already at target plan %s and ready", instanceId, req.PlanID)
 		return c.JSON(http.StatusOK, map[string]any{})
 	}
-	if existingCluster.PlanID == req.PlanID && existingCluster.IsProvisioning {
+	if existingCluster.PlanID == req.PlanID && len(req.Parameters) == 0 && existingCluster.IsProvisioning {
 		if acceptsIncomplete {
-			logger.Info("instance %s update to plan %s in progress", instanceId, req.PlanID)
-			return c.JSON(http.StatusAccepted, map[string]any{})
+			logger.InfoContext(ctx, "instance %s update to plan %s in progress", instanceId, req.PlanID)
+			return c.JSON(http.StatusAccepted, operationResponse(b.inProgressOperation(ctx, instanceId, "")))
 		}
-		return c.JSON(http.StatusUnprocessableEntity, map[string]any{
-			"error":       "AsyncRequired",
-			"description": "Service instance update is in progress and requires async support",
-		})
+		return asyncRequired(c, "Service instance update is in progress and requires async support")
+	}
+	if existingCluster.IsProvisioning {
+		logger.WarnContext(ctx, "attempted to update instance %s while another operation is in progress", instanceId)
+		return concurrencyError(c, "Another operation for this service instance is in progress")
+	}
+
+	// the version is merged onto the parameters of the instance, so only a different one upgrades it
+	var upgradeTo string
+	if len(params.PostgresVersion) > 0 && params.PostgresVersion != existingCluster.PostgresVersion {
+		reason, err := b.checkMajorUpgrade(ctx, instanceId, existingCluster, params.PostgresVersion)
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to check major upgrade of instance %s: %v", instanceId, err)
+			return brokerError(c, http.StatusInternalServerError, "", err.Error())
+		}
+		if len(reason) > 0 {
+			logger.WarnContext(ctx, "refused major upgrade of instance %s to %s: %s", instanceId, params.PostgresVersion, reason)
+			return updateError(c, http.StatusUnprocessableEntity, reason, true, false)
+		}
+		upgradeTo = params.PostgresVersion
 	}
 
 	if !acceptsIncomplete {
-		return c.JSON(http.StatusUnprocessableEntity, map[string]any{
-			"error":       "AsyncRequired",
-			"description": "This service plan requires client support for asynchronous service operations",
-		})
+		return asyncRequired(c, "This service plan requires client support for asynchronous service operations")
 	}
 
-	logger.Info("starting async update for instance %s to plan %s", instanceId, req.PlanID)
-	if err := b.client.UpdateCluster(context.Background(), instanceId, req.PlanID,
-		newInstances, newCPU, newMemory, newStorage); err != nil {
-		logger.Error("failed to start update for instance %s: %v", instanceId, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	logger.InfoContext(ctx, "starting async update for instance %s to plan %s", instanceId, req.PlanID)
+	generation, err := b.client.UpdateCluster(ctx, instanceId, req.ServiceID, req.PlanID, params)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to start update for instance %s: %v", instanceId, err)
+		return updateError(c, http.StatusInternalServerError, err.Error(), true, true)
+	}
+	op, err := b.client.StartOperation(ctx, instanceId, cnpg.Operation{
+		Type:            cnpg.OperationUpdate,
+		PlanID:          req.PlanID,
+		Generation:      generation,
+		PostgresVersion: upgradeTo,
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to record update of instance %s: %v", instanceId, err)
 	}
 
-	logger.Info("update initiated for instance %s", instanceId)
+	logger.InfoContext(ctx, "update initiated for instance %s", instanceId)
 	response := c.Response()
 	response.Header().Set("Retry-After", "10")
-	return c.JSON(http.StatusAccepted, map[string]any{})
+	return c.JSON(http.StatusAccepted, operationResponse(op))
 }
 
 func parseStorage(storage string) int64 {
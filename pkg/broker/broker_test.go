@@ -0,0 +1,1231 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnpg-broker/pkg/audit"
+	"github.com/cnpg-broker/pkg/catalog"
+	"github.com/cnpg-broker/pkg/cnpg"
+	"github.com/cnpg-broker/pkg/cnpg/cnpgtest"
+	"github.com/cnpg-broker/pkg/config"
+	"github.com/labstack/echo/v4"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+)
+
+func TestMain(m *testing.M) {
+	cnpgtest.LoadCatalog()
+	os.Exit(m.Run())
+}
+
+func newTestServer(core []runtime.Object, objects []runtime.Object) (*echo.Echo, *dynamicfake.FakeDynamicClient, kubernetes.Interface) {
+	dynClient, clientset := cnpgtest.NewClients(core, objects)
+	e := echo.New()
+	New(cnpg.NewClientFromInterfaces(dynClient, clientset), audit.New(nil)).RegisterRoutes(e)
+	return e, dynClient, clientset
+}
+
+// serve sends an OSB API request with the given headers to the broker
+func serve(e *echo.Echo, method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("X-Broker-API-Version", "2.17")
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// serveJSON sends an OSB API request to the broker and decodes its response
+func serveJSON(t *testing.T, e *echo.Echo, method, path, body string) (int, map[string]any) {
+	t.Helper()
+	rec := serve(e, method, path, body, nil)
+	var response map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response body of %s %s: %v", method, path, err)
+	}
+	return rec.Code, response
+}
+
+func TestBrokerHandlers(t *testing.T) {
+	instancePath := "/v2/service_instances/" + cnpgtest.InstanceID
+	provisionBody := `{"service_id":"` + cnpgtest.ServiceID + `","plan_id":"` + cnpgtest.DevSmall + `"}`
+	bindingPath := instancePath + "/service_bindings/" + cnpgtest.BindingID
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		header     map[string]string
+		body       string
+		core       []runtime.Object
+		clusters   []runtime.Object
+		wantStatus int
+		wantBody   map[string]any
+		check      func(t *testing.T, dynClient *dynamicfake.FakeDynamicClient)
+	}{
+		{
+			name:       "catalog",
+			method:     http.MethodGet,
+			path:       "/v2/catalog",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "catalog not modified",
+			method:     http.MethodGet,
+			path:       "/v2/catalog",
+			header:     map[string]string{"If-None-Match": catalog.ETag()},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:       "missing API version",
+			method:     http.MethodGet,
+			path:       "/v2/catalog",
+			header:     map[string]string{"X-Broker-API-Version": ""},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "unsupported API version",
+			method:     http.MethodGet,
+			path:       "/v2/catalog",
+			header:     map[string]string{"X-Broker-API-Version": "2.12"},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "invalid originating identity",
+			method:     http.MethodPut,
+			path:       instancePath + "?accepts_incomplete=true",
+			header:     map[string]string{"X-Broker-API-Originating-Identity": "kubernetes not-base64"},
+			body:       provisionBody,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "provision with invalid instance_id",
+			method:     http.MethodPut,
+			path:       "/v2/service_instances/not-a-uuid?accepts_incomplete=true",
+			body:       provisionBody,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "provision with unknown plan",
+			method:     http.MethodPut,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       `{"service_id":"` + cnpgtest.ServiceID + `","plan_id":"` + cnpgtest.HAMedium + `"}`,
+			wantStatus: http.StatusBadRequest,
+			check: func(t *testing.T, dynClient *dynamicfake.FakeDynamicClient) {
+				list, _ := dynClient.Resource(cnpgtest.ClusterResource).Namespace(cnpgtest.InstanceID).List(context.Background(), metav1.ListOptions{})
+				if len(list.Items) > 0 {
+					t.Error("expected no cluster to be created for an unknown plan")
+				}
+			},
+		},
+		{
+			name:       "update to unknown plan",
+			method:     http.MethodPatch,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       `{"service_id":"` + cnpgtest.ServiceID + `","plan_id":"` + cnpgtest.HAMedium + `"}`,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "provision with invalid parameters",
+			method:     http.MethodPut,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       `{"service_id":"` + cnpgtest.ServiceID + `","plan_id":"` + cnpgtest.DevSmall + `","parameters":{"postgres_version":"9"}}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "provision requires async",
+			method:     http.MethodPut,
+			path:       instancePath,
+			body:       provisionBody,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   map[string]any{"error": "AsyncRequired"},
+		},
+		{
+			name:   "provision",
+			method: http.MethodPut,
+			path:   instancePath + "?accepts_incomplete=true",
+			body:   provisionBody,
+			header: map[string]string{
+				// {"username":"alice"}
+				"X-Broker-API-Originating-Identity": "kubernetes eyJ1c2VybmFtZSI6ImFsaWNlIn0=",
+			},
+			wantStatus: http.StatusAccepted,
+			check: func(t *testing.T, dynClient *dynamicfake.FakeDynamicClient) {
+				cluster, err := dynClient.Resource(cnpgtest.ClusterResource).Namespace(cnpgtest.InstanceID).
+					Get(context.Background(), "db-"+cnpgtest.InstanceID, metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("cluster was not created: %v", err)
+				}
+				if planId := cluster.GetAnnotations()["cnpg-broker.io/plan-id"]; planId != cnpgtest.DevSmall {
+					t.Errorf("expected plan-id annotation %s, got %s", cnpgtest.DevSmall, planId)
+				}
+				if createdBy := cluster.GetAnnotations()["cnpg-broker.io/created-by"]; createdBy != "kubernetes/alice" {
+					t.Errorf("expected created-by annotation kubernetes/alice, got %s", createdBy)
+				}
+			},
+		},
+		{
+			name:       "provision while deprovision is in progress",
+			method:     http.MethodPut,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       provisionBody,
+			core:       []runtime.Object{cnpgtest.Namespace(true)},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   map[string]any{"error": "ConcurrencyError"},
+		},
+		{
+			name:       "provision of existing ready instance",
+			method:     http.MethodPut,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       provisionBody,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "provision of existing instance in progress",
+			method:     http.MethodPut,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       provisionBody,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 0, "Setting up primary")},
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "provision of existing instance in progress requires async",
+			method:     http.MethodPut,
+			path:       instancePath,
+			body:       provisionBody,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 0, "Setting up primary")},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   map[string]any{"error": "AsyncRequired"},
+		},
+		{
+			name:       "provision conflict with different plan",
+			method:     http.MethodPut,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       provisionBody,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevMedium, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "get instance",
+			method:     http.MethodGet,
+			path:       instancePath,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"plan_id": cnpgtest.DevSmall},
+		},
+		{
+			name:       "get unknown instance",
+			method:     http.MethodGet,
+			path:       instancePath,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "update of unknown instance",
+			method:     http.MethodPatch,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       `{"service_id":"` + cnpgtest.ServiceID + `","plan_id":"` + cnpgtest.DevMedium + `"}`,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "update to larger plan",
+			method:     http.MethodPatch,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       `{"service_id":"` + cnpgtest.ServiceID + `","plan_id":"` + cnpgtest.DevMedium + `"}`,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusAccepted,
+			check: func(t *testing.T, dynClient *dynamicfake.FakeDynamicClient) {
+				cluster, err := dynClient.Resource(cnpgtest.ClusterResource).Namespace(cnpgtest.InstanceID).
+					Get(context.Background(), "db-"+cnpgtest.InstanceID, metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("failed to get cluster: %v", err)
+				}
+				size, _, _ := unstructured.NestedString(cluster.Object, "spec", "storage", "size")
+				if size != "5Gi" {
+					t.Errorf("expected storage size 5Gi, got %s", size)
+				}
+			},
+		},
+		{
+			name:       "update requires async",
+			method:     http.MethodPatch,
+			path:       instancePath,
+			body:       `{"service_id":"` + cnpgtest.ServiceID + `","plan_id":"` + cnpgtest.DevMedium + `"}`,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   map[string]any{"error": "AsyncRequired"},
+		},
+		{
+			name:       "update to same plan",
+			method:     http.MethodPatch,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       provisionBody,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "update while another operation is in progress",
+			method:     http.MethodPatch,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       `{"service_id":"` + cnpgtest.ServiceID + `","plan_id":"` + cnpgtest.DevMedium + `"}`,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 0, "Setting up primary")},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   map[string]any{"error": "ConcurrencyError"},
+		},
+		{
+			name:       "update rejects storage downgrade",
+			method:     http.MethodPatch,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       provisionBody,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevMedium, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   map[string]any{"description": "cannot decrease storage size", "instance_usable": true, "update_repeatable": false},
+		},
+		{
+			name:       "update rejects instances downgrade",
+			method:     http.MethodPatch,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       `{"service_id":"` + cnpgtest.HAService + `","plan_id":"` + cnpgtest.HASmall + `"}`,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.HAService, cnpgtest.HAMedium, 3, "Cluster in healthy state")},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   map[string]any{"description": "cannot decrease number of instances", "instance_usable": true, "update_repeatable": false},
+		},
+		{
+			name:       "update rejects change of service",
+			method:     http.MethodPatch,
+			path:       instancePath + "?accepts_incomplete=true",
+			body:       `{"service_id":"` + cnpgtest.HAService + `","plan_id":"` + cnpgtest.HAMedium + `"}`,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   map[string]any{"description": "cannot change service_id", "instance_usable": true, "update_repeatable": false},
+		},
+		{
+			name:       "deprovision of unknown instance",
+			method:     http.MethodDelete,
+			path:       instancePath + "?accepts_incomplete=true",
+			wantStatus: http.StatusGone,
+		},
+		{
+			name:       "deprovision requires async",
+			method:     http.MethodDelete,
+			path:       instancePath,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   map[string]any{"error": "AsyncRequired"},
+		},
+		{
+			name:       "deprovision",
+			method:     http.MethodDelete,
+			path:       instancePath + "?accepts_incomplete=true",
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "deprovision in progress",
+			method:     http.MethodDelete,
+			path:       instancePath + "?accepts_incomplete=true",
+			core:       []runtime.Object{cnpgtest.Namespace(true)},
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "last_operation of deleted instance",
+			method:     http.MethodGet,
+			path:       instancePath + "/last_operation",
+			wantStatus: http.StatusGone,
+			wantBody:   map[string]any{"state": "succeeded"},
+		},
+		{
+			name:       "last_operation while namespace terminates",
+			method:     http.MethodGet,
+			path:       instancePath + "/last_operation",
+			core:       []runtime.Object{cnpgtest.Namespace(true)},
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"state": "in progress"},
+		},
+		{
+			// the operation journal is deleted with the namespace
+			name:       "last_operation of deprovision while namespace terminates",
+			method:     http.MethodGet,
+			path:       instancePath + "/last_operation?operation=deprovision-0123456789abcdef",
+			core:       []runtime.Object{cnpgtest.Namespace(true)},
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"state": "in progress"},
+		},
+		{
+			name:       "last_operation of deprovision of deleted instance",
+			method:     http.MethodGet,
+			path:       instancePath + "/last_operation?operation=deprovision-0123456789abcdef",
+			wantStatus: http.StatusGone,
+			wantBody:   map[string]any{"state": "succeeded"},
+		},
+		{
+			name:       "last_operation before cluster exists",
+			method:     http.MethodGet,
+			path:       instancePath + "/last_operation",
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"state": "in progress"},
+		},
+		{
+			name:       "last_operation while instances start",
+			method:     http.MethodGet,
+			path:       instancePath + "/last_operation",
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.HAService, cnpgtest.HAMedium, 1, "Creating replica")},
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"state": "in progress"},
+		},
+		{
+			name:       "last_operation while waiting for load balancer",
+			method:     http.MethodGet,
+			path:       instancePath + "/last_operation",
+			core:       []runtime.Object{cnpgtest.Namespace(false), cnpgtest.LoadBalancer(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"state": "in progress"},
+		},
+		{
+			name:       "last_operation of ready instance",
+			method:     http.MethodGet,
+			path:       instancePath + "/last_operation",
+			core:       []runtime.Object{cnpgtest.Namespace(false), cnpgtest.LoadBalancer(true)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"state": "succeeded"},
+		},
+		{
+			name:       "last_operation of unknown operation",
+			method:     http.MethodGet,
+			path:       instancePath + "/last_operation?operation=update-0123456789abcdef",
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "last_operation of failed instance",
+			method:     http.MethodGet,
+			path:       instancePath + "/last_operation",
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 0, "Failed to create primary")},
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"state": "failed", "instance_usable": false},
+		},
+		{
+			name:       "async bind waits for role",
+			method:     http.MethodPut,
+			path:       bindingPath + "?accepts_incomplete=true",
+			body:       provisionBody,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusAccepted,
+			check: func(t *testing.T, dynClient *dynamicfake.FakeDynamicClient) {
+				cluster, err := dynClient.Resource(cnpgtest.ClusterResource).Namespace(cnpgtest.InstanceID).Get(context.Background(), "db-"+cnpgtest.InstanceID, metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("failed to get cluster: %v", err)
+				}
+				roles, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "managed", "roles")
+				if len(roles) != 1 {
+					t.Errorf("expected 1 managed role, got %d", len(roles))
+				}
+			},
+		},
+		{
+			name:       "bind instance of a plan removed from the catalog",
+			method:     http.MethodPut,
+			path:       bindingPath,
+			body:       provisionBody,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, "7c1e9a52-0d3b-4f6e-a8c2-5b4d3e2f1a09", 1, "Cluster in healthy state")},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "bind with secret_name requires a namespace",
+			method:     http.MethodPut,
+			path:       bindingPath,
+			body:       `{"service_id":"` + cnpgtest.ServiceID + `","plan_id":"` + cnpgtest.DevSmall + `","parameters":{"secret_name":"db"}}`,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "get unknown binding",
+			method:     http.MethodGet,
+			path:       bindingPath,
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "binding last_operation of deleted instance",
+			method:     http.MethodGet,
+			path:       bindingPath + "/last_operation",
+			wantStatus: http.StatusGone,
+		},
+		{
+			name:       "binding last_operation of unknown operation",
+			method:     http.MethodGet,
+			path:       bindingPath + "/last_operation?operation=bind-0123456789abcdef",
+			core:       []runtime.Object{cnpgtest.Namespace(false)},
+			clusters:   []runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")},
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, dynClient, _ := newTestServer(tt.core, tt.clusters)
+			rec := serve(e, tt.method, tt.path, tt.body, tt.header)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if len(tt.wantBody) > 0 {
+				var body map[string]any
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+					t.Fatalf("failed to decode response body: %v", err)
+				}
+				for key, want := range tt.wantBody {
+					if body[key] != want {
+						t.Errorf("expected %s to be %v, got %v", key, want, body[key])
+					}
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, dynClient)
+			}
+		})
+	}
+}
+
+func TestOperationJournal(t *testing.T) {
+	instancePath := "/v2/service_instances/" + cnpgtest.InstanceID
+	e, _, _ := newTestServer([]runtime.Object{cnpgtest.Namespace(false), cnpgtest.LoadBalancer(true)},
+		[]runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")})
+
+	do := func(method, path, body string) (int, map[string]any) {
+		return serveJSON(t, e, method, path, body)
+	}
+
+	// the old pods are still ready right after the PATCH, the update must not be reported as succeeded yet
+	status, response := do(http.MethodPatch, instancePath+"?accepts_incomplete=true",
+		`{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevMedium+`"}`)
+	if status != http.StatusAccepted {
+		t.Fatalf("expected update to be accepted, got %d: %v", status, response)
+	}
+	update, ok := response["operation"].(string)
+	if !ok || !strings.HasPrefix(update, "update-") {
+		t.Fatalf("expected update operation token, got %v", response["operation"])
+	}
+	status, response = do(http.MethodGet, instancePath+"/last_operation?operation="+update, "")
+	if status != http.StatusOK || response["state"] != "in progress" {
+		t.Errorf("expected update to be in progress, got %d: %v", status, response)
+	}
+	status, response = do(http.MethodGet, instancePath+"/last_operation", "")
+	if status != http.StatusOK || response["state"] != "in progress" {
+		t.Errorf("expected latest operation to be in progress, got %d: %v", status, response)
+	}
+
+	status, response = do(http.MethodDelete, instancePath+"?accepts_incomplete=true", "")
+	if status != http.StatusAccepted {
+		t.Fatalf("expected deprovision to be accepted, got %d: %v", status, response)
+	}
+	if deprovision, _ := response["operation"].(string); !strings.HasPrefix(deprovision, "deprovision-") {
+		t.Errorf("expected deprovision operation token, got %v", response["operation"])
+	}
+	status, response = do(http.MethodGet, instancePath+"/last_operation?operation="+update, "")
+	if status != http.StatusGone {
+		t.Errorf("expected deleted instance to be gone, got %d: %v", status, response)
+	}
+}
+
+func TestOperationStatus(t *testing.T) {
+	tests := []struct {
+		opType, state string
+		want          map[string]any
+	}{
+		{cnpg.OperationProvision, cnpg.OperationFailed, map[string]any{"instance_usable": false}},
+		{cnpg.OperationUpdate, cnpg.OperationFailed, map[string]any{"instance_usable": true, "update_repeatable": true}},
+		{cnpg.OperationDeprovision, cnpg.OperationFailed, map[string]any{}},
+		{cnpg.OperationProvision, cnpg.OperationSucceeded, map[string]any{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.opType+" "+tt.state, func(t *testing.T) {
+			status := operationStatus(tt.opType, tt.state, "")
+			for _, key := range []string{"instance_usable", "update_repeatable"} {
+				if status[key] != tt.want[key] {
+					t.Errorf("expected %s %v, got %v", key, tt.want[key], status[key])
+				}
+			}
+		})
+	}
+}
+
+func TestOrphanCleanup(t *testing.T) {
+	svc := cnpgtest.LoadBalancer(true)
+	svc.Labels = map[string]string{"cnpg-broker.io/instance-id": cnpgtest.InstanceID}
+	svc.CreationTimestamp = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	dynClient, clientset := cnpgtest.NewClients([]runtime.Object{svc}, nil)
+	auditor := audit.New(nil)
+	e := echo.New()
+	New(cnpg.NewClientFromInterfaces(dynClient, clientset), auditor).RegisterRoutes(e)
+	id := "loadbalancer-without-cluster/" + cnpgtest.InstanceID + "/" + svc.Name
+
+	status, response := serveJSON(t, e, http.MethodGet, "/admin/orphans", "")
+	if orphans, _ := response["orphans"].([]any); status != http.StatusOK || len(orphans) != 1 {
+		t.Fatalf("expected 1 orphan, got %d: %v", status, response)
+	}
+
+	status, response = serveJSON(t, e, http.MethodPost, "/admin/orphans/cleanup", `{"ids":["`+id+`"]}`)
+	token, _ := response["confirm"].(string)
+	if status != http.StatusOK || response["dry_run"] != true || len(token) == 0 {
+		t.Fatalf("expected a dry run with confirm token, got %d: %v", status, response)
+	}
+	if _, err := clientset.CoreV1().Services(cnpgtest.InstanceID).Get(context.Background(), svc.Name, metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected a dry run to keep the service: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"without confirmation", `{"ids":["` + id + `"],"dry_run":false}`, http.StatusBadRequest},
+		{"confirmation of other orphans", `{"ids":["` + id + `","unknown"],"dry_run":false,"confirm":"` + token + `"}`, http.StatusConflict},
+		{"confirmed", `{"ids":["` + id + `"],"dry_run":false,"confirm":"` + token + `"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := serve(e, http.MethodPost, "/admin/orphans/cleanup", tt.body, nil); rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+	if _, err := clientset.CoreV1().Services(cnpgtest.InstanceID).Get(context.Background(), svc.Name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the confirmed cleanup to delete the service, got %v", err)
+	}
+
+	entries := auditor.Recent("")
+	if len(entries) != 4 {
+		t.Fatalf("expected an audit entry per cleanup request, got %v", entries)
+	}
+	last := entries[len(entries)-1]
+	if last.Operation != "cleanup-orphans" || last.Parameters["dry_run"] != false || !slices.Contains(last.Objects, "Service "+cnpgtest.InstanceID+"/"+svc.Name) {
+		t.Errorf("expected the cleanup and its deleted service to be audited, got %+v", last)
+	}
+}
+
+func TestSecretProjection(t *testing.T) {
+	bindingPath := "/v2/service_instances/" + cnpgtest.InstanceID + "/service_bindings/" + cnpgtest.BindingID
+	appSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-" + cnpgtest.InstanceID + "-app", Namespace: cnpgtest.InstanceID},
+		Data:       map[string][]byte{"host": []byte("db-" + cnpgtest.InstanceID + "-rw"), "dbname": []byte("app")},
+	}
+	e, _, clientset := newTestServer([]runtime.Object{cnpgtest.Namespace(false), appSecret},
+		[]runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		return serve(e, method, path, body, nil)
+	}
+
+	rec := do(http.MethodPut, bindingPath, `{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevSmall+`",`+
+		`"context":{"platform":"kubernetes","namespace":"consumer"},"parameters":{"secret_name":"orders-db"}}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected bind to return %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Credentials map[string]string `json:"credentials"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode response body: %v", err)
+	}
+	if body.Credentials["secret_namespace"] != "consumer" || body.Credentials["secret_name"] != "orders-db" {
+		t.Errorf("expected credentials to reference consumer/orders-db, got %v", body.Credentials)
+	}
+	if _, ok := body.Credentials["password"]; ok {
+		t.Error("expected projected credentials not to contain the password")
+	}
+
+	secret, err := clientset.CoreV1().Secrets("consumer").Get(context.Background(), "orders-db", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get projected secret: %v", err)
+	}
+	if secret.Type != "servicebinding.io/postgresql" {
+		t.Errorf("expected projected secret of type servicebinding.io/postgresql, got %s", secret.Type)
+	}
+	for _, key := range []string{"type", "provider", "host", "port", "username", "password", "database", "uri"} {
+		if _, ok := secret.Data[key]; !ok {
+			t.Errorf("expected projected secret to contain %s", key)
+		}
+	}
+
+	if rec := do(http.MethodDelete, bindingPath, ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected unbind to return %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if _, err := clientset.CoreV1().Secrets("consumer").Get(context.Background(), "orders-db", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected projected secret to be deleted, got %v", err)
+	}
+
+	// a Secret the broker did not project is never overwritten
+	if _, err := clientset.CoreV1().Secrets("consumer").Create(context.Background(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "orders-db", Namespace: "consumer"},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create secret: %v", err)
+	}
+	projectionNamespaces := config.Get().Projection.Namespaces
+	config.Get().Projection.Namespaces = []string{"shared"}
+	defer func() { config.Get().Projection.Namespaces = projectionNamespaces }()
+	tests := []struct {
+		name       string
+		context    string
+		parameters string
+		wantStatus int
+	}{
+		{"existing secret", `{"platform":"kubernetes","namespace":"consumer"}`, `{"secret_name":"orders-db"}`, http.StatusConflict},
+		{"other namespace on kubernetes", `{"platform":"kubernetes","namespace":"consumer"}`, `{"secret_namespace":"kube-system"}`, http.StatusBadRequest},
+		{"namespace not allowed", `{"platform":"cloudfoundry"}`, `{"secret_namespace":"kube-system"}`, http.StatusBadRequest},
+		{"namespace required", `{"platform":"cloudfoundry"}`, `{"secret_name":"orders-db"}`, http.StatusBadRequest},
+		{"allowed namespace", `{"platform":"cloudfoundry"}`, `{"secret_namespace":"shared","secret_name":"orders-db"}`, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(http.MethodPut, bindingPath, `{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevSmall+`",`+
+				`"context":`+tt.context+`,"parameters":`+tt.parameters+`}`)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected bind to return %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	instancePath := "/v2/service_instances/" + cnpgtest.InstanceID
+	e, _, _ := newTestServer([]runtime.Object{cnpgtest.Namespace(false), cnpgtest.LoadBalancer(true)},
+		[]runtime.Object{cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		return serve(e, method, path, body, nil)
+	}
+
+	do(http.MethodPatch, instancePath+"?accepts_incomplete=true",
+		`{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevMedium+`","parameters":{"timezone":"UTC"}}`)
+	do(http.MethodGet, instancePath+"/last_operation", "")
+	do(http.MethodDelete, instancePath+"?accepts_incomplete=true&service_id="+cnpgtest.ServiceID+"&plan_id="+cnpgtest.DevMedium, "")
+
+	rec := do(http.MethodGet, "/admin/audit/"+cnpgtest.InstanceID, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Entries []audit.Entry `json:"entries"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode response body: %v", err)
+	}
+	if len(body.Entries) != 2 {
+		t.Fatalf("expected an entry for the update and the deprovision, got %d", len(body.Entries))
+	}
+
+	update, deprovision := body.Entries[0], body.Entries[1]
+	if update.Operation != "update" || update.Status != http.StatusAccepted || update.PlanID != cnpgtest.DevMedium {
+		t.Errorf("unexpected update entry: %+v", update)
+	}
+	if update.Parameters["timezone"] != "UTC" {
+		t.Errorf("expected update parameters to be recorded, got %v", update.Parameters)
+	}
+	if !slices.Contains(update.Objects, "Cluster "+cnpgtest.InstanceID+"/db-"+cnpgtest.InstanceID) {
+		t.Errorf("expected update to touch the cluster, got %v", update.Objects)
+	}
+	if deprovision.Operation != "deprovision" || !slices.Contains(deprovision.Objects, "Namespace "+cnpgtest.InstanceID) {
+		t.Errorf("unexpected deprovision entry: %+v", deprovision)
+	}
+	if err := audit.Verify(nil, body.Entries); err != nil {
+		t.Errorf("expected a valid hash chain: %v", err)
+	}
+	if status, response := serveJSON(t, e, http.MethodGet, "/admin/audit/verify", ""); status != http.StatusOK || response["valid"] != true {
+		t.Errorf("expected the audit sinks to be valid, got %d: %v", status, response)
+	}
+
+	// bodies are read in full for the audit log, oversized ones are rejected before
+	oversized := `{"parameters":{"timezone":"` + strings.Repeat("x", 2<<20) + `"}}`
+	for _, path := range []string{instancePath + "?accepts_incomplete=true", "/admin/orphans/cleanup"} {
+		method := http.MethodPatch
+		if strings.HasPrefix(path, "/admin/") {
+			method = http.MethodPost
+		}
+		if rec := do(method, path, oversized); rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected an oversized body to be rejected with %d, got %d", http.StatusRequestEntityTooLarge, rec.Code)
+		}
+	}
+}
+
+func TestDefaultPlan(t *testing.T) {
+	const unknownPlan = "7c1e9a52-0d3b-4f6e-a8c2-5b4d3e2f1a09"
+	defaultPlanId := config.Get().DefaultPlanID
+	defer func() { config.Get().DefaultPlanID = defaultPlanId }()
+
+	instancePath := "/v2/service_instances/" + cnpgtest.InstanceID + "?accepts_incomplete=true"
+	unknownPlanBody := `{"service_id":"` + cnpgtest.ServiceID + `","plan_id":"` + unknownPlan + `"}`
+
+	config.Get().DefaultPlanID = ""
+	e, _, _ := newTestServer(nil, nil)
+	if rec := serve(e, http.MethodPut, instancePath, unknownPlanBody, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected provision of an unknown plan without default to return %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+	}
+
+	config.Get().DefaultPlanID = cnpgtest.DevMedium
+	e, dynClient, _ := newTestServer(nil, nil)
+	if rec := serve(e, http.MethodPut, instancePath, unknownPlanBody, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected provision of an unknown plan to return %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body.String())
+	}
+	if planId := cnpgtest.GetCluster(t, dynClient).GetAnnotations()["cnpg-broker.io/plan-id"]; planId != cnpgtest.DevMedium {
+		t.Errorf("expected the default plan %s to be provisioned, got %s", cnpgtest.DevMedium, planId)
+	}
+
+	// the default plan does not apply to other services
+	haBody := `{"service_id":"` + cnpgtest.HAService + `","plan_id":"` + unknownPlan + `"}`
+	if rec := serve(e, http.MethodPut, "/v2/service_instances/5d8e2b1a-7c3f-4e6a-9b0d-1f2e3a4b5c6d?accepts_incomplete=true", haBody, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected provision of an unknown plan of another service to return %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+	}
+
+	cnpgtest.SetReady(t, dynClient)
+	if rec := serve(e, http.MethodPatch, instancePath, unknownPlanBody, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected update to an unknown plan to return %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+	}
+}
+
+func TestPlanOverlay(t *testing.T) {
+	original := cnpgtest.ReadCatalog(t)
+	overlays := strings.Replace(original, "      storage: 1Gi\n", "      storage: 1Gi\n"+
+		"      clusterSpec:\n"+
+		"        monitoring:\n"+
+		"          enablePodMonitor: true\n"+
+		"        postgresql:\n"+
+		"          parameters:\n"+
+		"            max_connections: \"100\"\n", 1)
+	overlays = strings.Replace(overlays, "      storage: 5Gi\n", "      storage: 5Gi\n"+
+		"      clusterSpec:\n"+
+		"        postgresql:\n"+
+		"          parameters:\n"+
+		"            work_mem: 8MB\n", 1)
+	cnpgtest.UseCatalog(t, overlays)
+
+	instancePath := "/v2/service_instances/" + cnpgtest.InstanceID
+	e, dynClient, _ := newTestServer(nil, nil)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		return serve(e, method, path, body, nil)
+	}
+
+	// settings managed by the operator are rejected
+	rec := do(http.MethodPut, instancePath+"?accepts_incomplete=true", `{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevSmall+`",`+
+		`"parameters":{"postgresql_parameters":{"port":"5433","shared_preload_libraries":"auto_explain","work_mem":"8MB"}}}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "parameters.postgresql_parameters.port") ||
+		!strings.Contains(rec.Body.String(), "parameters.postgresql_parameters.shared_preload_libraries") {
+		t.Fatalf("expected provision to return %d for port and shared_preload_libraries, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+	}
+
+	rec = do(http.MethodPut, instancePath+"?accepts_incomplete=true", `{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevSmall+`",`+
+		`"parameters":{"postgresql_parameters":{"statement_timeout":"30s"}}}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected provision to return %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body.String())
+	}
+	cluster := cnpgtest.GetCluster(t, dynClient)
+	if enabled, _, _ := unstructured.NestedBool(cluster.Object, "spec", "monitoring", "enablePodMonitor"); !enabled {
+		t.Error("expected the plan overlay to enable the pod monitor")
+	}
+	parameters, _, _ := unstructured.NestedStringMap(cluster.Object, "spec", "postgresql", "parameters")
+	if parameters["max_connections"] != "100" || parameters["statement_timeout"] != "30s" {
+		t.Errorf("expected parameters of plan and instance, got %v", parameters)
+	}
+
+	// the update requires a ready cluster
+	cnpgtest.SetReady(t, dynClient)
+	rec = do(http.MethodPatch, instancePath+"?accepts_incomplete=true", `{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevMedium+`"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected update to return %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body.String())
+	}
+	cluster = cnpgtest.GetCluster(t, dynClient)
+	if _, found, _ := unstructured.NestedFieldNoCopy(cluster.Object, "spec", "monitoring", "enablePodMonitor"); found {
+		t.Error("expected the overlay of the previous plan to be removed")
+	}
+	parameters, _, _ = unstructured.NestedStringMap(cluster.Object, "spec", "postgresql", "parameters")
+	if _, found := parameters["max_connections"]; found || parameters["work_mem"] != "8MB" || parameters["statement_timeout"] != "30s" {
+		t.Errorf("expected parameters of the new plan and the instance, got %v", parameters)
+	}
+}
+
+func TestRetriedProvision(t *testing.T) {
+	instancePath := "/v2/service_instances/" + cnpgtest.InstanceID
+	e, dynClient, clientset := newTestServer(nil, nil)
+	do := func(parameters, username string) *httptest.ResponseRecorder {
+		return serve(e, http.MethodPut, instancePath+"?accepts_incomplete=true",
+			`{"service_id":"`+cnpgtest.HAService+`","plan_id":"`+cnpgtest.HASmall+`","parameters":`+parameters+`}`,
+			map[string]string{"X-Broker-API-Originating-Identity": "kubernetes " + username})
+	}
+	const alice, bob = "eyJ1c2VybmFtZSI6ImFsaWNlIn0=", "eyJ1c2VybmFtZSI6ImJvYiJ9"
+
+	if rec := do(`{"timezone":"UTC"}`, alice); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected provision to return %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body.String())
+	}
+	// a provision failing half way leaves the instance without its pooler and its services
+	ctx := context.Background()
+	if err := dynClient.Resource(cnpgtest.PoolerResource).Namespace(cnpgtest.InstanceID).Delete(ctx, "db-"+cnpgtest.InstanceID+"-pooler", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete pooler: %v", err)
+	}
+	if err := clientset.CoreV1().Services(cnpgtest.InstanceID).Delete(ctx, "db-"+cnpgtest.InstanceID+"-lb-pooler", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete service: %v", err)
+	}
+	// the image the instance was created with is kept, even if the catalog has a newer one by now
+	cluster := cnpgtest.GetCluster(t, dynClient)
+	const image = "ghcr.io/cloudnative-pg/postgresql:17.0"
+	_ = unstructured.SetNestedField(cluster.Object, image, "spec", "imageName")
+	if _, err := dynClient.Resource(cnpgtest.ClusterResource).Namespace(cnpgtest.InstanceID).Update(ctx, cluster, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update cluster: %v", err)
+	}
+
+	if rec := do(`{"postgres_version":"16","postgresql_parameters":{"work_mem":"8MB"}}`, bob); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected retried provision to return %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body.String())
+	}
+	if _, err := dynClient.Resource(cnpgtest.PoolerResource).Namespace(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID+"-pooler", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the retried provision to apply the pooler: %v", err)
+	}
+	if _, err := clientset.CoreV1().Services(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID+"-lb-pooler", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the retried provision to apply the pooler service: %v", err)
+	}
+	cluster = cnpgtest.GetCluster(t, dynClient)
+	if managers := cluster.GetManagedFields(); len(managers) == 0 || managers[0].Manager != "cnpg-broker" {
+		t.Errorf("expected the cluster to be managed by cnpg-broker, got %v", managers)
+	}
+	if imageName, _, _ := unstructured.NestedString(cluster.Object, "spec", "imageName"); imageName != image {
+		t.Errorf("expected the image %s to be kept, got %s", image, imageName)
+	}
+	if createdBy := cluster.GetAnnotations()["cnpg-broker.io/created-by"]; createdBy != "kubernetes/alice" {
+		t.Errorf("expected created-by annotation kubernetes/alice to be kept, got %s", createdBy)
+	}
+	parameters, _, _ := unstructured.NestedStringMap(cluster.Object, "spec", "postgresql", "parameters")
+	if parameters["timezone"] != "UTC" || parameters["work_mem"] != "8MB" {
+		t.Errorf("expected the parameters of both requests to be merged, got %v", parameters)
+	}
+
+	// a ready instance is left untouched
+	cnpgtest.SetReady(t, dynClient)
+	if err := dynClient.Resource(cnpgtest.PoolerResource).Namespace(cnpgtest.InstanceID).Delete(ctx, "db-"+cnpgtest.InstanceID+"-pooler", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete pooler: %v", err)
+	}
+	if rec := do(`{"timezone":"Europe/Berlin"}`, bob); rec.Code != http.StatusOK {
+		t.Fatalf("expected provision of a ready instance to return %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if _, err := dynClient.Resource(cnpgtest.PoolerResource).Namespace(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID+"-pooler", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected a ready instance not to be converged, got %v", err)
+	}
+}
+
+func TestExposure(t *testing.T) {
+	original := cnpgtest.ReadCatalog(t)
+	invalid := strings.Replace(original, "      storage: 1Gi\n", "      storage: 1Gi\n"+
+		"      exposure:\n"+
+		"        mode: Ingress\n", 1)
+	if _, err := catalog.Update(context.Background(), []byte(invalid), "test", nil); err == nil || !strings.Contains(err.Error(), "unknown mode") {
+		t.Fatalf("expected an unknown exposure mode to be rejected, got %v", err)
+	}
+	exposures := strings.Replace(original, "      storage: 1Gi\n", "      storage: 1Gi\n"+
+		"      exposure:\n"+
+		"        mode: NodePort\n"+
+		"        nodeAddress: 192.0.2.10\n", 1)
+	exposures = strings.Replace(exposures, "      storage: 5Gi\n", "      storage: 5Gi\n"+
+		"      exposure:\n"+
+		"        mode: none\n", 1)
+	cnpgtest.UseCatalog(t, exposures)
+
+	instancePath := "/v2/service_instances/" + cnpgtest.InstanceID
+	serviceName := "db-" + cnpgtest.InstanceID + "-lb-rw"
+	e, dynClient, clientset := newTestServer(nil, nil)
+	client := cnpg.NewClientFromInterfaces(dynClient, clientset)
+	ctx := context.Background()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		return serve(e, method, path, body, nil)
+	}
+
+	rec := do(http.MethodPut, instancePath+"?accepts_incomplete=true", `{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevSmall+`"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected provision to return %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body.String())
+	}
+	svc, err := clientset.CoreV1().Services(cnpgtest.InstanceID).Get(ctx, serviceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	if svc.Spec.Type != corev1.ServiceTypeNodePort {
+		t.Errorf("expected a NodePort service, got %s", svc.Spec.Type)
+	}
+	if ready, err := client.CheckServicesReady(ctx, cnpgtest.InstanceID); err != nil || ready {
+		t.Errorf("expected a service without node port not to be ready, got %t, %v", ready, err)
+	}
+	svc.Spec.Ports[0].NodePort = 30432
+	if _, err := clientset.CoreV1().Services(cnpgtest.InstanceID).Update(ctx, svc, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update service: %v", err)
+	}
+	if ready, err := client.CheckServicesReady(ctx, cnpgtest.InstanceID); err != nil || !ready {
+		t.Errorf("expected a service with node port to be ready, got %t, %v", ready, err)
+	}
+
+	// the update requires a ready cluster
+	cnpgtest.SetReady(t, dynClient)
+	rec = do(http.MethodPatch, instancePath+"?accepts_incomplete=true", `{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevMedium+`"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected update to return %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body.String())
+	}
+	if _, err := clientset.CoreV1().Services(cnpgtest.InstanceID).Get(ctx, serviceName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the service to be deleted by a plan without exposure, got %v", err)
+	}
+	if ready, err := client.CheckServicesReady(ctx, cnpgtest.InstanceID); err != nil || !ready {
+		t.Errorf("expected an instance without exposure to be ready, got %t, %v", ready, err)
+	}
+}
+
+func TestTLSRouteVersion(t *testing.T) {
+	cnpgtest.UseCatalog(t, strings.Replace(cnpgtest.ReadCatalog(t), "      storage: 1Gi\n", "      storage: 1Gi\n"+
+		"      postgresVersion: \"17\"\n"+
+		"      exposure:\n"+
+		"        mode: TLSRoute\n"+
+		"        gateway:\n"+
+		"          name: postgres\n"+
+		"        hostname: \"{instance_id}.db.example.com\"\n", 1))
+
+	instancePath := "/v2/service_instances/" + cnpgtest.InstanceID
+	e, dynClient, _ := newTestServer(nil, nil)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		return serve(e, method, path, body, nil)
+	}
+
+	rec := do(http.MethodPut, instancePath+"?accepts_incomplete=true",
+		`{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevSmall+`","parameters":{"postgres_version":"16"}}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "requires PostgreSQL 17") {
+		t.Fatalf("expected a TLSRoute provision of PostgreSQL 16 to return %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+	}
+
+	// an instance on PostgreSQL 16 cannot move to a plan exposed with a TLSRoute
+	rec = do(http.MethodPut, instancePath+"?accepts_incomplete=true",
+		`{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevMedium+`","parameters":{"postgres_version":"16"}}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected provision to return %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body.String())
+	}
+	cnpgtest.SetReady(t, dynClient)
+	rec = do(http.MethodPatch, instancePath+"?accepts_incomplete=true", `{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevSmall+`"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "requires PostgreSQL 17") {
+		t.Errorf("expected an update of PostgreSQL 16 to a TLSRoute plan to return %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+	}
+}
+
+func TestPoolerSettings(t *testing.T) {
+	instancePath := "/v2/service_instances/" + cnpgtest.InstanceID
+	e, dynClient, clientset := newTestServer(nil, nil)
+	ctx := context.Background()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		return serve(e, method, path, body, nil)
+	}
+
+	// a single instance plan gets a pooler if the instance enables it
+	rec := do(http.MethodPut, instancePath+"?accepts_incomplete=true", `{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevSmall+`",`+
+		`"parameters":{"pooler":{"enabled":true,"pool_mode":"transaction","default_pool_size":20}}}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected provision to return %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body.String())
+	}
+	pooler, err := dynClient.Resource(cnpgtest.PoolerResource).Namespace(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID+"-pooler", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected a pooler: %v", err)
+	}
+	pgbouncer, _, _ := unstructured.NestedMap(pooler.Object, "spec", "pgbouncer")
+	if pgbouncer["poolMode"] != "transaction" || pgbouncer["parameters"].(map[string]any)["default_pool_size"] != "20" {
+		t.Errorf("expected the pooler settings of the instance, got %v", pgbouncer)
+	}
+	if _, err := dynClient.Resource(cnpgtest.PoolerResource).Namespace(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID+"-pooler-ro", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected no ro pooler for a single instance, got %v", err)
+	}
+	if _, err := clientset.CoreV1().Services(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID+"-lb-pooler", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected a pooler service: %v", err)
+	}
+
+	rec = do(http.MethodGet, instancePath, "")
+	var instance struct {
+		Poolers []cnpg.PoolerStatus `json:"poolers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &instance); err != nil {
+		t.Fatalf("failed to decode instance: %v", err)
+	}
+	if len(instance.Poolers) != 1 || instance.Poolers[0].Type != "rw" || instance.Poolers[0].PoolMode != "transaction" {
+		t.Errorf("expected the pooler status in the instance, got %+v", instance.Poolers)
+	}
+
+	// the update requires a ready cluster
+	cnpgtest.SetReady(t, dynClient)
+	rec = do(http.MethodPatch, instancePath+"?accepts_incomplete=true", `{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevSmall+`",`+
+		`"parameters":{"pooler":{"enabled":false}}}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected update to return %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body.String())
+	}
+	if _, err := dynClient.Resource(cnpgtest.PoolerResource).Namespace(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID+"-pooler", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the disabled pooler to be deleted, got %v", err)
+	}
+	if _, err := clientset.CoreV1().Services(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID+"-lb-pooler", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the pooler service to be deleted, got %v", err)
+	}
+}
+
+func TestMajorUpgrade(t *testing.T) {
+	instancePath := "/v2/service_instances/" + cnpgtest.InstanceID
+	cluster := cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")
+	_ = unstructured.SetNestedField(cluster.Object, "ghcr.io/cloudnative-pg/postgresql:16", "spec", "imageName")
+	_ = unstructured.SetNestedSlice(cluster.Object, []any{map[string]any{
+		"name":       "barman-cloud.cloudnative-pg.io",
+		"parameters": map[string]any{"barmanObjectName": "db-" + cnpgtest.InstanceID + "-backup"},
+	}}, "spec", "plugins")
+	_ = unstructured.SetNestedField(cluster.Object, int64(16), "status", "pgDataImageInfo", "majorVersion")
+	e, dynClient, _ := newTestServer([]runtime.Object{cnpgtest.Namespace(false), cnpgtest.LoadBalancer(true)}, []runtime.Object{cluster})
+	ctx := context.Background()
+	do := func(method, path, body string) (int, map[string]any) {
+		return serveJSON(t, e, method, path, body)
+	}
+	upgradeTo := func(version string) (int, map[string]any) {
+		return do(http.MethodPatch, instancePath+"?accepts_incomplete=true", `{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevSmall+`",`+
+			`"parameters":{"postgres_version":"`+version+`"}}`)
+	}
+
+	status, response := upgradeTo("15")
+	if status != http.StatusUnprocessableEntity || !strings.Contains(response["description"].(string), "downgrade") {
+		t.Errorf("expected downgrade to be refused, got %d: %v", status, response)
+	}
+	status, response = upgradeTo("17")
+	if status != http.StatusUnprocessableEntity || !strings.Contains(response["description"].(string), "backup") {
+		t.Errorf("expected upgrade without recent backup to be refused, got %d: %v", status, response)
+	}
+
+	backup := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "postgresql.cnpg.io/v1",
+		"kind":       "Backup",
+		"metadata":   map[string]any{"name": "db-" + cnpgtest.InstanceID + "-manual", "namespace": cnpgtest.InstanceID},
+		"status": map[string]any{
+			"phase":     "completed",
+			"stoppedAt": time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+		},
+	}}
+	if _, err := dynClient.Resource(cnpgtest.BackupResource).Namespace(cnpgtest.InstanceID).Create(ctx, backup, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create backup: %v", err)
+	}
+	status, response = upgradeTo("17")
+	if status != http.StatusAccepted {
+		t.Fatalf("expected upgrade to be accepted, got %d: %v", status, response)
+	}
+	upgrade := response["operation"].(string)
+	updated, err := dynClient.Resource(cnpgtest.ClusterResource).Namespace(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get cluster: %v", err)
+	}
+	if imageName, _, _ := unstructured.NestedString(updated.Object, "spec", "imageName"); imageName != "ghcr.io/cloudnative-pg/postgresql:17" {
+		t.Errorf("expected the image of version 17, got %s", imageName)
+	}
+
+	// the pods are ready, but the operator has not upgraded the data directory yet
+	status, response = do(http.MethodGet, instancePath+"/last_operation?operation="+upgrade, "")
+	if status != http.StatusOK || response["state"] != "in progress" || !strings.Contains(response["description"].(string), "Major upgrade to PostgreSQL 17") {
+		t.Errorf("expected major upgrade to be in progress, got %d: %v", status, response)
+	}
+
+	_ = unstructured.SetNestedField(updated.Object, int64(17), "status", "pgDataImageInfo", "majorVersion")
+	// the fake API server does not bump the generation, the Ready condition must refer to the update
+	_ = unstructured.SetNestedSlice(updated.Object, []any{map[string]any{
+		"type": "Ready", "status": "True", "observedGeneration": max(updated.GetGeneration(), 1),
+	}}, "status", "conditions")
+	if _, err := dynClient.Resource(cnpgtest.ClusterResource).Namespace(cnpgtest.InstanceID).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update cluster status: %v", err)
+	}
+	status, response = do(http.MethodGet, instancePath+"/last_operation?operation="+upgrade, "")
+	if status != http.StatusOK || response["state"] != "succeeded" {
+		t.Errorf("expected major upgrade to succeed, got %d: %v", status, response)
+	}
+}
+
+func TestRestoreOwnership(t *testing.T) {
+	instancePath := "/v2/service_instances/" + cnpgtest.InstanceID
+	sourceId := "5d8e2b1a-7c3f-4e6a-9b0d-1f2e3a4b5c6d"
+	source := cnpgtest.Cluster(cnpgtest.ServiceID, cnpgtest.DevSmall, 1, "Cluster in healthy state")
+	source.SetName("db-" + sourceId)
+	source.SetNamespace(sourceId)
+	source.SetAnnotations(map[string]string{"cnpg-broker.io/owner": "kubernetes/orders"})
+	var core []runtime.Object
+	for _, name := range []string{"db-" + sourceId + "-replication", "db-" + sourceId + "-ca"} {
+		core = append(core, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: sourceId}})
+	}
+	e, dynClient, clientset := newTestServer(core, []runtime.Object{source})
+	ctx := context.Background()
+	clone := func(namespace string) (int, map[string]any) {
+		return serveJSON(t, e, http.MethodPut, instancePath+"?accepts_incomplete=true", `{"service_id":"`+cnpgtest.ServiceID+`","plan_id":"`+cnpgtest.DevSmall+`",`+
+			`"context":{"platform":"kubernetes","namespace":"`+namespace+`"},`+
+			`"parameters":{"restore_from_instance":"`+sourceId+`","restore_method":"pg_basebackup"}}`)
+	}
+
+	if status, response := clone("payments"); status != http.StatusForbidden {
+		t.Fatalf("expected a restore from an instance of another namespace to be forbidden, got %d: %v", status, response)
+	}
+	if status, response := clone("orders"); status != http.StatusAccepted {
+		t.Fatalf("expected a restore from an instance of the same namespace to be accepted, got %d: %v", status, response)
+	}
+	if owner := cnpgtest.GetCluster(t, dynClient).GetAnnotations()["cnpg-broker.io/owner"]; owner != "kubernetes/orders" {
+		t.Errorf("expected the clone to be owned by kubernetes/orders, got %q", owner)
+	}
+	replicationSecret := "db-" + sourceId + "-replication"
+	if _, err := clientset.CoreV1().Secrets(cnpgtest.InstanceID).Get(ctx, replicationSecret, metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected the replication secret of the source to be copied: %v", err)
+	}
+
+	// the copies are removed once the bootstrap finished
+	cnpgtest.SetReady(t, dynClient)
+	svc, err := clientset.CoreV1().Services(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID+"-lb-rw", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}}
+	if _, err := clientset.CoreV1().Services(cnpgtest.InstanceID).UpdateStatus(ctx, svc, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update service: %v", err)
+	}
+	if status, response := serveJSON(t, e, http.MethodGet, instancePath+"/last_operation", ""); status != http.StatusOK || response["state"] != "succeeded" {
+		t.Fatalf("expected the clone to succeed, got %d: %v", status, response)
+	}
+	for _, name := range []string{replicationSecret, "db-" + sourceId + "-ca"} {
+		if _, err := clientset.CoreV1().Secrets(cnpgtest.InstanceID).Get(ctx, name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("expected the copy of secret %s to be deleted, got %v", name, err)
+		}
+	}
+	if _, err := clientset.CoreV1().Secrets(sourceId).Get(ctx, replicationSecret, metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the secret of the source to be kept: %v", err)
+	}
+}
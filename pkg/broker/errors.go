@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Error codes defined by the OSB API spec for the "error" field of an error response
+const (
+	errAsyncRequired    = "AsyncRequired"
+	errConcurrencyError = "ConcurrencyError"
+)
+
+// ErrorResponse is the body of all error responses, as defined by the OSB API spec
+type ErrorResponse struct {
+	Error            string `json:"error,omitempty"`
+	Description      string `json:"description,omitempty"`
+	InstanceUsable   *bool  `json:"instance_usable,omitempty"`
+	UpdateRepeatable *bool  `json:"update_repeatable,omitempty"`
+}
+
+// brokerError responds with an OSB error, code is one of the error codes of the spec or empty
+func brokerError(c echo.Context, status int, code, description string) error {
+	return c.JSON(status, ErrorResponse{
+		Error:       code,
+		Description: description,
+	})
+}
+
+// updateError responds with an OSB error for a failed update, telling the platform whether the
+// instance is still usable and whether repeating the same update could succeed
+func updateError(c echo.Context, status int, description string, instanceUsable, updateRepeatable bool) error {
+	return c.JSON(status, ErrorResponse{
+		Description:      description,
+		InstanceUsable:   &instanceUsable,
+		UpdateRepeatable: &updateRepeatable,
+	})
+}
+
+func asyncRequired(c echo.Context, description string) error {
+	return brokerError(c, http.StatusUnprocessableEntity, errAsyncRequired, description)
+}
+
+func concurrencyError(c echo.Context, description string) error {
+	return brokerError(c, http.StatusUnprocessableEntity, errConcurrencyError, description)
+}
+
+// requestContext returns the context for k8s operations of a request. It carries the request values,
+// e.g. the originating identity, but is not canceled if the platform goes away mid-operation.
+func requestContext(c echo.Context) context.Context {
+	return context.WithoutCancel(c.Request().Context())
+}
@@ -3,18 +3,27 @@ package broker
 import (
 	"crypto/subtle"
 
+	"github.com/cnpg-broker/pkg/audit"
+	"github.com/cnpg-broker/pkg/cnpg"
 	"github.com/cnpg-broker/pkg/config"
+	"github.com/cnpg-broker/pkg/logger"
+	"github.com/cnpg-broker/pkg/metrics"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
+// bodyLimit is the maximum size of request bodies, which are read in full by the audit middleware
+const bodyLimit = "1M"
+
 type Handler struct {
-	broker *Broker
+	broker  *Broker
+	auditor *audit.Auditor
 }
 
-func New() *Handler {
+func New(client cnpg.ClusterBackend, auditor *audit.Auditor) *Handler {
 	return &Handler{
-		broker: NewBroker(),
+		broker:  NewBroker(client),
+		auditor: auditor,
 	}
 }
 
@@ -22,28 +31,30 @@ func (h *Handler) RegisterRoutes(e *echo.Echo) {
 	g := e.Group("/v2")
 	cfg := config.Get()
 
-	// don't show timestamp unless specifically configured
-	format := `remote_ip="${remote_ip}", host="${host}", method=${method}, uri=${uri}, user_agent="${user_agent}", ` +
-		`status=${status}, error="${error}", latency_human="${latency_human}", bytes_out=${bytes_out}` + "\n"
-	if cfg.LogTimestamp {
-		format = `time="${time_rfc3339}", ` + format
-	}
-	// add logger middleware
-	g.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-		Format: format,
-	}))
+	// add logger middleware, log lines of a request carry its instance and binding
+	g.Use(logger.AccessLog())
+	g.Use(logger.RouteParams("instance_id", "binding_id"))
+	g.Use(metrics.Middleware())
+	g.Use(middleware.BodyLimit(bodyLimit))
 
 	// add auth middleware
+	var auth echo.MiddlewareFunc
 	if cfg.Username != "" && cfg.Password != "" {
-		g.Use(middleware.BasicAuth(func(u, p string, c echo.Context) (bool, error) {
+		auth = middleware.BasicAuth(func(u, p string, c echo.Context) (bool, error) {
 			if subtle.ConstantTimeCompare([]byte(u), []byte(cfg.Username)) == 1 &&
 				subtle.ConstantTimeCompare([]byte(p), []byte(cfg.Password)) == 1 {
 				return true, nil
 			}
 			return false, nil
-		}))
+		})
+		g.Use(auth)
 	}
 
+	// OSB API version check and originating identity, state-changing requests are audited
+	g.Use(apiVersion)
+	g.Use(originatingIdentity)
+	g.Use(auditRequests(h.auditor))
+
 	g.GET("/catalog", h.broker.GetCatalog)
 	g.PUT("/service_instances/:instance_id", h.broker.ProvisionInstance)
 	g.PATCH("/service_instances/:instance_id", h.broker.UpdateInstance)
@@ -53,4 +64,22 @@ func (h *Handler) RegisterRoutes(e *echo.Echo) {
 	g.PUT("/service_instances/:instance_id/service_bindings/:binding_id", h.broker.BindInstance)
 	g.GET("/service_instances/:instance_id/service_bindings/:binding_id", h.broker.GetBinding)
 	g.DELETE("/service_instances/:instance_id/service_bindings/:binding_id", h.broker.UnbindInstance)
+	g.GET("/service_instances/:instance_id/service_bindings/:binding_id/last_operation", h.broker.BindingLastOperation)
+
+	// broker specific extensions
+	g.GET("/service_instances/:instance_id/backups", h.broker.ListBackups)
+	g.POST("/service_instances/:instance_id/backups", h.broker.CreateBackup)
+
+	// admin endpoints, not part of the OSB API, the orphan cleanup is audited
+	admin := e.Group("/admin")
+	admin.Use(logger.AccessLog())
+	admin.Use(middleware.BodyLimit(bodyLimit))
+	if auth != nil {
+		admin.Use(auth)
+	}
+	admin.Use(auditRequests(h.auditor))
+	admin.GET("/audit/verify", h.VerifyAudit)
+	admin.GET("/audit/:instance_id", h.AuditEntries)
+	admin.GET("/orphans", h.broker.ListOrphans)
+	admin.POST("/orphans/cleanup", h.broker.CleanupOrphans)
 }
@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cnpg-broker/pkg/identity"
+	"github.com/cnpg-broker/pkg/logger"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	apiVersionHeader = "X-Broker-API-Version"
+	// minAPIVersion is the oldest OSB API version the broker supports, originating identities were added in 2.13
+	minAPIVersionMajor = 2
+	minAPIVersionMinor = 13
+)
+
+// apiVersion rejects requests without a supported X-Broker-API-Version header with 412 Precondition Failed
+func apiVersion(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		version := c.Request().Header.Get(apiVersionHeader)
+		if !supportedAPIVersion(version) {
+			logger.WarnContext(c.Request().Context(), "rejecting request with unsupported API version [%s]", version)
+			return brokerError(c, http.StatusPreconditionFailed, "",
+				fmt.Sprintf("unsupported %s [%s], requires %d.%d or later within major version %d",
+					apiVersionHeader, version, minAPIVersionMajor, minAPIVersionMinor, minAPIVersionMajor))
+		}
+		return next(c)
+	}
+}
+
+func supportedAPIVersion(version string) bool {
+	majorStr, minorStr, found := strings.Cut(strings.TrimSpace(version), ".")
+	if !found {
+		return false
+	}
+	major, err := strconv.Atoi(majorStr)
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(minorStr)
+	if err != nil {
+		return false
+	}
+	return major == minAPIVersionMajor && minor >= minAPIVersionMinor
+}
+
+// originatingIdentity decodes the X-Broker-API-Originating-Identity header into the request context
+func originatingIdentity(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Request().Header.Get(identity.Header)
+		if len(header) == 0 {
+			return next(c)
+		}
+
+		id, err := identity.Parse(header)
+		if err != nil {
+			logger.WarnContext(c.Request().Context(), "rejecting request with invalid originating identity: %v", err)
+			return brokerError(c, http.StatusBadRequest, "", fmt.Sprintf("invalid %s: %v", identity.Header, err))
+		}
+		ctx := logger.With(identity.NewContext(c.Request().Context(), id), "user", id.String())
+		if c.Request().Method != http.MethodGet {
+			logger.InfoContext(ctx, "%s %s requested by %s", c.Request().Method, c.Request().URL.Path, id)
+		}
+		c.SetRequest(c.Request().WithContext(ctx))
+		return next(c)
+	}
+}
@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cnpg-broker/pkg/cnpg"
+	"github.com/cnpg-broker/pkg/logger"
+)
+
+// updateGracePeriod is how long an update is considered in progress if the operator does not report
+// the generation its Ready condition was observed for, as the old pods stay ready until they are rolled
+const updateGracePeriod = 30 * time.Second
+
+// operationState derives the state of an in progress operation from the current state of its cluster.
+// Without an operation, i.e. for instances without journal, the cluster is evaluated like a provision.
+func (b *Broker) operationState(ctx context.Context, instanceId string, op *cnpg.Operation, cluster *cnpg.ClusterInfo) (string, string) {
+	opType := cnpg.OperationProvision
+	if op != nil {
+		opType = op.Type
+	}
+
+	switch opType {
+	case cnpg.OperationDeprovision:
+		// the namespace exists and is not terminating yet
+		return cnpg.OperationInProgress, "Deprovision in progress - waiting for namespace deletion"
+
+	case cnpg.OperationUpdate:
+		if !cluster.Exists {
+			return cnpg.OperationFailed, "Update failed: cluster not found"
+		}
+		if cluster.IsFailed {
+			return cnpg.OperationFailed, fmt.Sprintf("Update failed: %s", cluster.FailureReason)
+		}
+		// the operator reports the new major version once it upgraded the data directory
+		if len(op.PostgresVersion) > 0 && cluster.PostgresVersion != op.PostgresVersion {
+			return cnpg.OperationInProgress, fmt.Sprintf("Major upgrade to PostgreSQL %s in progress - %s",
+				op.PostgresVersion, cluster.Phase)
+		}
+		rolledOut := time.Since(op.StartedAt) >= updateGracePeriod
+		if cluster.ObservedGeneration > 0 {
+			rolledOut = cluster.ObservedGeneration >= op.Generation
+		}
+		if cluster.IsReady && rolledOut {
+			return cnpg.OperationSucceeded, fmt.Sprintf("Update succeeded - %d/%d instances ready",
+				cluster.ReadyInstances, cluster.Instances)
+		}
+		return cnpg.OperationInProgress, fmt.Sprintf("Update in progress - %d/%d instances ready, %s",
+			cluster.ReadyInstances, cluster.Instances, cluster.Phase)
+	}
+
+	if !cluster.Exists {
+		return cnpg.OperationInProgress, "Provisioning in progress - waiting for cluster creation"
+	}
+	if cluster.IsFailed {
+		return cnpg.OperationFailed, fmt.Sprintf("Operation failed: %s", cluster.FailureReason)
+	}
+	if !cluster.IsReady {
+		return cnpg.OperationInProgress, fmt.Sprintf("Operation in progress - %d/%d instances ready",
+			cluster.ReadyInstances, cluster.Instances)
+	}
+
+	servicesReady, err := b.client.CheckServicesReady(ctx, instanceId)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to check services for %s: %v", instanceId, err)
+		servicesReady = true
+	}
+	if !servicesReady {
+		return cnpg.OperationInProgress, fmt.Sprintf("Provisioning in progress - %d/%d instances ready, waiting for services",
+			cluster.ReadyInstances, cluster.Instances)
+	}
+	return cnpg.OperationSucceeded, fmt.Sprintf("Operation succeeded - %d/%d instances ready",
+		cluster.ReadyInstances, cluster.Instances)
+}
+
+// operationStatus is the last_operation response for an operation of opType
+func operationStatus(opType, state, description string) map[string]any {
+	status := map[string]any{
+		"state":       state,
+		"description": description,
+	}
+	if state == cnpg.OperationFailed {
+		// a failed provision leaves nothing usable behind, a failed update leaves the instance usable and can be retried
+		switch opType {
+		case cnpg.OperationProvision:
+			status["instance_usable"] = false
+		case cnpg.OperationUpdate:
+			status["instance_usable"] = true
+			status["update_repeatable"] = true
+		}
+	}
+	return status
+}
+
+// operationResponse is the body of an accepted async request, carrying the operation token if there is one
+func operationResponse(op *cnpg.Operation) map[string]any {
+	if op == nil {
+		return map[string]any{}
+	}
+	return map[string]any{"operation": op.ID}
+}
+
+// inProgressOperation returns the latest operation of a binding, or of the instance itself if bindingId
+// is empty, if it is still in progress, or nil
+func (b *Broker) inProgressOperation(ctx context.Context, instanceId, bindingId string) *cnpg.Operation {
+	op, err := b.client.LatestOperation(ctx, instanceId, bindingId)
+	if err != nil || op.State != cnpg.OperationInProgress {
+		return nil
+	}
+	return op
+}
@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/cnpg-broker/pkg/cnpg"
+	"github.com/cnpg-broker/pkg/logger"
+	"github.com/labstack/echo/v4"
+)
+
+// ListOrphans returns the inconsistencies between the instances and the objects in the cluster
+func (b *Broker) ListOrphans(c echo.Context) error {
+	ctx := requestContext(c)
+	orphans, err := b.client.FindOrphans(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to find orphans: %v", err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	if orphans == nil {
+		orphans = []cnpg.Orphan{}
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"orphans": orphans,
+	})
+}
+
+// cleanupRequest selects the orphans to clean up. It is a dry run unless dry_run is false, which
+// requires the confirm token of a dry run of the same orphans.
+type cleanupRequest struct {
+	IDs     []string `json:"ids"`
+	DryRun  *bool    `json:"dry_run"`
+	Confirm string   `json:"confirm"`
+}
+
+// CleanupOrphans resolves the selected orphans. A dry run reports the actions with a confirm token,
+// the cleanup itself is only done if the actions are still the same as those the token confirms.
+func (b *Broker) CleanupOrphans(c echo.Context) error {
+	ctx := requestContext(c)
+	var req cleanupRequest
+	if err := c.Bind(&req); err != nil {
+		return brokerError(c, http.StatusBadRequest, "", "invalid request body")
+	}
+	if len(req.IDs) == 0 {
+		return brokerError(c, http.StatusBadRequest, "", "no orphans selected")
+	}
+	dryRun := req.DryRun == nil || *req.DryRun
+	if !dryRun && len(req.Confirm) == 0 {
+		return brokerError(c, http.StatusBadRequest, "", "confirm is required, it is returned by a dry run of the same orphans")
+	}
+
+	preview, err := b.client.CleanupOrphans(ctx, req.IDs, true)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to clean up orphans: %v", err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	token := confirmToken(preview)
+	if dryRun {
+		return c.JSON(http.StatusOK, map[string]any{
+			"dry_run": true,
+			"results": preview,
+			"confirm": token,
+		})
+	}
+	if req.Confirm != token {
+		logger.WarnContext(ctx, "orphans changed since their dry run, not cleaning up %v", req.IDs)
+		return brokerError(c, http.StatusConflict, "", "the orphans changed since the dry run, repeat it")
+	}
+
+	results, err := b.client.CleanupOrphans(ctx, req.IDs, false)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to clean up orphans: %v", err)
+		return brokerError(c, http.StatusInternalServerError, "", err.Error())
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"dry_run": false,
+		"results": results,
+	})
+}
+
+// confirmToken identifies the actions of a dry run, the objects they apply to and their outcome
+func confirmToken(results []cnpg.OrphanCleanup) string {
+	sum := sha256.New()
+	for _, result := range results {
+		fmt.Fprintf(sum, "%s\x00%s\x00%s\x00%s\x00%s\x00%d\x00%s\n", result.ID, result.Action, result.Kind, result.Namespace, result.Name,
+			result.CreatedAt.UnixNano(), result.Error)
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
@@ -0,0 +1,34 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cnpg-broker/pkg/validation"
+	"github.com/labstack/echo/v4"
+)
+
+// decodeParameters converts the already validated OSB parameters into their typed representation
+func decodeParameters(parameters map[string]any, out any) error {
+	if len(parameters) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(parameters)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// invalidParameters responds with the field-level errors of a parameter validation
+func invalidParameters(c echo.Context, errs []*validation.ValidationError) error {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return c.JSON(http.StatusBadRequest, map[string]any{
+		"description": "invalid parameters: " + strings.Join(messages, "; "),
+		"fields":      errs,
+	})
+}
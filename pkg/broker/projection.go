@@ -0,0 +1,52 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/cnpg-broker/pkg/catalog"
+	"github.com/cnpg-broker/pkg/cnpg"
+	"github.com/cnpg-broker/pkg/config"
+)
+
+// projectionTarget returns where the credentials of a binding are to be projected to as a servicebinding.io
+// Secret, or nil if they are returned in the response. Projection is requested by the secret_namespace and
+// secret_name parameters, or enabled by the plan for bindings from Kubernetes platforms. Bindings from
+// Kubernetes platforms always project to the namespace of their context, bindings from other platforms
+// only to the namespaces allowed by the operator.
+func projectionTarget(bindContext map[string]any, plan catalog.Plan, params cnpg.BindingParameters) (*cnpg.ProjectedSecret, error) {
+	platform, _ := bindContext["platform"].(string)
+	kubernetes := platform == "kubernetes"
+	if len(params.SecretNamespace) == 0 && len(params.SecretName) == 0 && !(kubernetes && plan.Metadata.ProjectSecret) {
+		return nil, nil
+	}
+
+	if kubernetes {
+		namespace, _ := bindContext["namespace"].(string)
+		if len(namespace) == 0 {
+			return nil, errors.New("context.namespace is required to project the credentials to a secret")
+		}
+		if len(params.SecretNamespace) > 0 && params.SecretNamespace != namespace {
+			return nil, fmt.Errorf("secret_namespace must be the namespace %s of the binding", namespace)
+		}
+		return &cnpg.ProjectedSecret{Namespace: namespace, Name: params.SecretName}, nil
+	}
+
+	if len(params.SecretNamespace) == 0 {
+		return nil, errors.New("secret_namespace is required to project the credentials to a secret")
+	}
+	if !slices.Contains(config.Get().Projection.Namespaces, params.SecretNamespace) {
+		return nil, fmt.Errorf("secret_namespace %s is not allowed for projection", params.SecretNamespace)
+	}
+	return &cnpg.ProjectedSecret{Namespace: params.SecretNamespace, Name: params.SecretName}, nil
+}
+
+// projectedCredentials are the credentials returned for a binding projected to a Secret, referencing it
+// instead of containing the credentials themselves
+func projectedCredentials(projected *cnpg.ProjectedSecret) map[string]string {
+	return map[string]string{
+		"secret_namespace": projected.Namespace,
+		"secret_name":      projected.Name,
+	}
+}
@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cnpg-broker/pkg/catalog"
+	"github.com/cnpg-broker/pkg/cnpg"
+	"github.com/cnpg-broker/pkg/config"
+	"github.com/cnpg-broker/pkg/validation"
+)
+
+// validatePostgresVersion checks that a requested PostgreSQL version is declared by the catalog.
+// Without declared versions any version of the schema is accepted.
+func validatePostgresVersion(version string) *validation.ValidationError {
+	versions := catalog.PostgresVersions()
+	if len(version) == 0 || len(versions) == 0 {
+		return nil
+	}
+	if _, found := catalog.FindPostgresVersion(version); found {
+		return nil
+	}
+	declared := make([]string, 0, len(versions))
+	for _, v := range versions {
+		declared = append(declared, v.Version)
+	}
+	return &validation.ValidationError{Field: "parameters.postgres_version", Message: fmt.Sprintf("must be one of %v", declared)}
+}
+
+// validateExposureVersion checks that instances of a plan can be exposed with the requested PostgreSQL version,
+// or with current if none is requested. An unknown current version is not checked.
+func validateExposureVersion(plan catalog.Plan, version, current string) *validation.ValidationError {
+	field := "parameters.postgres_version"
+	if len(version) == 0 {
+		if len(current) == 0 {
+			return nil
+		}
+		field, version = "plan_id", current
+	}
+	if err := plan.CheckPostgresVersion(version); err != nil {
+		return &validation.ValidationError{Field: field, Message: err.Error()}
+	}
+	return nil
+}
+
+// checkMajorUpgrade checks that an instance can be upgraded in place to a PostgreSQL major version:
+// it is no downgrade, the instance is healthy and a backup to restore from in case the upgrade fails
+// completed recently. It returns why the upgrade is refused, or an empty string.
+func (b *Broker) checkMajorUpgrade(ctx context.Context, instanceId string, cluster *cnpg.ClusterInfo, version string) (string, error) {
+	if len(cluster.PostgresVersion) == 0 {
+		return "current PostgreSQL version of the instance is unknown, cannot upgrade", nil
+	}
+	current, err := strconv.Atoi(cluster.PostgresVersion)
+	if err != nil {
+		return "", fmt.Errorf("invalid PostgreSQL version %s of instance %s", cluster.PostgresVersion, instanceId)
+	}
+	target, err := strconv.Atoi(version)
+	if err != nil {
+		return fmt.Sprintf("invalid PostgreSQL version %s", version), nil
+	}
+	if target < current {
+		return fmt.Sprintf("cannot downgrade PostgreSQL from version %d to %d", current, target), nil
+	}
+	if !cluster.IsReady {
+		return fmt.Sprintf("instance must be healthy to be upgraded, current phase: %s", cluster.Phase), nil
+	}
+	if !cluster.BackupsEnabled {
+		return "instance has no backups configured, cannot upgrade", nil
+	}
+
+	backups, err := b.client.ListBackups(ctx, instanceId)
+	if err != nil {
+		return "", err
+	}
+	maxAge := config.Get().Upgrade.BackupMaxAge
+	for _, backup := range backups {
+		if backup.Phase != "completed" {
+			continue
+		}
+		completedAt := backup.CreatedAt
+		if stoppedAt, err := time.Parse(time.RFC3339, backup.StoppedAt); err == nil {
+			completedAt = stoppedAt
+		}
+		if time.Since(completedAt) <= maxAge {
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("instance needs a backup completed within the last %s to be upgraded", maxAge), nil
+}
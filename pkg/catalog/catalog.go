@@ -1,16 +1,55 @@
 package catalog
 
 import (
-	"os"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
 
-	"github.com/cnpg-broker/pkg/logger"
-	"gopkg.in/yaml.v3"
+	"github.com/cnpg-broker/pkg/config"
 )
 
-var catalog Catalog
+var (
+	ErrServiceNotFound = errors.New("service not found")
+	ErrPlanNotFound    = errors.New("plan not found")
+)
+
+// loaded is a validated catalog, it is replaced as a whole on reload
+type loaded struct {
+	catalog Catalog
+	// digest identifies the YAML the catalog was loaded from
+	digest string
+	etag   string
+}
+
+var current atomic.Pointer[loaded]
+
+// get returns the current catalog, which must not be modified
+func get() *Catalog {
+	if l := current.Load(); l != nil {
+		return &l.catalog
+	}
+	return &Catalog{}
+}
 
 type Catalog struct {
 	Services []Service `yaml:"services"`
+	// PostgresVersions are the PostgreSQL major versions instances can be provisioned with and upgraded to
+	PostgresVersions []PostgresVersion `yaml:"postgresVersions,omitempty"`
+}
+
+// PostgresVersion maps a PostgreSQL major version to a CNPG image, or to an image catalog
+type PostgresVersion struct {
+	Version      string           `yaml:"version"`
+	ImageName    string           `yaml:"imageName,omitempty"`
+	ImageCatalog *ImageCatalogRef `yaml:"imageCatalog,omitempty"`
+}
+
+// ImageCatalogRef references a CNPG ImageCatalog or ClusterImageCatalog holding the image of the version
+type ImageCatalogRef struct {
+	// Kind is ImageCatalog, in the namespace of the instance, or ClusterImageCatalog
+	Kind string `yaml:"kind"`
+	Name string `yaml:"name"`
 }
 
 type Service struct {
@@ -41,44 +80,234 @@ type Plan struct {
 	Description string       `yaml:"description" json:"description"`
 	Free        bool         `yaml:"free" json:"free"`
 	Metadata    PlanMetadata `yaml:"metadata" json:"metadata"`
+	Schemas     *Schemas     `yaml:"schemas,omitempty" json:"schemas,omitempty"`
 }
 
 type PlanMetadata struct {
-	Instances        int64  `yaml:"instances" json:"instances"`
-	CPU              string `yaml:"cpu" json:"cpu"`
-	Memory           string `yaml:"memory" json:"memory"`
-	Storage          string `yaml:"storage" json:"storage"`
-	HighAvailability bool   `yaml:"highAvailability" json:"highAvailability"`
-	SLA              bool   `yaml:"sla" json:"sla"`
-}
-
-func init() {
-	data, err := os.ReadFile("catalog.yaml")
-	if err != nil {
-		logger.Fatal("failed to read catalog.yaml: %v", err)
+	Instances        int64         `yaml:"instances" json:"instances"`
+	CPU              string        `yaml:"cpu" json:"cpu"`
+	Memory           string        `yaml:"memory" json:"memory"`
+	Storage          string        `yaml:"storage" json:"storage"`
+	HighAvailability bool          `yaml:"highAvailability" json:"highAvailability"`
+	SLA              bool          `yaml:"sla" json:"sla"`
+	Backup           *BackupConfig `yaml:"backup,omitempty" json:"backup,omitempty"`
+	// ProjectSecret projects the credentials of bindings from Kubernetes platforms to a Secret
+	// in the namespace of the caller, instead of returning them in the response
+	ProjectSecret bool `yaml:"projectSecret,omitempty" json:"projectSecret,omitempty"`
+	// ClusterSpec is merged onto the spec of the CNPG Cluster generated for the plan, e.g. to set
+	// imageName, postgresql.parameters, storage.storageClass, walStorage, affinity or monitoring
+	ClusterSpec map[string]any `yaml:"clusterSpec,omitempty" json:"-"`
+	// PoolerSpec is merged onto the spec of the rw and ro CNPG Poolers of every instance with its pooler
+	// enabled, single-instance plans included
+	PoolerSpec map[string]any `yaml:"poolerSpec,omitempty" json:"-"`
+	// Exposure defines how instances are reachable from outside the cluster, LoadBalancer Services if not set
+	Exposure *Exposure `yaml:"exposure,omitempty" json:"-"`
+	// Pooler configures the PgBouncer Poolers, instance parameters take precedence
+	Pooler *PoolerConfig `yaml:"pooler,omitempty" json:"pooler,omitempty"`
+	// PostgresVersion is the PostgreSQL major version of instances provisioned without postgres_version,
+	// the default image of the operator if not set
+	PostgresVersion string `yaml:"postgresVersion,omitempty" json:"postgresVersion,omitempty"`
+}
+
+// PoolerConfig are the PgBouncer settings of a plan, zero values keep the defaults
+type PoolerConfig struct {
+	// Enabled creates Poolers, by default only HA plans have them
+	Enabled *bool `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	// PoolMode is session or transaction, session by default
+	PoolMode        string `yaml:"poolMode,omitempty" json:"poolMode,omitempty"`
+	DefaultPoolSize int    `yaml:"defaultPoolSize,omitempty" json:"defaultPoolSize,omitempty"`
+	MaxClientConn   int    `yaml:"maxClientConn,omitempty" json:"maxClientConn,omitempty"`
+	// Instances is the number of PgBouncer pods per Pooler, the number of instances of the plan by default
+	Instances int64 `yaml:"instances,omitempty" json:"instances,omitempty"`
+}
+
+// The exposure modes of a plan
+const (
+	// ExposureNone only exposes instances with the ClusterIP Services created by CNPG
+	ExposureNone         = "none"
+	ExposureClusterIP    = "ClusterIP"
+	ExposureNodePort     = "NodePort"
+	ExposureLoadBalancer = "LoadBalancer"
+	// ExposureTLSRoute routes TLS connections to the primary through a Gateway API Gateway, by SNI
+	ExposureTLSRoute = "TLSRoute"
+
+	// MinTLSRouteVersion is the first PostgreSQL major version with direct TLS negotiation, which sends the SNI TLSRoutes route by
+	MinTLSRouteVersion = 17
+)
+
+// Exposure defines the Services, or the TLSRoute, exposing the instances of a plan
+type Exposure struct {
+	Mode string `yaml:"mode"`
+	// Annotations are set on the Services, e.g. to configure the load balancer
+	Annotations              map[string]string `yaml:"annotations,omitempty"`
+	LoadBalancerClass        string            `yaml:"loadBalancerClass,omitempty"`
+	LoadBalancerSourceRanges []string          `yaml:"loadBalancerSourceRanges,omitempty"`
+	// NodeAddress is the host returned in the credentials of NodePort Services
+	NodeAddress string `yaml:"nodeAddress,omitempty"`
+	// Gateway is the parent of the TLSRoute
+	Gateway *GatewayRef `yaml:"gateway,omitempty"`
+	// Hostname is the SNI hostname of the TLSRoute, {instance_id} is replaced with the instance ID
+	Hostname string `yaml:"hostname,omitempty"`
+	// Port is the port of the Gateway listener returned in the credentials, 5432 if not set
+	Port int32 `yaml:"port,omitempty"`
+}
+
+// GatewayRef references the listener of a Gateway
+type GatewayRef struct {
+	Name        string `yaml:"name"`
+	Namespace   string `yaml:"namespace,omitempty"`
+	SectionName string `yaml:"sectionName,omitempty"`
+}
+
+// ExposureConfig returns the exposure of the plan, with LoadBalancer Services if it has none
+func (p Plan) ExposureConfig() Exposure {
+	exposure := Exposure{Mode: ExposureLoadBalancer}
+	if p.Metadata.Exposure != nil {
+		exposure = *p.Metadata.Exposure
+	}
+	if exposure.Port == 0 {
+		exposure.Port = 5432
+	}
+	return exposure
+}
+
+// CheckPostgresVersion returns an error if instances of the plan cannot be exposed with a PostgreSQL major version
+func (p Plan) CheckPostgresVersion(version string) error {
+	if p.ExposureConfig().Mode != ExposureTLSRoute {
+		return nil
+	}
+	if major, err := strconv.Atoi(version); err != nil || major < MinTLSRouteVersion {
+		return fmt.Errorf("exposure mode TLSRoute requires PostgreSQL %d or later, got %q", MinTLSRouteVersion, version)
+	}
+	return nil
+}
+
+// BackupConfig defines the scheduled backups of a plan
+type BackupConfig struct {
+	// Schedule is a cron expression with seconds, as used by CNPG ScheduledBackups, e.g. "0 0 2 * * *"
+	Schedule        string `yaml:"schedule" json:"schedule"`
+	RetentionPolicy string `yaml:"retentionPolicy" json:"retentionPolicy"`
+	// DestinationPath overrides the object store destination path configured for the broker
+	DestinationPath string `yaml:"destinationPath,omitempty" json:"-"`
+}
+
+// Schemas are the JSON schemas for the parameters accepted by a plan, as defined by the OSB API
+type Schemas struct {
+	ServiceInstance *ServiceInstanceSchema `yaml:"service_instance,omitempty" json:"service_instance,omitempty"`
+	ServiceBinding  *ServiceBindingSchema  `yaml:"service_binding,omitempty" json:"service_binding,omitempty"`
+}
+
+type ServiceInstanceSchema struct {
+	Create *InputParametersSchema `yaml:"create,omitempty" json:"create,omitempty"`
+	Update *InputParametersSchema `yaml:"update,omitempty" json:"update,omitempty"`
+}
+
+type ServiceBindingSchema struct {
+	Create *InputParametersSchema `yaml:"create,omitempty" json:"create,omitempty"`
+}
+
+type InputParametersSchema struct {
+	Parameters map[string]any `yaml:"parameters,omitempty" json:"parameters,omitempty"`
+}
+
+// ProvisionSchema returns the JSON schema for provision parameters, or nil if the plan does not accept any
+func (p Plan) ProvisionSchema() map[string]any {
+	if p.Schemas == nil || p.Schemas.ServiceInstance == nil || p.Schemas.ServiceInstance.Create == nil {
+		return nil
+	}
+	return p.Schemas.ServiceInstance.Create.Parameters
+}
+
+// UpdateSchema returns the JSON schema for update parameters, or nil if the plan does not accept any
+func (p Plan) UpdateSchema() map[string]any {
+	if p.Schemas == nil || p.Schemas.ServiceInstance == nil || p.Schemas.ServiceInstance.Update == nil {
+		return nil
+	}
+	return p.Schemas.ServiceInstance.Update.Parameters
+}
+
+// BindSchema returns the JSON schema for binding parameters, or nil if the plan does not accept any
+func (p Plan) BindSchema() map[string]any {
+	if p.Schemas == nil || p.Schemas.ServiceBinding == nil || p.Schemas.ServiceBinding.Create == nil {
+		return nil
 	}
-	if err := yaml.Unmarshal(data, &catalog); err != nil {
-		logger.Fatal("failed to parse catalog.yaml: %v", err)
+	return p.Schemas.ServiceBinding.Create.Parameters
+}
+
+// Loaded returns true once a catalog with at least one service has been loaded
+func Loaded() bool {
+	return len(get().Services) > 0
+}
+
+// ETag returns the entity tag of the catalog served by GetCatalog
+func ETag() string {
+	if l := current.Load(); l != nil {
+		return l.etag
 	}
-	logger.Info("loaded catalog with %d service(s)", len(catalog.Services))
+	return ""
 }
 
 func GetCatalog() map[string]any {
-	return map[string]any{"services": catalog.Services}
+	return map[string]any{"services": get().Services}
+}
+
+// PostgresVersions returns the PostgreSQL versions of the catalog, empty if it does not declare any
+func PostgresVersions() []PostgresVersion {
+	return get().PostgresVersions
 }
 
-func PlanSpec(planId string) (int64, string, string, string) {
-	for _, svc := range catalog.Services {
+// FindPostgresVersion returns the PostgreSQL version of the catalog with the given major version
+func FindPostgresVersion(version string) (PostgresVersion, bool) {
+	for _, v := range get().PostgresVersions {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return PostgresVersion{}, false
+}
+
+// Plans returns the plans of all services
+func Plans() []Plan {
+	var plans []Plan
+	for _, svc := range get().Services {
+		plans = append(plans, svc.Plans...)
+	}
+	return plans
+}
+
+func FindPlan(planId string) (Plan, bool) {
+	for _, svc := range get().Services {
 		for _, plan := range svc.Plans {
 			if plan.ID == planId {
-				logger.Debug("found plan %s: instances=%d, cpu=%s, memory=%s, storage=%s",
-					planId, plan.Metadata.Instances, plan.Metadata.CPU,
-					plan.Metadata.Memory, plan.Metadata.Storage)
-				return plan.Metadata.Instances, plan.Metadata.CPU,
-					plan.Metadata.Memory, plan.Metadata.Storage
+				return plan, true
 			}
 		}
 	}
-	logger.Warn("plan %s not found, using defaults", planId)
-	return 3, "4", "4Gi", "250Gi"
+	return Plan{}, false
+}
+
+// GetPlan returns the plan of a service
+func GetPlan(serviceId, planId string) (Plan, error) {
+	for _, svc := range get().Services {
+		if svc.ID != serviceId {
+			continue
+		}
+		for _, plan := range svc.Plans {
+			if plan.ID == planId {
+				return plan, nil
+			}
+		}
+		return Plan{}, fmt.Errorf("%w: %s for service %s", ErrPlanNotFound, planId, serviceId)
+	}
+	return Plan{}, fmt.Errorf("%w: %s", ErrServiceNotFound, serviceId)
+}
+
+// DefaultPlan returns the configured default plan if it belongs to the service
+func DefaultPlan(serviceId string) (Plan, bool) {
+	defaultPlanId := config.Get().DefaultPlanID
+	if len(defaultPlanId) == 0 {
+		return Plan{}, false
+	}
+	plan, err := GetPlan(serviceId, defaultPlanId)
+	return plan, err == nil
 }
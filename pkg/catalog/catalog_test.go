@@ -0,0 +1,236 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cnpg-broker/pkg/config"
+)
+
+// catalogPath is the catalog.yaml of the repository, cnpgtest cannot be used here as it imports this package
+const catalogPath = "../../catalog.yaml"
+
+const (
+	devSmall  = "22cedd15-900f-4625-9f10-a57f43c64585"
+	devMedium = "de7acc66-412d-41c0-bf3e-763307a86c38"
+)
+
+func TestMain(m *testing.M) {
+	data, err := os.ReadFile(catalogPath)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := Update(context.Background(), data, catalogPath, nil); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func readCatalog(t *testing.T) []byte {
+	t.Helper()
+	data, err := os.ReadFile(catalogPath)
+	if err != nil {
+		t.Fatalf("failed to read catalog: %v", err)
+	}
+	return data
+}
+
+func validCatalog() *Catalog {
+	return &Catalog{
+		Services: []Service{{
+			ID:   "79f7fb16-c95d-4210-8930-1c758648327e",
+			Name: "postgresql",
+			Plans: []Plan{{
+				ID:   devSmall,
+				Name: "small",
+				Metadata: PlanMetadata{
+					Instances:       1,
+					CPU:             "500m",
+					Memory:          "512Mi",
+					Storage:         "1Gi",
+					PostgresVersion: "17",
+				},
+			}},
+		}},
+		PostgresVersions: []PostgresVersion{{Version: "17", ImageName: "ghcr.io/cloudnative-pg/postgresql:17"}},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Catalog)
+		wantErr string
+	}{
+		{"valid", func(c *Catalog) {}, ""},
+		{"no services", func(c *Catalog) { c.Services = nil }, "no services"},
+		{"no plans", func(c *Catalog) { c.Services[0].Plans = nil }, "no plans"},
+		{"invalid service id", func(c *Catalog) { c.Services[0].ID = "postgresql" }, "not a valid UUID"},
+		{"duplicate plan name", func(c *Catalog) {
+			plan := c.Services[0].Plans[0]
+			plan.ID = devMedium
+			c.Services[0].Plans = append(c.Services[0].Plans, plan)
+		}, "plan name small is not unique"},
+		{"invalid postgres version", func(c *Catalog) { c.PostgresVersions[0].Version = "17.2" }, "is not a major version"},
+		{"image and image catalog", func(c *Catalog) {
+			c.PostgresVersions[0].ImageCatalog = &ImageCatalogRef{Kind: "ImageCatalog", Name: "postgresql"}
+		}, "exactly one of imageName and imageCatalog"},
+		{"unknown plan postgres version", func(c *Catalog) { c.Services[0].Plans[0].Metadata.PostgresVersion = "16" }, "is not in postgresVersions"},
+		{"reserved cluster spec", func(c *Catalog) {
+			c.Services[0].Plans[0].Metadata.ClusterSpec = map[string]any{"storage": map[string]any{"size": "5Gi"}}
+		}, "storage.size is set by the broker"},
+		{"invalid pool mode", func(c *Catalog) {
+			c.Services[0].Plans[0].Metadata.Pooler = &PoolerConfig{PoolMode: "statement"}
+		}, "must be session or transaction"},
+		{"unknown exposure mode", func(c *Catalog) {
+			c.Services[0].Plans[0].Metadata.Exposure = &Exposure{Mode: "Ingress"}
+		}, "unknown mode"},
+		{"exposure field of another mode", func(c *Catalog) {
+			c.Services[0].Plans[0].Metadata.Exposure = &Exposure{Mode: ExposureClusterIP, NodeAddress: "192.0.2.10"}
+		}, "nodeAddress is not used with mode ClusterIP"},
+		{"TLSRoute without gateway", func(c *Catalog) {
+			c.Services[0].Plans[0].Metadata.Exposure = &Exposure{Mode: ExposureTLSRoute, Hostname: "{instance_id}.db.example.com"}
+		}, "gateway.name is required"},
+		{"TLSRoute", func(c *Catalog) {
+			c.Services[0].Plans[0].Metadata.Exposure = &Exposure{Mode: ExposureTLSRoute, Gateway: &GatewayRef{Name: "postgres"},
+				Hostname: "{instance_id}.db.example.com"}
+		}, ""},
+		{"TLSRoute before PostgreSQL 17", func(c *Catalog) {
+			c.PostgresVersions = append(c.PostgresVersions, PostgresVersion{Version: "16", ImageName: "ghcr.io/cloudnative-pg/postgresql:16"})
+			c.Services[0].Plans[0].Metadata.PostgresVersion = "16"
+			c.Services[0].Plans[0].Metadata.Exposure = &Exposure{Mode: ExposureTLSRoute, Gateway: &GatewayRef{Name: "postgres"},
+				Hostname: "{instance_id}.db.example.com"}
+		}, "requires PostgreSQL 17 or later"},
+		{"TLSRoute without postgres version", func(c *Catalog) {
+			c.Services[0].Plans[0].Metadata.PostgresVersion = ""
+			c.Services[0].Plans[0].Metadata.Exposure = &Exposure{Mode: ExposureTLSRoute, Gateway: &GatewayRef{Name: "postgres"},
+				Hostname: "{instance_id}.db.example.com"}
+		}, "requires PostgreSQL 17 or later"},
+		{"invalid source range", func(c *Catalog) {
+			c.Services[0].Plans[0].Metadata.Exposure = &Exposure{Mode: ExposureLoadBalancer, LoadBalancerSourceRanges: []string{"10.0.0.1"}}
+		}, "is not a CIDR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validCatalog()
+			tt.change(c)
+			err := Validate(c)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("expected a valid catalog, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestGetPlan(t *testing.T) {
+	const serviceId = "79f7fb16-c95d-4210-8930-1c758648327e"
+	const unknownPlan = "7c1e9a52-0d3b-4f6e-a8c2-5b4d3e2f1a09"
+	defaultPlanId := config.Get().DefaultPlanID
+	defer func() { config.Get().DefaultPlanID = defaultPlanId }()
+	config.Get().DefaultPlanID = devMedium
+
+	if plan, err := GetPlan(serviceId, devSmall); err != nil || plan.ID != devSmall {
+		t.Errorf("expected plan %s, got %s: %v", devSmall, plan.ID, err)
+	}
+	// the default plan is not applied by lookups
+	if _, err := GetPlan(serviceId, unknownPlan); !errors.Is(err, ErrPlanNotFound) {
+		t.Errorf("expected ErrPlanNotFound, got %v", err)
+	}
+	if _, err := GetPlan("00000000-0000-4000-8000-000000000000", devSmall); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("expected ErrServiceNotFound, got %v", err)
+	}
+
+	if plan, found := DefaultPlan(serviceId); !found || plan.ID != devMedium {
+		t.Errorf("expected default plan %s, got %s", devMedium, plan.ID)
+	}
+	if _, found := DefaultPlan("a651d10f-25ab-4a75-99a6-520c0abbe2ae"); found {
+		t.Error("expected no default plan for a service the default plan does not belong to")
+	}
+}
+
+func TestVersionEnums(t *testing.T) {
+	original := readCatalog(t)
+	defer func() {
+		if _, err := Update(context.Background(), original, catalogPath, nil); err != nil {
+			t.Fatalf("failed to restore catalog: %v", err)
+		}
+	}()
+	enum := func(schema map[string]any) any {
+		return schema["properties"].(map[string]any)["postgres_version"].(map[string]any)["enum"]
+	}
+
+	plan, _ := FindPlan(devSmall)
+	if got := fmt.Sprint(enum(plan.ProvisionSchema()), enum(plan.UpdateSchema())); got != "[15 16 17 18] [15 16 17 18]" {
+		t.Errorf("expected the declared versions in the schemas, got %s", got)
+	}
+	withoutVersion15 := strings.Replace(string(original), "- version: \"15\"\n  imageName: ghcr.io/cloudnative-pg/postgresql:15\n", "", 1)
+	if _, err := Update(context.Background(), []byte(withoutVersion15), "test", nil); err != nil {
+		t.Fatalf("failed to update catalog: %v", err)
+	}
+	plan, _ = FindPlan(devSmall)
+	if got := fmt.Sprint(enum(plan.ProvisionSchema())); got != "[16 17 18]" {
+		t.Errorf("expected a removed version to be removed from the schemas, got %s", got)
+	}
+}
+
+func TestCatalogReload(t *testing.T) {
+	original := readCatalog(t)
+	etag := ETag()
+	defer func() {
+		if _, err := Update(context.Background(), original, catalogPath, nil); err != nil {
+			t.Fatalf("failed to restore catalog: %v", err)
+		}
+	}()
+
+	// dev-medium is removed, dev-small gets a duplicate name
+	withoutDevMedium := strings.Replace(string(original), "id: "+devMedium, "id: 00000000-0000-4000-8000-000000000000", 1)
+	usage := func(context.Context) (map[string]int, error) {
+		return map[string]int{devMedium: 2}, nil
+	}
+	tests := []struct {
+		name    string
+		catalog string
+		wantErr string
+	}{
+		{"plan in use removed", withoutDevMedium, "still used by 2 instance(s)"},
+		{"duplicate plan id", strings.Replace(string(original), "id: "+devMedium, "id: "+devSmall, 1), "is not unique"},
+		{"invalid quantity", strings.Replace(string(original), "storage: 1Gi", "storage: 1 GB", 1), "not a valid quantity"},
+		{"no instances", strings.Replace(string(original), "instances: 1", "instances: 0", 1), "instances must be at least 1"},
+		{"invalid yaml", "services: [", "failed to parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Update(context.Background(), []byte(tt.catalog), "test", usage)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if ETag() != etag {
+				t.Errorf("expected the current catalog to be kept")
+			}
+		})
+	}
+
+	// removing a plan without instances is fine
+	changed, err := Update(context.Background(), []byte(withoutDevMedium), "test", func(context.Context) (map[string]int, error) {
+		return map[string]int{devSmall: 1}, nil
+	})
+	if err != nil || !changed {
+		t.Fatalf("expected catalog to be reloaded, got %v", err)
+	}
+	if _, found := FindPlan(devMedium); found {
+		t.Errorf("expected plan %s to be removed", devMedium)
+	}
+	if ETag() == etag {
+		t.Errorf("expected the ETag to change")
+	}
+}
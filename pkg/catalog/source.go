@@ -0,0 +1,121 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cnpg-broker/pkg/logger"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+// Source provides the catalog YAML
+type Source interface {
+	// Read returns the current catalog YAML
+	Read(ctx context.Context) ([]byte, error)
+	// Watch calls changed whenever the catalog may have changed, until ctx is done
+	Watch(ctx context.Context, changed func())
+	String() string
+}
+
+// Watch reloads the catalog from source whenever it changes, until ctx is done. An invalid
+// catalog is logged and the current one is kept.
+func Watch(ctx context.Context, source Source, usage PlanUsage) {
+	source.Watch(ctx, func() {
+		data, err := source.Read(ctx)
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to reload catalog: %v", err)
+			return
+		}
+		if _, err := Update(ctx, data, source.String(), usage); err != nil {
+			logger.ErrorContext(ctx, "failed to reload catalog, keeping the current one: %v", err)
+		}
+	})
+}
+
+// FileSource reads the catalog from a file, which is polled for changes. Polling also picks up
+// files of mounted ConfigMaps, which are replaced by swapping symlinks.
+type FileSource struct {
+	Path     string
+	Interval time.Duration
+}
+
+func (s *FileSource) Read(_ context.Context) ([]byte, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", s.Path, err)
+	}
+	return data, nil
+}
+
+// Watch calls changed on every poll, Update skips the catalog if the file did not change
+func (s *FileSource) Watch(ctx context.Context, changed func()) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed()
+		}
+	}
+}
+
+func (s *FileSource) String() string {
+	return s.Path
+}
+
+// ConfigMapSource reads the catalog from a key of a ConfigMap, which is watched for changes
+type ConfigMapSource struct {
+	Clientset kubernetes.Interface
+	Namespace string
+	Name      string
+	Key       string
+}
+
+func (s *ConfigMapSource) Read(ctx context.Context) ([]byte, error) {
+	cm, err := s.Clientset.CoreV1().ConfigMaps(s.Namespace).Get(ctx, s.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", s, err)
+	}
+	data, found := cm.Data[s.Key]
+	if !found {
+		return nil, fmt.Errorf("%s has no key %s", s, s.Key)
+	}
+	return []byte(data), nil
+}
+
+func (s *ConfigMapSource) Watch(ctx context.Context, changed func()) {
+	factory := informers.NewSharedInformerFactoryWithOptions(s.Clientset, 0,
+		informers.WithNamespace(s.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", s.Name).String()
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	_, err := informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(any) { changed() },
+		UpdateFunc: func(oldObj, newObj any) {
+			if oldObj.(*corev1.ConfigMap).ResourceVersion != newObj.(*corev1.ConfigMap).ResourceVersion {
+				changed()
+			}
+		},
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to watch %s: %v", s, err)
+		return
+	}
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	factory.Shutdown()
+}
+
+func (s *ConfigMapSource) String() string {
+	return fmt.Sprintf("configmap %s/%s", s.Namespace, s.Name)
+}
@@ -0,0 +1,305 @@
+package catalog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cnpg-broker/pkg/config"
+	"github.com/cnpg-broker/pkg/logger"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// uuidRegex matches the IDs accepted by the OSB API handlers, see validation
+var uuidRegex = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// reservedClusterSpec are the fields of the Cluster spec set by the broker, plans cannot overlay them
+var reservedClusterSpec = [][]string{
+	{"instances"}, {"resources"}, {"storage", "size"}, {"bootstrap"}, {"managed"}, {"plugins"}, {"inheritedMetadata"},
+}
+
+// reservedPoolerSpec are the fields of the Pooler spec set by the broker, plans cannot overlay them
+var reservedPoolerSpec = [][]string{
+	{"cluster"}, {"type"},
+}
+
+// PlanUsage returns the number of service instances per plan ID
+type PlanUsage func(ctx context.Context) (map[string]int, error)
+
+// Update parses and validates a catalog and replaces the current one with it. Plans of the current
+// catalog must not be removed while usage reports instances using them. It returns false if data
+// is the catalog that is already loaded.
+func Update(ctx context.Context, data []byte, source string, usage PlanUsage) (bool, error) {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	previous := current.Load()
+	if previous != nil && previous.digest == digest {
+		return false, nil
+	}
+
+	var c Catalog
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return false, fmt.Errorf("failed to parse %s: %w", source, err)
+	}
+	if err := Validate(&c); err != nil {
+		return false, fmt.Errorf("invalid catalog %s: %w", source, err)
+	}
+	setVersionEnums(&c)
+	if previous != nil && usage != nil {
+		if err := checkRemovedPlans(ctx, &previous.catalog, &c, usage); err != nil {
+			return false, fmt.Errorf("invalid catalog %s: %w", source, err)
+		}
+	}
+
+	served, err := json.Marshal(map[string]any{"services": c.Services})
+	if err != nil {
+		return false, fmt.Errorf("failed to encode catalog %s: %w", source, err)
+	}
+	etag := sha256.Sum256(served)
+
+	// only swap if the catalog was not replaced concurrently, otherwise the plans in use were checked against a stale one
+	if !current.CompareAndSwap(previous, &loaded{
+		catalog: c,
+		digest:  digest,
+		etag:    `"` + hex.EncodeToString(etag[:16]) + `"`,
+	}) {
+		return false, fmt.Errorf("catalog %s was replaced concurrently", source)
+	}
+	logger.InfoContext(ctx, "loaded catalog with %d service(s) from %s", len(c.Services), source)
+	return true, nil
+}
+
+// setVersionEnums restricts the postgres_version parameter of the plan schemas to the PostgreSQL
+// versions of the catalog, if it declares any, so the schemas cannot offer versions it does not have
+func setVersionEnums(c *Catalog) {
+	if len(c.PostgresVersions) == 0 {
+		return
+	}
+	for _, svc := range c.Services {
+		for _, plan := range svc.Plans {
+			for _, schema := range []map[string]any{plan.ProvisionSchema(), plan.UpdateSchema()} {
+				properties, _ := schema["properties"].(map[string]any)
+				version, ok := properties["postgres_version"].(map[string]any)
+				if !ok {
+					continue
+				}
+				versions := make([]any, 0, len(c.PostgresVersions))
+				for _, v := range c.PostgresVersions {
+					versions = append(versions, v.Version)
+				}
+				version["enum"] = versions
+			}
+		}
+	}
+}
+
+// Validate checks that IDs are unique UUIDs, plan names are unique per service, and plans have
+// at least one instance, parseable resource quantities, spec overlays not setting reserved fields,
+// valid pooler settings, a complete exposure and a declared default PostgreSQL version. PostgreSQL
+// versions must be unique major versions with either an image or an image catalog. A configured
+// default plan must exist.
+func Validate(c *Catalog) error {
+	var errs []error
+	ids := make(map[string]bool)
+	checkID := func(kind, name, id string) {
+		if !uuidRegex.MatchString(id) {
+			errs = append(errs, fmt.Errorf("%s %s: id %q is not a valid UUID", kind, name, id))
+		}
+		if ids[id] {
+			errs = append(errs, fmt.Errorf("%s %s: id %s is not unique", kind, name, id))
+		}
+		ids[id] = true
+	}
+
+	if len(c.Services) == 0 {
+		errs = append(errs, errors.New("no services"))
+	}
+	if defaultPlan := config.Get().DefaultPlanID; len(defaultPlan) > 0 && !hasPlan(c, defaultPlan) {
+		errs = append(errs, fmt.Errorf("default plan %s not found", defaultPlan))
+	}
+	versions := make(map[string]bool)
+	for _, v := range c.PostgresVersions {
+		if _, err := strconv.Atoi(v.Version); err != nil {
+			errs = append(errs, fmt.Errorf("postgres version %q is not a major version", v.Version))
+		}
+		if versions[v.Version] {
+			errs = append(errs, fmt.Errorf("postgres version %s is not unique", v.Version))
+		}
+		versions[v.Version] = true
+		if (len(v.ImageName) > 0) == (v.ImageCatalog != nil) {
+			errs = append(errs, fmt.Errorf("postgres version %s: exactly one of imageName and imageCatalog is required", v.Version))
+		}
+		if v.ImageCatalog != nil && (len(v.ImageCatalog.Name) == 0 || (v.ImageCatalog.Kind != "ImageCatalog" && v.ImageCatalog.Kind != "ClusterImageCatalog")) {
+			errs = append(errs, fmt.Errorf("postgres version %s: imageCatalog needs a name and kind ImageCatalog or ClusterImageCatalog", v.Version))
+		}
+	}
+	for _, svc := range c.Services {
+		checkID("service", svc.Name, svc.ID)
+		if len(svc.Plans) == 0 {
+			errs = append(errs, fmt.Errorf("service %s: no plans", svc.Name))
+		}
+		names := make(map[string]bool)
+		for _, plan := range svc.Plans {
+			checkID("plan", plan.Name, plan.ID)
+			if names[plan.Name] {
+				errs = append(errs, fmt.Errorf("service %s: plan name %s is not unique", svc.Name, plan.Name))
+			}
+			names[plan.Name] = true
+
+			if plan.Metadata.Instances < 1 {
+				errs = append(errs, fmt.Errorf("plan %s: instances must be at least 1", plan.Name))
+			}
+			if err := checkOverlay(plan.Metadata.ClusterSpec, reservedClusterSpec); err != nil {
+				errs = append(errs, fmt.Errorf("plan %s: clusterSpec: %w", plan.Name, err))
+			}
+			if err := checkOverlay(plan.Metadata.PoolerSpec, reservedPoolerSpec); err != nil {
+				errs = append(errs, fmt.Errorf("plan %s: poolerSpec: %w", plan.Name, err))
+			}
+			if version := plan.Metadata.PostgresVersion; len(version) > 0 && !versions[version] {
+				errs = append(errs, fmt.Errorf("plan %s: postgres version %s is not in postgresVersions", plan.Name, version))
+			}
+			if pooler := plan.Metadata.Pooler; pooler != nil {
+				if pooler.PoolMode != "" && pooler.PoolMode != "session" && pooler.PoolMode != "transaction" {
+					errs = append(errs, fmt.Errorf("plan %s: pooler: poolMode %q must be session or transaction", plan.Name, pooler.PoolMode))
+				}
+				if pooler.DefaultPoolSize < 0 || pooler.MaxClientConn < 0 || pooler.Instances < 0 {
+					errs = append(errs, fmt.Errorf("plan %s: pooler: defaultPoolSize, maxClientConn and instances must not be negative", plan.Name))
+				}
+			}
+			if plan.Metadata.Exposure != nil {
+				if err := checkExposure(plan.Metadata.Exposure); err != nil {
+					errs = append(errs, fmt.Errorf("plan %s: exposure: %w", plan.Name, err))
+				}
+				if err := plan.CheckPostgresVersion(plan.Metadata.PostgresVersion); err != nil {
+					errs = append(errs, fmt.Errorf("plan %s: postgresVersion: %w", plan.Name, err))
+				}
+			}
+			for field, quantity := range map[string]string{
+				"cpu":     plan.Metadata.CPU,
+				"memory":  plan.Metadata.Memory,
+				"storage": plan.Metadata.Storage,
+			} {
+				if _, err := resource.ParseQuantity(quantity); err != nil {
+					errs = append(errs, fmt.Errorf("plan %s: %s %q is not a valid quantity", plan.Name, field, quantity))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func hasPlan(c *Catalog, planId string) bool {
+	for _, svc := range c.Services {
+		for _, plan := range svc.Plans {
+			if plan.ID == planId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkOverlay returns an error if overlay sets any of the reserved fields
+func checkOverlay(overlay map[string]any, reserved [][]string) error {
+	var errs []error
+	for _, path := range reserved {
+		value := any(overlay)
+		for _, field := range path {
+			object, ok := value.(map[string]any)
+			if !ok {
+				value = nil
+				break
+			}
+			value = object[field]
+		}
+		if value != nil {
+			errs = append(errs, fmt.Errorf("%s is set by the broker", strings.Join(path, ".")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkExposure returns an error if the mode of an exposure is unknown or it sets fields of another mode
+func checkExposure(exposure *Exposure) error {
+	var errs []error
+	unused := func(set bool, field string) {
+		if set {
+			errs = append(errs, fmt.Errorf("%s is not used with mode %s", field, exposure.Mode))
+		}
+	}
+	switch exposure.Mode {
+	case ExposureNone, ExposureTLSRoute:
+		unused(len(exposure.Annotations) > 0, "annotations")
+	case ExposureClusterIP, ExposureNodePort, ExposureLoadBalancer:
+	default:
+		return fmt.Errorf("unknown mode %q, must be one of %s, %s, %s, %s or %s", exposure.Mode,
+			ExposureNone, ExposureClusterIP, ExposureNodePort, ExposureLoadBalancer, ExposureTLSRoute)
+	}
+	if exposure.Mode != ExposureLoadBalancer {
+		unused(len(exposure.LoadBalancerClass) > 0, "loadBalancerClass")
+		unused(len(exposure.LoadBalancerSourceRanges) > 0, "loadBalancerSourceRanges")
+	}
+	if exposure.Mode != ExposureNodePort {
+		unused(len(exposure.NodeAddress) > 0, "nodeAddress")
+	}
+	if exposure.Mode == ExposureTLSRoute {
+		if exposure.Gateway == nil || len(exposure.Gateway.Name) == 0 {
+			errs = append(errs, errors.New("gateway.name is required with mode TLSRoute"))
+		}
+		if !strings.Contains(exposure.Hostname, "{instance_id}") {
+			errs = append(errs, errors.New("hostname must contain {instance_id} with mode TLSRoute"))
+		}
+	} else {
+		unused(exposure.Gateway != nil, "gateway")
+		unused(len(exposure.Hostname) > 0, "hostname")
+		unused(exposure.Port != 0, "port")
+	}
+	for _, cidr := range exposure.LoadBalancerSourceRanges {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("loadBalancerSourceRanges: %q is not a CIDR", cidr))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkRemovedPlans returns an error for every plan of previous that is missing in next and still in use
+func checkRemovedPlans(ctx context.Context, previous, next *Catalog, usage PlanUsage) error {
+	kept := make(map[string]bool)
+	for _, svc := range next.Services {
+		for _, plan := range svc.Plans {
+			kept[plan.ID] = true
+		}
+	}
+
+	var removed []Plan
+	for _, svc := range previous.Services {
+		for _, plan := range svc.Plans {
+			if !kept[plan.ID] {
+				removed = append(removed, plan)
+			}
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	instances, err := usage(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check usage of removed plans: %w", err)
+	}
+	var errs []error
+	for _, plan := range removed {
+		if n := instances[plan.ID]; n > 0 {
+			errs = append(errs, fmt.Errorf("plan %s (%s) is removed but still used by %d instance(s)", plan.Name, plan.ID, n))
+		}
+	}
+	return errors.Join(errs...)
+}
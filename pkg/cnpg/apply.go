@@ -0,0 +1,211 @@
+package cnpg
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/cnpg-broker/pkg/audit"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+// fieldManager owns the fields of all objects the broker applies. Fields the broker stops rendering,
+// e.g. when the spec overlay of a plan changes, are removed by the API server.
+const fieldManager = "cnpg-broker"
+
+// applyOptions forces ownership, the broker is the only writer of the fields it renders
+var applyOptions = metav1.ApplyOptions{FieldManager: fieldManager, Force: true}
+
+// rolesFieldManager owns the managed roles of the Clusters, the login roles of the bindings. They are
+// changed by binds and unbinds rather than rendered from the plan, applying them as fieldManager would
+// remove them on the next provision or update.
+const rolesFieldManager = "cnpg-broker-roles"
+
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+)
+
+// Change is an object that was created or updated by applying its desired state
+type Change struct {
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+	// Action is ChangeCreated or ChangeUpdated
+	Action string
+}
+
+type changesKey struct{}
+
+// changes collects the objects changed by the applies on a context, see recordChanges
+type changes struct {
+	mu      sync.Mutex
+	changes []Change
+}
+
+// recordChanges returns a context on which applies record the objects they changed. Recording
+// costs a read of every object before it is applied, so it is only done when reconciling.
+func recordChanges(ctx context.Context) (context.Context, *changes) {
+	c := &changes{}
+	return context.WithValue(ctx, changesKey{}, c), c
+}
+
+func (c *changes) list() []Change {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changes
+}
+
+// apply runs write, a server-side apply, and audits it. If changes are recorded on ctx, get is used
+// to compare the object before and after, an apply without effect leaves it unchanged.
+func apply(ctx context.Context, apiVersion, kind, namespace, name string, get, write func() (runtime.Object, error)) error {
+	recorder, _ := ctx.Value(changesKey{}).(*changes)
+	var before map[string]any
+	if recorder != nil {
+		current, err := get()
+		if err == nil {
+			if before, err = comparable(current); err != nil {
+				return err
+			}
+		} else if !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	applied, err := write()
+	if err != nil {
+		return err
+	}
+	audit.Touched(ctx, kind, namespace, name)
+	if recorder == nil {
+		return nil
+	}
+
+	after, err := comparable(applied)
+	if err != nil {
+		return err
+	}
+	if before != nil && equality.Semantic.DeepEqual(before, after) {
+		return nil
+	}
+	change := Change{APIVersion: apiVersion, Kind: kind, Namespace: namespace, Name: name, Action: ChangeUpdated}
+	if before == nil {
+		change.Action = ChangeCreated
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.changes = append(recorder.changes, change)
+	return nil
+}
+
+// comparable returns the content of an object without its status and the metadata every write
+// changes, the status may be updated by controllers any time
+func comparable(obj runtime.Object) (map[string]any, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	delete(content, "status")
+	for _, field := range []string{"resourceVersion", "generation", "managedFields"} {
+		unstructured.RemoveNestedField(content, "metadata", field)
+	}
+	return content, nil
+}
+
+// applyObject applies a rendered CNPG or barman-cloud object with server-side apply
+func (c *Client) applyObject(ctx context.Context, resource schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	client := c.dynamic.Resource(resource).Namespace(obj.GetNamespace())
+	err := apply(ctx, obj.GetAPIVersion(), obj.GetKind(), obj.GetNamespace(), obj.GetName(),
+		func() (runtime.Object, error) {
+			return client.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		},
+		func() (runtime.Object, error) {
+			return client.Apply(ctx, obj.GetName(), obj, applyOptions)
+		})
+	if err != nil {
+		return fmt.Errorf("failed to apply %s %s/%s: %w", obj.GetKind(), obj.GetNamespace(), obj.GetName(), err)
+	}
+	return nil
+}
+
+// applyManagedRoles applies the managed roles of a Cluster as rolesFieldManager. The resource version of
+// cluster, from which roles was derived, is applied as well, so a concurrent change of the Cluster fails
+// the apply with a conflict.
+func (c *Client) applyManagedRoles(ctx context.Context, cluster *unstructured.Unstructured, roles []any) error {
+	client := c.dynamic.Resource(clusterResource).Namespace(cluster.GetNamespace())
+	obj := &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "Cluster",
+			"metadata": map[string]any{
+				"name":            cluster.GetName(),
+				"namespace":       cluster.GetNamespace(),
+				"resourceVersion": cluster.GetResourceVersion(),
+			},
+			"spec": map[string]any{
+				"managed": map[string]any{
+					"roles": roles,
+				},
+			},
+		},
+	}
+	return apply(ctx, obj.GetAPIVersion(), obj.GetKind(), obj.GetNamespace(), obj.GetName(),
+		func() (runtime.Object, error) {
+			return client.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		},
+		func() (runtime.Object, error) {
+			return client.Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{FieldManager: rolesFieldManager, Force: true})
+		})
+}
+
+func (c *Client) applyNamespace(ctx context.Context, namespace *corev1ac.NamespaceApplyConfiguration) error {
+	client := c.clientset.CoreV1().Namespaces()
+	err := apply(ctx, "v1", "Namespace", "", *namespace.Name,
+		func() (runtime.Object, error) {
+			return client.Get(ctx, *namespace.Name, metav1.GetOptions{})
+		},
+		func() (runtime.Object, error) {
+			return client.Apply(ctx, namespace, applyOptions)
+		})
+	if err != nil {
+		return fmt.Errorf("failed to apply namespace %s: %w", *namespace.Name, err)
+	}
+	return nil
+}
+
+func (c *Client) applyService(ctx context.Context, service *corev1ac.ServiceApplyConfiguration) error {
+	client := c.clientset.CoreV1().Services(*service.Namespace)
+	err := apply(ctx, "v1", "Service", *service.Namespace, *service.Name,
+		func() (runtime.Object, error) {
+			return client.Get(ctx, *service.Name, metav1.GetOptions{})
+		},
+		func() (runtime.Object, error) {
+			return client.Apply(ctx, service, applyOptions)
+		})
+	if err != nil {
+		return fmt.Errorf("failed to apply service %s: %w", *service.Name, err)
+	}
+	return nil
+}
+
+func (c *Client) applySecret(ctx context.Context, secret *corev1ac.SecretApplyConfiguration) error {
+	client := c.clientset.CoreV1().Secrets(*secret.Namespace)
+	err := apply(ctx, "v1", "Secret", *secret.Namespace, *secret.Name,
+		func() (runtime.Object, error) {
+			return client.Get(ctx, *secret.Name, metav1.GetOptions{})
+		},
+		func() (runtime.Object, error) {
+			return client.Apply(ctx, secret, applyOptions)
+		})
+	if err != nil {
+		return fmt.Errorf("failed to apply secret %s: %w", *secret.Name, err)
+	}
+	return nil
+}
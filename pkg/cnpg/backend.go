@@ -0,0 +1,48 @@
+package cnpg
+
+import (
+	"context"
+
+	"github.com/cnpg-broker/pkg/catalog"
+)
+
+// ClusterBackend is the set of operations the broker, Web-UI and health checks need from the
+// Kubernetes side. It is implemented by Client, tests can build a Client from fake k8s clients.
+type ClusterBackend interface {
+	ListClusters(ctx context.Context) ([]ClusterInfo, error)
+	CreateCluster(ctx context.Context, instanceId, serviceId, planId string, params InstanceParameters) (string, error)
+	GetCluster(ctx context.Context, instanceId string) (*ClusterInfo, error)
+	GetPoolers(ctx context.Context, instanceId string) ([]PoolerStatus, error)
+	UpdateCluster(ctx context.Context, instanceId, serviceId, planId string, params InstanceParameters) (int64, error)
+	DeleteCluster(ctx context.Context, instanceId string) error
+	ValidateRestore(ctx context.Context, instanceId string, params InstanceParameters, plan catalog.Plan) error
+	RemoveRestoreCopies(ctx context.Context, instanceId string) error
+
+	CreateBinding(ctx context.Context, instanceId, bindingId string) (bool, error)
+	DeleteBinding(ctx context.Context, instanceId, bindingId string) (bool, error)
+	GetBindingStatus(ctx context.Context, instanceId, bindingId string) (*BindingStatus, error)
+	PruneBindingRoles(ctx context.Context, instanceId string) (int, error)
+	GetCredentials(ctx context.Context, instanceId, bindingId string) (map[string]string, error)
+	ProjectBinding(ctx context.Context, instanceId, bindingId string, target ProjectedSecret) (*ProjectedSecret, error)
+
+	CreateBackup(ctx context.Context, instanceId string) (*BackupInfo, error)
+	ListBackups(ctx context.Context, instanceId string) ([]BackupInfo, error)
+
+	StartOperation(ctx context.Context, instanceId string, op Operation) (*Operation, error)
+	FinishOperation(ctx context.Context, instanceId, operationId, state, description string) error
+	GetOperation(ctx context.Context, instanceId, operationId string) (*Operation, error)
+	LatestOperation(ctx context.Context, instanceId, bindingId string) (*Operation, error)
+
+	FindOrphans(ctx context.Context) ([]Orphan, error)
+	CleanupOrphans(ctx context.Context, ids []string, dryRun bool) ([]OrphanCleanup, error)
+
+	GetNamespaceStatus(ctx context.Context, instanceId string) (*NamespaceStatus, error)
+	CheckServicesReady(ctx context.Context, instanceId string) (bool, error)
+
+	CheckCRDs(ctx context.Context) error
+	CheckOperator(ctx context.Context, namespace, name string) error
+	CheckRBAC(ctx context.Context) error
+	HasSynced() bool
+}
+
+var _ ClusterBackend = (*Client)(nil)
@@ -0,0 +1,307 @@
+package cnpg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cnpg-broker/pkg/audit"
+	"github.com/cnpg-broker/pkg/catalog"
+	"github.com/cnpg-broker/pkg/config"
+	"github.com/cnpg-broker/pkg/logger"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+var backupResource = schema.GroupVersionResource{
+	Group:    "postgresql.cnpg.io",
+	Version:  "v1",
+	Resource: "backups",
+}
+
+var scheduledBackupResource = schema.GroupVersionResource{
+	Group:    "postgresql.cnpg.io",
+	Version:  "v1",
+	Resource: "scheduledbackups",
+}
+
+// ErrBackupsNotConfigured is returned for backup operations on instances without an object store
+var ErrBackupsNotConfigured = errors.New("backups are not configured for this instance")
+
+// ErrBackupCredentialsMissing is returned if there are no object store credentials for an instance with backups
+var ErrBackupCredentialsMissing = errors.New("object store credentials are missing")
+
+// backupTarget is the resolved backup configuration of a plan
+type backupTarget struct {
+	Schedule        string
+	RetentionPolicy string
+	DestinationPath string
+}
+
+// backupConfiguration returns the backup target of a plan, or nil if the plan has no backups
+// or there is no object store configured for the broker
+func backupConfiguration(planId string) *backupTarget {
+	plan, found := catalog.FindPlan(planId)
+	if !found || plan.Metadata.Backup == nil {
+		return nil
+	}
+
+	destinationPath := config.Get().Backup.DestinationPath
+	if len(plan.Metadata.Backup.DestinationPath) > 0 {
+		destinationPath = plan.Metadata.Backup.DestinationPath
+	}
+	if len(destinationPath) == 0 {
+		logger.Warn("plan %s has backups configured, but there is no object store destination path", planId)
+		return nil
+	}
+	return &backupTarget{
+		Schedule:        plan.Metadata.Backup.Schedule,
+		RetentionPolicy: plan.Metadata.Backup.RetentionPolicy,
+		DestinationPath: destinationPath,
+	}
+}
+
+// applyBackupStore applies the object store credentials Secret and the barman-cloud ObjectStore of an instance.
+// The credentials are copied from the Secret of the instance in the credentials namespace of the broker if
+// there is one, otherwise from the credentials Secret of the broker.
+func (c *Client) applyBackupStore(ctx context.Context, instanceId string, target *backupTarget) error {
+	cfg := config.Get().Backup
+	credentialsName := fmt.Sprintf("%s-credentials", backupName(instanceId))
+
+	secrets := c.clientset.CoreV1().Secrets(cfg.CredentialsNamespace)
+	source, err := secrets.Get(ctx, backupCredentialsName(instanceId), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		source, err = secrets.Get(ctx, cfg.CredentialsSecret, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("%w: Secret %s/%s not found", ErrBackupCredentialsMissing, cfg.CredentialsNamespace, cfg.CredentialsSecret)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get object store credentials: %w", err)
+	}
+	data := make(map[string][]byte)
+	for _, key := range []string{"ACCESS_KEY_ID", "ACCESS_SECRET_KEY"} {
+		if len(source.Data[key]) == 0 {
+			return fmt.Errorf("%w: Secret %s/%s has no %s", ErrBackupCredentialsMissing, cfg.CredentialsNamespace, source.Name, key)
+		}
+		data[key] = source.Data[key]
+	}
+	if len(cfg.Region) > 0 {
+		data["ACCESS_REGION"] = []byte(cfg.Region)
+	}
+	secret := corev1ac.Secret(credentialsName, instanceId).
+		WithLabels(map[string]string{
+			"cnpg-broker.io/instance-id": instanceId,
+		}).
+		WithData(data)
+	if err := c.applySecret(ctx, secret); err != nil {
+		return fmt.Errorf("failed to apply object store credentials: %w", err)
+	}
+
+	configuration := map[string]any{
+		"destinationPath": target.DestinationPath,
+		"s3Credentials": map[string]any{
+			"accessKeyId": map[string]any{
+				"name": credentialsName,
+				"key":  "ACCESS_KEY_ID",
+			},
+			"secretAccessKey": map[string]any{
+				"name": credentialsName,
+				"key":  "ACCESS_SECRET_KEY",
+			},
+		},
+		"wal": map[string]any{
+			"compression": "gzip",
+		},
+		"data": map[string]any{
+			"compression": "gzip",
+		},
+	}
+	if len(cfg.EndpointURL) > 0 {
+		configuration["endpointURL"] = cfg.EndpointURL
+	}
+	if len(cfg.Region) > 0 {
+		configuration["s3Credentials"].(map[string]any)["region"] = map[string]any{
+			"name": credentialsName,
+			"key":  "ACCESS_REGION",
+		}
+	}
+	spec := map[string]any{
+		"configuration": configuration,
+	}
+	if len(target.RetentionPolicy) > 0 {
+		spec["retentionPolicy"] = target.RetentionPolicy
+	}
+
+	objectStore := &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "barmancloud.cnpg.io/v1",
+			"kind":       "ObjectStore",
+			"metadata": map[string]any{
+				"name":      backupName(instanceId),
+				"namespace": instanceId,
+				"labels": map[string]any{
+					"cnpg-broker.io/instance-id": instanceId,
+				},
+			},
+			"spec": spec,
+		},
+	}
+	return c.applyObject(ctx, objectStoreResource, objectStore)
+}
+
+// applyScheduledBackup applies the ScheduledBackup of an instance
+func (c *Client) applyScheduledBackup(ctx context.Context, instanceId string, target *backupTarget) error {
+	scheduledBackup := &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "ScheduledBackup",
+			"metadata": map[string]any{
+				"name":      backupName(instanceId),
+				"namespace": instanceId,
+				"labels": map[string]any{
+					"cnpg-broker.io/instance-id": instanceId,
+				},
+			},
+			"spec": map[string]any{
+				"schedule":             target.Schedule,
+				"immediate":            true,
+				"backupOwnerReference": "self",
+				"method":               "plugin",
+				"cluster": map[string]any{
+					"name": clusterName(instanceId),
+				},
+				"pluginConfiguration": map[string]any{
+					"name": barmanCloudPlugin,
+				},
+			},
+		},
+	}
+	return c.applyObject(ctx, scheduledBackupResource, scheduledBackup)
+}
+
+// deleteScheduledBackup stops the scheduled backups of an instance, existing backups and the WAL archive are kept
+func (c *Client) deleteScheduledBackup(ctx context.Context, instanceId string) error {
+	err := c.dynamic.Resource(scheduledBackupResource).Namespace(instanceId).Delete(ctx, backupName(instanceId), metav1.DeleteOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	audit.Touched(ctx, "ScheduledBackup", instanceId, backupName(instanceId))
+	return nil
+}
+
+// setBarmanPlugin enables WAL archiving to the ObjectStore of the instance in the plugins of a Cluster spec
+func setBarmanPlugin(spec map[string]any, instanceId string) {
+	plugin := map[string]any{
+		"name":          barmanCloudPlugin,
+		"isWALArchiver": true,
+		"parameters": map[string]any{
+			"barmanObjectName": backupName(instanceId),
+		},
+	}
+
+	plugins, _, _ := unstructured.NestedSlice(spec, "plugins")
+	for i, p := range plugins {
+		if existing, ok := p.(map[string]any); ok && existing["name"] == barmanCloudPlugin {
+			plugins[i] = plugin
+			spec["plugins"] = plugins
+			return
+		}
+	}
+	spec["plugins"] = append(plugins, plugin)
+}
+
+func (c *Client) CreateBackup(ctx context.Context, instanceId string) (*BackupInfo, error) {
+	cluster, err := c.dynamic.Resource(clusterResource).Namespace(instanceId).Get(ctx, clusterName(instanceId), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if objectStoreName, _, found := barmanCloudConfiguration(cluster); !found || objectStoreName != backupName(instanceId) {
+		return nil, ErrBackupsNotConfigured
+	}
+
+	// the random suffix keeps backups started within the same second apart
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("failed to generate backup name: %w", err)
+	}
+	name := fmt.Sprintf("%s-%s-%s", clusterName(instanceId), time.Now().UTC().Format("20060102150405"), hex.EncodeToString(suffix))
+	backup := &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "Backup",
+			"metadata": map[string]any{
+				"name":      name,
+				"namespace": instanceId,
+				"labels": map[string]any{
+					"cnpg-broker.io/instance-id": instanceId,
+				},
+			},
+			"spec": map[string]any{
+				"method": "plugin",
+				"cluster": map[string]any{
+					"name": clusterName(instanceId),
+				},
+				"pluginConfiguration": map[string]any{
+					"name": barmanCloudPlugin,
+				},
+			},
+		},
+	}
+	created, err := c.dynamic.Resource(backupResource).Namespace(instanceId).Create(ctx, backup, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	audit.Touched(ctx, "Backup", instanceId, created.GetName())
+	logger.InfoContext(ctx, "started on-demand backup %s for instance %s", created.GetName(), instanceId)
+	return backupInfo(created), nil
+}
+
+func (c *Client) ListBackups(ctx context.Context, instanceId string) ([]BackupInfo, error) {
+	list, err := c.dynamic.Resource(backupResource).Namespace(instanceId).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]BackupInfo, 0, len(list.Items))
+	for i := range list.Items {
+		backups = append(backups, *backupInfo(&list.Items[i]))
+	}
+	// newest first
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+	return backups, nil
+}
+
+func backupInfo(backup *unstructured.Unstructured) *BackupInfo {
+	info := &BackupInfo{
+		Name:      backup.GetName(),
+		CreatedAt: backup.GetCreationTimestamp().Time,
+	}
+	_, info.Scheduled = backup.GetLabels()["cnpg.io/scheduled-backup"]
+	info.Method, _, _ = unstructured.NestedString(backup.Object, "spec", "method")
+
+	if status, found, err := unstructured.NestedMap(backup.Object, "status"); found && err == nil {
+		info.Phase, _, _ = unstructured.NestedString(status, "phase")
+		info.BackupID, _, _ = unstructured.NestedString(status, "backupId")
+		info.BeginWal, _, _ = unstructured.NestedString(status, "beginWal")
+		info.EndWal, _, _ = unstructured.NestedString(status, "endWal")
+		info.BeginLSN, _, _ = unstructured.NestedString(status, "beginLSN")
+		info.EndLSN, _, _ = unstructured.NestedString(status, "endLSN")
+		info.StartedAt, _, _ = unstructured.NestedString(status, "startedAt")
+		info.StoppedAt, _, _ = unstructured.NestedString(status, "stoppedAt")
+		info.Error, _, _ = unstructured.NestedString(status, "error")
+	}
+	return info
+}
@@ -0,0 +1,387 @@
+package cnpg
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/cnpg-broker/pkg/audit"
+	"github.com/cnpg-broker/pkg/logger"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const passwordChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// projectedSecretAnnotation records the "<namespace>/<name>" of the projected Secret on the binding Secret
+const projectedSecretAnnotation = "cnpg-broker.io/projected-secret"
+
+// ErrProjectedSecretConflict is returned if the Secret to project the credentials to belongs to something else
+var ErrProjectedSecretConflict = errors.New("secret already exists and does not belong to the binding")
+
+// States of the login role of a binding
+const (
+	RoleReconciled = "reconciled"
+	RolePending    = "pending"
+	RoleFailed     = "failed"
+)
+
+// RoleDisabled is the ensure setting reported for the role of an unbound binding that could not be dropped
+const RoleDisabled = "disabled"
+
+// CreateBinding creates the login role for bindingId, consisting of a basic-auth Secret holding
+// the generated password and a matching entry in the managed roles of the Cluster.
+// It returns false if the binding already existed.
+func (c *Client) CreateBinding(ctx context.Context, instanceId, bindingId string) (bool, error) {
+	created := true
+	secretName := bindingSecretName(instanceId, bindingId)
+	roleName := bindingRoleName(bindingId)
+
+	// the password of an existing binding is kept, the binding is idempotent
+	_, err := c.clientset.CoreV1().Secrets(instanceId).Get(ctx, secretName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		password, err := generatePassword(32)
+		if err != nil {
+			return false, err
+		}
+		annotations := map[string]string{}
+		setOriginatingIdentity(ctx, annotations, "cnpg-broker.io/created-by")
+		data := map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte(roleName),
+			corev1.BasicAuthPasswordKey: []byte(password),
+		}
+		if err := c.applySecret(ctx, renderBindingSecret(instanceId, bindingId, data, annotations)); err != nil {
+			return false, err
+		}
+	case err != nil:
+		return false, err
+	default:
+		logger.DebugContext(ctx, "secret for binding %s of instance %s already exists", bindingId, instanceId)
+		created = false
+	}
+
+	// grant the role membership of the app database owner, so it can access the app database
+	role := map[string]any{
+		"name":    roleName,
+		"ensure":  "present",
+		"login":   true,
+		"inRoles": []any{"app"},
+		"comment": fmt.Sprintf("cnpg-broker binding %s", bindingId),
+		"passwordSecret": map[string]any{
+			"name": secretName,
+		},
+	}
+	if err := c.setManagedRole(ctx, instanceId, role); err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+// DeleteBinding drops the login role of bindingId and deletes its Secret.
+// It returns false if the binding did not exist.
+func (c *Client) DeleteBinding(ctx context.Context, instanceId, bindingId string) (bool, error) {
+	existed := true
+	roleName := bindingRoleName(bindingId)
+
+	secret, err := c.clientset.CoreV1().Secrets(instanceId).Get(ctx, bindingSecretName(instanceId, bindingId), metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return false, err
+		}
+		existed = false
+	}
+	if projected := projectedSecret(secret); projected != nil {
+		err := c.clientset.CoreV1().Secrets(projected.Namespace).Delete(ctx, projected.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return false, fmt.Errorf("failed to delete projected secret %s/%s: %w", projected.Namespace, projected.Name, err)
+		}
+		audit.Touched(ctx, "Secret", projected.Namespace, projected.Name)
+		logger.DebugContext(ctx, "deleted projected secret %s/%s of binding %s", projected.Namespace, projected.Name, bindingId)
+	}
+
+	// the role itself has to stay in the managed roles list, otherwise CNPG would simply stop
+	// managing it instead of dropping it, PruneBindingRoles removes it once it is dropped
+	role := map[string]any{
+		"name":   roleName,
+		"ensure": "absent",
+	}
+	if err := c.setManagedRole(ctx, instanceId, role); err != nil {
+		return false, err
+	}
+
+	err = c.clientset.CoreV1().Secrets(instanceId).Delete(ctx, bindingSecretName(instanceId, bindingId), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, err
+	}
+	if existed {
+		audit.Touched(ctx, "Secret", instanceId, bindingSecretName(instanceId, bindingId))
+	}
+	return existed, nil
+}
+
+// GetBindingStatus returns whether the login role of bindingId has been reconciled by CNPG, based on the
+// managed roles in the spec and status of the Cluster. The Cluster is read from the API server, since the
+// cache might not have caught up yet with a role that was just added.
+func (c *Client) GetBindingStatus(ctx context.Context, instanceId, bindingId string) (*BindingStatus, error) {
+	status := &BindingStatus{
+		SecretExists: true,
+		State:        RolePending,
+	}
+	roleName := bindingRoleName(bindingId)
+
+	secret, err := c.clientset.CoreV1().Secrets(instanceId).Get(ctx, bindingSecretName(instanceId, bindingId), metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		status.SecretExists = false
+	}
+	status.ProjectedSecret = projectedSecret(secret)
+
+	cluster, err := c.dynamic.Resource(clusterResource).Namespace(instanceId).Get(ctx, clusterName(instanceId), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	roles, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "managed", "roles")
+	for _, r := range roles {
+		if role, ok := r.(map[string]any); ok && role["name"] == roleName {
+			status.Ensure, _ = role["ensure"].(string)
+			if len(status.Ensure) == 0 {
+				status.Ensure = "present"
+			}
+			if status.Ensure == "present" && role["login"] == false {
+				status.Ensure = RoleDisabled
+			}
+		}
+	}
+	if len(status.Ensure) == 0 {
+		// not a managed role, nothing to reconcile
+		status.State = RoleReconciled
+		return status, nil
+	}
+	if !rolesStatusCurrent(cluster) {
+		return status, nil
+	}
+
+	if messages, found, _ := unstructured.NestedStringSlice(cluster.Object, "status", "managedRolesStatus", "cannotReconcile", roleName); found {
+		status.State = RoleFailed
+		status.Message = strings.Join(messages, "; ")
+		return status, nil
+	}
+	reconciled, _, _ := unstructured.NestedStringSlice(cluster.Object, "status", "managedRolesStatus", "byStatus", "reconciled")
+	if slices.Contains(reconciled, roleName) {
+		status.State = RoleReconciled
+	}
+	return status, nil
+}
+
+// PruneBindingRoles resolves the managed roles of unbound bindings CNPG has reconciled: dropped roles
+// are removed from the managed roles, roles CNPG cannot drop, usually because they own objects in the
+// app database, are kept without login and membership of app instead. It returns the number of roles
+// changed.
+func (c *Client) PruneBindingRoles(ctx context.Context, instanceId string) (int, error) {
+	changed := 0
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		changed = 0
+		cluster, err := c.dynamic.Resource(clusterResource).Namespace(instanceId).Get(ctx, clusterName(instanceId), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !rolesStatusCurrent(cluster) {
+			return nil
+		}
+		roles, _, err := unstructured.NestedSlice(cluster.Object, "spec", "managed", "roles")
+		if err != nil {
+			return err
+		}
+		reconciled, _, _ := unstructured.NestedStringSlice(cluster.Object, "status", "managedRolesStatus", "byStatus", "reconciled")
+		cannotReconcile, _, _ := unstructured.NestedMap(cluster.Object, "status", "managedRolesStatus", "cannotReconcile")
+
+		pruned := make([]any, 0, len(roles))
+		for _, r := range roles {
+			role, ok := r.(map[string]any)
+			name, _ := role["name"].(string)
+			if !ok || !strings.HasPrefix(name, "binding_") || role["ensure"] != "absent" {
+				pruned = append(pruned, r)
+				continue
+			}
+			switch {
+			case cannotReconcile[name] != nil:
+				logger.WarnContext(ctx, "role %s of instance %s cannot be dropped, disabling it: %v", name, instanceId, cannotReconcile[name])
+				pruned = append(pruned, map[string]any{
+					"name":            name,
+					"ensure":          "present",
+					"login":           false,
+					"disablePassword": true,
+					"comment":         "cnpg-broker unbound binding, kept as it owns objects",
+				})
+				changed++
+			case slices.Contains(reconciled, name):
+				logger.DebugContext(ctx, "role %s of instance %s has been dropped", name, instanceId)
+				changed++
+			default:
+				pruned = append(pruned, r)
+			}
+		}
+		if changed == 0 {
+			return nil
+		}
+		return c.applyManagedRoles(ctx, cluster, pruned)
+	})
+	return changed, err
+}
+
+// rolesStatusCurrent returns false while the operator has not observed the latest spec of a Cluster,
+// the status of its managed roles may still be the one of the previous spec
+func rolesStatusCurrent(cluster *unstructured.Unstructured) bool {
+	observed := readyObservedGeneration(cluster)
+	return observed == 0 || observed >= cluster.GetGeneration()
+}
+
+// ProjectBinding writes the credentials of bindingId as a Secret laid out per the servicebinding.io
+// Provisioned Service spec into target.Namespace, and records it on the binding Secret so it is
+// deleted along with the binding. An empty target.Name defaults to the binding ID.
+func (c *Client) ProjectBinding(ctx context.Context, instanceId, bindingId string, target ProjectedSecret) (*ProjectedSecret, error) {
+	if len(target.Name) == 0 {
+		target.Name = bindingId
+	}
+	credentials, err := c.GetCredentials(ctx, instanceId, bindingId)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string][]byte{
+		"type":     []byte("postgresql"),
+		"provider": []byte("cloudnative-pg"),
+		"host":     []byte(fmt.Sprintf("%s-rw.%s.svc.cluster.local", clusterName(instanceId), instanceId)),
+		"port":     []byte(credentials["port"]),
+		"username": []byte(credentials["username"]),
+		"password": []byte(credentials["password"]),
+		"database": []byte(credentials["database"]),
+		"uri":      []byte(credentials["uri"]),
+	}
+	if caCert, ok := credentials["ca_cert"]; ok {
+		data["ca.crt"] = []byte(caCert)
+	}
+	secrets := c.clientset.CoreV1().Secrets(target.Namespace)
+	existing, err := secrets.Get(ctx, target.Name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to project credentials to %s/%s: %w", target.Namespace, target.Name, err)
+	}
+	// only Secrets the broker projected for this binding before are updated, never ones created by others
+	if err == nil && (existing.Labels["cnpg-broker.io/instance-id"] != instanceId || existing.Labels["cnpg-broker.io/binding-id"] != bindingId) {
+		return nil, fmt.Errorf("%w: %s/%s", ErrProjectedSecretConflict, target.Namespace, target.Name)
+	}
+	annotations := map[string]string{
+		"cnpg-broker.io/instance-id": instanceId,
+		"cnpg-broker.io/binding-id":  bindingId,
+	}
+	setOriginatingIdentity(ctx, annotations, "cnpg-broker.io/created-by")
+	projected := corev1ac.Secret(target.Name, target.Namespace).
+		WithLabels(map[string]string{
+			"cnpg-broker.io/instance-id": instanceId,
+			"cnpg-broker.io/binding-id":  bindingId,
+		}).
+		WithAnnotations(annotations).
+		WithType(corev1.SecretType("servicebinding.io/postgresql")).
+		WithData(data)
+	if err := c.applySecret(ctx, projected); err != nil {
+		return nil, fmt.Errorf("failed to project credentials to %s/%s: %w", target.Namespace, target.Name, err)
+	}
+
+	// the binding Secret records the projected Secret, its data and created-by annotation are kept
+	bindingSecret, err := c.clientset.CoreV1().Secrets(instanceId).Get(ctx, bindingSecretName(instanceId, bindingId), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	bindingAnnotations := map[string]string{
+		projectedSecretAnnotation: fmt.Sprintf("%s/%s", target.Namespace, target.Name),
+	}
+	if createdBy, found := bindingSecret.Annotations["cnpg-broker.io/created-by"]; found {
+		bindingAnnotations["cnpg-broker.io/created-by"] = createdBy
+	}
+	if err := c.applySecret(ctx, renderBindingSecret(instanceId, bindingId, bindingSecret.Data, bindingAnnotations)); err != nil {
+		return nil, err
+	}
+	logger.DebugContext(ctx, "projected credentials of binding %s to secret %s/%s", bindingId, target.Namespace, target.Name)
+	return &target, nil
+}
+
+// renderBindingSecret renders the basic-auth Secret holding the credentials of the login role of a binding,
+// with annotations in addition to the instance and binding ID
+func renderBindingSecret(instanceId, bindingId string, data map[string][]byte, annotations map[string]string) *corev1ac.SecretApplyConfiguration {
+	annotations["cnpg-broker.io/instance-id"] = instanceId
+	annotations["cnpg-broker.io/binding-id"] = bindingId
+	return corev1ac.Secret(bindingSecretName(instanceId, bindingId), instanceId).
+		WithLabels(map[string]string{
+			"cnpg-broker.io/instance-id": instanceId,
+			"cnpg-broker.io/binding-id":  bindingId,
+			"cnpg.io/reload":             "true",
+		}).
+		WithAnnotations(annotations).
+		WithType(corev1.SecretTypeBasicAuth).
+		WithData(data)
+}
+
+// projectedSecret returns the projected Secret recorded on a binding Secret, or nil
+func projectedSecret(secret *corev1.Secret) *ProjectedSecret {
+	if secret == nil {
+		return nil
+	}
+	namespace, name, found := strings.Cut(secret.Annotations[projectedSecretAnnotation], "/")
+	if !found {
+		return nil
+	}
+	return &ProjectedSecret{Namespace: namespace, Name: name}
+}
+
+// setManagedRole adds or replaces role by name in spec.managed.roles of the Cluster, see applyManagedRoles.
+func (c *Client) setManagedRole(ctx context.Context, instanceId string, role map[string]any) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cluster, err := c.dynamic.Resource(clusterResource).Namespace(instanceId).Get(ctx, clusterName(instanceId), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		roles, _, err := unstructured.NestedSlice(cluster.Object, "spec", "managed", "roles")
+		if err != nil {
+			return err
+		}
+		replaced := false
+		for i, r := range roles {
+			if existing, ok := r.(map[string]any); ok && existing["name"] == role["name"] {
+				roles[i] = role
+				replaced = true
+			}
+		}
+		if !replaced {
+			if role["ensure"] == "absent" {
+				// nothing to drop if the role was never added
+				return nil
+			}
+			roles = append(roles, role)
+		}
+		return c.applyManagedRoles(ctx, cluster, roles)
+	})
+}
+
+func generatePassword(length int) (string, error) {
+	password := make([]byte, length)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(passwordChars))))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate password: %w", err)
+		}
+		password[i] = passwordChars[n.Int64()]
+	}
+	return string(password), nil
+}
@@ -0,0 +1,145 @@
+package cnpg
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnpg-broker/pkg/logger"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+// instanceSelector selects all objects belonging to a service instance
+const instanceSelector = "cnpg-broker.io/instance-id"
+
+// cache serves reads of broker managed objects from shared informers
+type cache struct {
+	namespaces corelisters.NamespaceLister
+	services   corelisters.ServiceLister
+	secrets    corelisters.SecretLister
+	clusters   toolscache.GenericLister
+	poolers    toolscache.GenericLister
+	synced     atomic.Bool
+}
+
+// StartCache starts shared informers for all objects labelled with an instance ID, reads are
+// served from the cache once it is synced. It stops when ctx is done.
+func (c *Client) StartCache(ctx context.Context, resync time.Duration) {
+	tweak := func(options *metav1.ListOptions) {
+		options.LabelSelector = instanceSelector
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(c.clientset, resync, informers.WithTweakListOptions(tweak))
+	dynamicFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.dynamic, resync, metav1.NamespaceAll, tweak)
+
+	cache := &cache{
+		namespaces: factory.Core().V1().Namespaces().Lister(),
+		services:   factory.Core().V1().Services().Lister(),
+		secrets:    factory.Core().V1().Secrets().Lister(),
+		clusters:   dynamicFactory.ForResource(clusterResource).Lister(),
+		poolers:    dynamicFactory.ForResource(poolerResource).Lister(),
+	}
+	c.cache = cache
+
+	factory.Start(ctx.Done())
+	dynamicFactory.Start(ctx.Done())
+
+	go func() {
+		start := time.Now()
+		for informer, synced := range factory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				logger.ErrorContext(ctx, "failed to sync cache for %v", informer)
+				return
+			}
+		}
+		for resource, synced := range dynamicFactory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				logger.ErrorContext(ctx, "failed to sync cache for %s", resource.Resource)
+				return
+			}
+		}
+		cache.synced.Store(true)
+		logger.InfoContext(ctx, "cache synced after %v", time.Since(start).Round(time.Millisecond))
+	}()
+}
+
+// HasSynced returns true once the cache is synced, or if there is no cache at all
+func (c *Client) HasSynced() bool {
+	return c.cache == nil || c.cache.synced.Load()
+}
+
+func (c *Client) cacheReady() bool {
+	return c.cache != nil && c.cache.synced.Load()
+}
+
+// The getters below serve from the cache and fall back to the API server on a cache miss, since the
+// cache might not have caught up yet with objects that were just created.
+// Objects returned from the cache are shared and must not be modified.
+
+func (c *Client) getNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	if c.cacheReady() {
+		if ns, err := c.cache.namespaces.Get(name); err == nil {
+			return ns, nil
+		} else if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return c.clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c *Client) getService(ctx context.Context, namespace, name string) (*corev1.Service, error) {
+	if c.cacheReady() {
+		if svc, err := c.cache.services.Services(namespace).Get(name); err == nil {
+			return svc, nil
+		} else if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return c.clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c *Client) getSecret(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	if c.cacheReady() {
+		if secret, err := c.cache.secrets.Secrets(namespace).Get(name); err == nil {
+			return secret, nil
+		} else if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return c.clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c *Client) getCluster(ctx context.Context, instanceId string) (*unstructured.Unstructured, error) {
+	if c.cacheReady() {
+		if obj, err := c.cache.clusters.ByNamespace(instanceId).Get(clusterName(instanceId)); err == nil {
+			if cluster, ok := obj.(*unstructured.Unstructured); ok {
+				return cluster, nil
+			}
+		} else if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return c.dynamic.Resource(clusterResource).Namespace(instanceId).Get(ctx, clusterName(instanceId), metav1.GetOptions{})
+}
+
+// listClusters returns all Clusters labelled with an instance ID from the cache
+func (c *Client) listClusters() ([]*unstructured.Unstructured, error) {
+	objs, err := c.cache.clusters.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	clusters := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		if cluster, ok := obj.(*unstructured.Unstructured); ok {
+			clusters = append(clusters, cluster)
+		}
+	}
+	return clusters, nil
+}
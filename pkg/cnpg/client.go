@@ -5,14 +5,16 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/cnpg-broker/pkg/audit"
 	"github.com/cnpg-broker/pkg/catalog"
 	"github.com/cnpg-broker/pkg/logger"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/util/intstr"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -31,31 +33,68 @@ var poolerResource = schema.GroupVersionResource{
 	Resource: "poolers",
 }
 
+var objectStoreResource = schema.GroupVersionResource{
+	Group:    "barmancloud.cnpg.io",
+	Version:  "v1",
+	Resource: "objectstores",
+}
+
 type Client struct {
 	dynamic   dynamic.Interface
-	clientset *kubernetes.Clientset
+	clientset kubernetes.Interface
+	cache     *cache
 }
 
-func NewClient() *Client {
+// NewClient creates a Client from the in-cluster config, or from the local kubeconfig if not running in a cluster
+func NewClient() (*Client, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		config, err = clientcmd.BuildConfigFromFlags("", clientcmd.RecommendedHomeFile)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("failed to load k8s config: %w", err)
 		}
 	}
 
-	dynClient := dynamic.NewForConfigOrDie(config)
-	clientset := kubernetes.NewForConfigOrDie(config)
+	dynClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic k8s client: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create k8s clientset: %w", err)
+	}
+
+	return NewClientFromInterfaces(dynClient, clientset), nil
+}
 
+// NewClientFromInterfaces creates a Client from existing k8s clients, e.g. the fake clients of client-go
+func NewClientFromInterfaces(dynClient dynamic.Interface, clientset kubernetes.Interface) *Client {
 	return &Client{
 		dynamic:   dynClient,
 		clientset: clientset,
 	}
 }
 
+// Clientset returns the typed k8s client, e.g. for writing Events
+func (c *Client) Clientset() kubernetes.Interface {
+	return c.clientset
+}
+
 func (c *Client) ListClusters(ctx context.Context) ([]ClusterInfo, error) {
-	logger.Debug("listing all clusters")
+	logger.DebugContext(ctx, "listing all clusters")
+
+	if c.cacheReady() {
+		objs, err := c.listClusters()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list clusters: %w", err)
+		}
+		clusters := make([]ClusterInfo, 0, len(objs))
+		for _, cluster := range objs {
+			clusters = append(clusters, *clusterInfo(cluster.GetNamespace(), cluster))
+		}
+		logger.DebugContext(ctx, "found %d clusters", len(clusters))
+		return clusters, nil
+	}
 
 	namespaces, err := c.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{
 		LabelSelector: "cnpg-broker.io/instance-id",
@@ -69,7 +108,7 @@ func (c *Client) ListClusters(ctx context.Context) ([]ClusterInfo, error) {
 		instanceId := ns.Name
 		clusterInfo, err := c.GetCluster(ctx, instanceId)
 		if err != nil {
-			logger.Warn("failed to get cluster info for %s: %v", instanceId, err)
+			logger.WarnContext(ctx, "failed to get cluster info for %s: %v", instanceId, err)
 			continue
 		}
 		if clusterInfo.Exists {
@@ -77,169 +116,76 @@ func (c *Client) ListClusters(ctx context.Context) ([]ClusterInfo, error) {
 		}
 	}
 
-	logger.Debug("found %d clusters", len(clusters))
+	logger.DebugContext(ctx, "found %d clusters", len(clusters))
 	return clusters, nil
 }
 
-func (c *Client) CreateCluster(ctx context.Context, instanceId, serviceId, planId string) (string, error) {
-	ns := &corev1.Namespace{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: instanceId,
-			Labels: map[string]string{
-				"cnpg-broker.io/instance-id": instanceId,
-			},
-			Annotations: map[string]string{
-				"cnpg-broker.io/instance-id": instanceId,
-			},
-		},
-	}
-	_, err := c.clientset.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{})
-	if err != nil {
-		return "", err
-	}
-
-	// Cluster with specs according to planId
-	instances, cpu, memory, storage := catalog.PlanSpec(planId)
-	cluster := &unstructured.Unstructured{
-		Object: map[string]any{
-			"apiVersion": "postgresql.cnpg.io/v1",
-			"kind":       "Cluster",
-			"metadata": map[string]any{
-				"name":      clusterName(instanceId),
-				"namespace": instanceId,
-				"labels": map[string]any{
-					"cnpg-broker.io/instance-id": instanceId,
-					"cnpg-broker.io/service-id":  serviceId,
-					"cnpg-broker.io/plan-id":     planId,
-				},
-				"annotations": map[string]any{
-					"cnpg-broker.io/instance-id": instanceId,
-					"cnpg-broker.io/service-id":  serviceId,
-					"cnpg-broker.io/plan-id":     planId,
-				},
-			},
-			"spec": map[string]any{
-				"instances": instances,
-				"storage": map[string]any{
-					"size": storage,
-				},
-				"resources": map[string]any{
-					"requests": map[string]any{
-						"cpu":    cpu,
-						"memory": memory,
-					},
-					"limits": map[string]any{
-						"cpu":    cpu,
-						"memory": memory,
-					},
-				},
-			},
-		},
-	}
-
-	_, err = c.dynamic.Resource(clusterResource).Namespace(instanceId).Create(ctx, cluster, metav1.CreateOptions{})
+// CreateCluster renders all objects of an instance and applies them. It converges to the same
+// state if it is retried, e.g. after a failure half way: the parameters of the retry are merged onto
+// the stored ones, the PostgreSQL version, image and identities of the instance are kept.
+func (c *Client) CreateCluster(ctx context.Context, instanceId, serviceId, planId string, params InstanceParameters) (string, error) {
+	plan, err := catalog.GetPlan(serviceId, planId)
 	if err != nil {
 		return "", err
 	}
-
-	// LoadBalancer service(s), create our own because we'll create multiple of them, with different ports
-	lbSvc := &corev1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("%s-lb-rw", clusterName(instanceId)),
-			Namespace: instanceId,
-		},
-		Spec: corev1.ServiceSpec{
-			Type: corev1.ServiceTypeLoadBalancer,
-			Ports: []corev1.ServicePort{
-				{
-					Name:       "postgres",
-					Port:       5432,
-					TargetPort: intstr.FromInt(5432),
-				},
-			},
-			Selector: map[string]string{
-				"cnpg.io/cluster":      clusterName(instanceId),
-				"cnpg.io/instanceRole": "primary",
-			},
-		},
-	}
-	_, err = c.clientset.CoreV1().Services(instanceId).Create(ctx, lbSvc, metav1.CreateOptions{})
+	existing, err := c.clusterObject(ctx, instanceId)
 	if err != nil {
 		return "", err
 	}
 
-	// Pooler for HA clusters
-	if instances > 1 {
-		pooler := &unstructured.Unstructured{
-			Object: map[string]any{
-				"apiVersion": "postgresql.cnpg.io/v1",
-				"kind":       "Pooler",
-				"metadata": map[string]any{
-					"name":      fmt.Sprintf("%s-pooler", clusterName(instanceId)),
-					"namespace": instanceId,
-				},
-				"spec": map[string]any{
-					"cluster": map[string]any{
-						"name": clusterName(instanceId),
-					},
-					"instances": instances,
-					"type":      "rw",
-					"pgbouncer": map[string]any{
-						"poolMode": "session",
-					},
-				},
-			},
+	annotations := make(map[string]string)
+	if existing != nil {
+		stored := decodeParameters(existing.GetAnnotations())
+		params = mergeParameters(stored, params)
+		params.PostgresVersion = stored.PostgresVersion
+		for _, key := range keptAnnotations {
+			if value, found := existing.GetAnnotations()[key]; found {
+				annotations[key] = value
+			}
 		}
-		_, err = c.dynamic.Resource(poolerResource).Namespace(instanceId).Create(ctx, pooler, metav1.CreateOptions{})
-		if err != nil {
-			return "", err
+	} else {
+		setOriginatingIdentity(ctx, annotations, "cnpg-broker.io/created-by")
+		if len(params.Owner) > 0 {
+			annotations[ownerAnnotation] = params.Owner
 		}
+	}
 
-		// LoadBalancer service for Pooler
-		lbSvc := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      fmt.Sprintf("%s-lb-pooler", clusterName(instanceId)),
-				Namespace: instanceId,
-			},
-			Spec: corev1.ServiceSpec{
-				Type: corev1.ServiceTypeLoadBalancer,
-				Ports: []corev1.ServicePort{
-					{
-						Name:       "postgres",
-						Port:       6432,
-						TargetPort: intstr.FromInt(5432),
-					},
-				},
-				Selector: map[string]string{
-					"cnpg.io/poolerName": fmt.Sprintf("%s-pooler", clusterName(instanceId)),
-				},
-			},
-		}
-		_, err = c.clientset.CoreV1().Services(instanceId).Create(ctx, lbSvc, metav1.CreateOptions{})
-		if err != nil {
-			return "", err
-		}
+	// restores take the version of their source. The default is stored with the parameters, so a
+	// later change of the plan's default does not upgrade existing instances.
+	if len(params.PostgresVersion) == 0 && len(params.RestoreFromInstance) == 0 {
+		params.PostgresVersion = plan.Metadata.PostgresVersion
 	}
 
+	if err := c.converge(ctx, instanceId, serviceId, plan, params, annotations, existing, existing != nil); err != nil {
+		return "", err
+	}
 	return instanceId, nil
 }
 
 func (c *Client) GetCluster(ctx context.Context, instanceId string) (*ClusterInfo, error) {
-	info := &ClusterInfo{
-		Exists:     false,
-		InstanceID: instanceId,
-		Namespace:  instanceId,
-		Name:  clusterName(instanceId),
-	}
-
-	cluster, err := c.dynamic.Resource(clusterResource).Namespace(instanceId).Get(ctx, clusterName(instanceId), metav1.GetOptions{})
+	cluster, err := c.getCluster(ctx, instanceId)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			return info, nil
+		if apierrors.IsNotFound(err) {
+			return &ClusterInfo{
+				Exists:     false,
+				InstanceID: instanceId,
+				Namespace:  instanceId,
+				Name:       clusterName(instanceId),
+			}, nil
 		}
 		return nil, err
 	}
-	info.Exists = true
+	return clusterInfo(instanceId, cluster), nil
+}
+
+// clusterInfo extracts the ClusterInfo of instanceId from its Cluster object
+func clusterInfo(instanceId string, cluster *unstructured.Unstructured) *ClusterInfo {
+	info := &ClusterInfo{
+		Exists:     true,
+		InstanceID: instanceId,
+		Namespace:  instanceId,
+		Name:       clusterName(instanceId),
+	}
 	info.Labels = cluster.GetLabels()
 
 	// extract annotations
@@ -250,6 +196,12 @@ func (c *Client) GetCluster(ctx context.Context, instanceId string) (*ClusterInf
 	if planId, ok := annotations["cnpg-broker.io/plan-id"]; ok {
 		info.PlanID = planId
 	}
+	info.Parameters = decodeParameters(annotations)
+	_, _, info.BackupsEnabled = barmanCloudConfiguration(cluster)
+	info.PostgresVersion = clusterPostgresVersion(cluster)
+	info.Generation = cluster.GetGeneration()
+	info.ObservedGeneration = readyObservedGeneration(cluster)
+	info.CreatedAt = cluster.GetCreationTimestamp().Time
 
 	// extract status
 	if statusMap, found, err := unstructured.NestedMap(cluster.Object, "status"); found && err == nil {
@@ -294,110 +246,176 @@ func (c *Client) GetCluster(ctx context.Context, instanceId string) (*ClusterInf
 	if info.IsFailed {
 		info.FailureReason = info.Phase
 	}
-	return info, nil
+	return info
 }
 
 func (c *Client) DeleteCluster(ctx context.Context, instanceId string) error {
-	return c.clientset.CoreV1().Namespaces().Delete(ctx, instanceId, metav1.DeleteOptions{})
+	err := c.clientset.CoreV1().Namespaces().Delete(ctx, instanceId, metav1.DeleteOptions{})
+	if err != nil {
+		return err
+	}
+	audit.Touched(ctx, "Namespace", "", instanceId)
+	return nil
 }
 
-func (c *Client) UpdateCluster(ctx context.Context, instanceId, planId string, instances int64, cpu, memory, storage string) error {
-	cluster, err := c.dynamic.Resource(clusterResource).Namespace(instanceId).Get(ctx, clusterName(instanceId), metav1.GetOptions{})
+// UpdateCluster applies the objects of an instance rendered for a new plan and parameters, which
+// are merged onto the parameters the instance has. It returns the generation of the updated Cluster.
+func (c *Client) UpdateCluster(ctx context.Context, instanceId, serviceId, planId string, params InstanceParameters) (int64, error) {
+	plan, err := catalog.GetPlan(serviceId, planId)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	existing, err := c.dynamic.Resource(clusterResource).Namespace(instanceId).Get(ctx, clusterName(instanceId), metav1.GetOptions{})
+	if err != nil {
+		return 0, err
 	}
 
-	// update plan annotation
-	annotations := cluster.GetAnnotations()
-	if annotations == nil {
-		annotations = make(map[string]string)
+	params = mergeParameters(decodeParameters(existing.GetAnnotations()), params)
+	annotations := make(map[string]string)
+	setOriginatingIdentity(ctx, annotations, "cnpg-broker.io/updated-by")
+	if err := c.converge(ctx, instanceId, serviceId, plan, params, annotations, existing, false); err != nil {
+		return 0, err
+	}
+	if err := c.resizeVolumes(ctx, instanceId, plan.Metadata.Storage); err != nil {
+		return 0, err
 	}
-	annotations["cnpg-broker.io/plan-id"] = planId
-	cluster.SetAnnotations(annotations)
 
-	// update specs
-	if err := unstructured.SetNestedField(cluster.Object, instances, "spec", "instances"); err != nil {
-		return err
+	updated, err := c.dynamic.Resource(clusterResource).Namespace(instanceId).Get(ctx, clusterName(instanceId), metav1.GetOptions{})
+	if err != nil {
+		return 0, err
 	}
-	if err := unstructured.SetNestedField(cluster.Object, cpu, "spec", "resources", "requests", "cpu"); err != nil {
+	return updated.GetGeneration(), nil
+}
+
+// clusterObject returns the Cluster of an instance, nil if it does not exist
+func (c *Client) clusterObject(ctx context.Context, instanceId string) (*unstructured.Unstructured, error) {
+	cluster, err := c.dynamic.Resource(clusterResource).Namespace(instanceId).Get(ctx, clusterName(instanceId), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return cluster, err
+}
+
+// converge renders the objects of an instance and applies them. existing is the current Cluster
+// of the instance, fields only rendered on creation are kept from it, or nil if there is none yet.
+// keepImage keeps the image of the existing Cluster instead of the one of the catalog.
+func (c *Client) converge(ctx context.Context, instanceId, serviceId string, plan catalog.Plan, params InstanceParameters, annotations map[string]string, existing *unstructured.Unstructured, keepImage bool) error {
+	cluster, err := renderCluster(instanceId, serviceId, plan, params, annotations)
+	if err != nil {
 		return err
 	}
-	if err := unstructured.SetNestedField(cluster.Object, cpu, "spec", "resources", "limits", "cpu"); err != nil {
+	if existing != nil {
+		keepClusterFields(cluster, existing, backupConfiguration(plan.ID) != nil, keepImage)
+	}
+	if err := c.applyNamespace(ctx, renderNamespace(instanceId, cluster.GetAnnotations())); err != nil {
 		return err
 	}
-	if err := unstructured.SetNestedField(cluster.Object, memory, "spec", "resources", "requests", "memory"); err != nil {
+	if existing == nil && len(params.RestoreFromInstance) > 0 {
+		spec := cluster.Object["spec"].(map[string]any)
+		if err := c.prepareRestore(ctx, instanceId, params, spec); err != nil {
+			return err
+		}
+	}
+	return c.applyInstance(ctx, instanceId, plan, params, cluster)
+}
+
+// applyInstance applies a rendered Cluster and renders and applies the backup configuration, the
+// Poolers and the services of an instance. Turning off backups keeps the WAL archive.
+func (c *Client) applyInstance(ctx context.Context, instanceId string, plan catalog.Plan, params InstanceParameters, cluster *unstructured.Unstructured) error {
+	backup := backupConfiguration(plan.ID)
+	if backup != nil {
+		if err := c.applyBackupStore(ctx, instanceId, backup); err != nil {
+			return err
+		}
+	}
+	if err := c.applyObject(ctx, clusterResource, cluster); err != nil {
 		return err
 	}
-	if err := unstructured.SetNestedField(cluster.Object, memory, "spec", "resources", "limits", "memory"); err != nil {
+	if backup != nil {
+		if err := c.applyScheduledBackup(ctx, instanceId, backup); err != nil {
+			return err
+		}
+	} else if err := c.deleteScheduledBackup(ctx, instanceId); err != nil {
 		return err
 	}
-	if err := unstructured.SetNestedField(cluster.Object, storage, "spec", "storage", "size"); err != nil {
+
+	if err := c.applyPoolers(ctx, instanceId, plan, params); err != nil {
 		return err
 	}
+	return c.applyExposure(ctx, instanceId, plan, params)
+}
 
-	// update existing Cluster
-	_, err = c.dynamic.Resource(clusterResource).Namespace(instanceId).Update(ctx, cluster, metav1.UpdateOptions{})
+// resizeVolumes grows the data volumes of an instance to size, they are never shrunk
+func (c *Client) resizeVolumes(ctx context.Context, instanceId, size string) error {
+	quantity, err := resource.ParseQuantity(size)
 	if err != nil {
 		return err
 	}
-
-	// scale out PVC if necessary
-	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(clusterName(instanceId)).List(ctx, metav1.ListOptions{})
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(instanceId).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("cnpg.io/cluster=%s,cnpg.io/pvcRole=PG_DATA", clusterName(instanceId)),
+	})
 	if err != nil {
 		return err
 	}
 	for _, pvc := range pvcs.Items {
-		pvc.Spec.Resources.Requests[corev1.ResourceStorage] = resource.MustParse(storage)
-		_, err = c.clientset.CoreV1().PersistentVolumeClaims(clusterName(instanceId)).Update(ctx, &pvc, metav1.UpdateOptions{})
-		if err != nil {
-			return err
+		if current, ok := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; ok && current.Cmp(quantity) >= 0 {
+			continue
+		}
+		resized := corev1ac.PersistentVolumeClaim(pvc.Name, instanceId).
+			WithSpec(corev1ac.PersistentVolumeClaimSpec().
+				WithResources(corev1ac.VolumeResourceRequirements().
+					WithRequests(corev1.ResourceList{corev1.ResourceStorage: quantity})))
+		if _, err := c.clientset.CoreV1().PersistentVolumeClaims(instanceId).Apply(ctx, resized, applyOptions); err != nil {
+			return fmt.Errorf("failed to resize volume %s: %w", pvc.Name, err)
 		}
+		audit.Touched(ctx, "PersistentVolumeClaim", instanceId, pvc.Name)
 	}
-
 	return nil
 }
 
-func (c *Client) GetCredentials(ctx context.Context, instanceId string) (map[string]string, error) {
-	logger.Debug("collecting credentials for instance %s", instanceId)
+func (c *Client) GetCredentials(ctx context.Context, instanceId, bindingId string) (map[string]string, error) {
+	logger.DebugContext(ctx, "collecting credentials for binding %s of instance %s", bindingId, instanceId)
 
 	secretName := fmt.Sprintf("%s-app", clusterName(instanceId))
-	secret, err := c.clientset.CoreV1().Secrets(instanceId).Get(ctx, secretName, metav1.GetOptions{})
+	secret, err := c.getSecret(ctx, instanceId, secretName)
+	if err != nil {
+		return nil, err
+	}
+	bindingSecret, err := c.getSecret(ctx, instanceId, bindingSecretName(instanceId, bindingId))
 	if err != nil {
 		return nil, err
 	}
 
 	host := string(secret.Data["host"])
-	username := string(secret.Data["username"])
-	password := string(secret.Data["password"])
 	database := string(secret.Data["dbname"])
-	fqdnUri := string(secret.Data["fqdn-uri"])
-	jdbcUri := string(secret.Data["fqdn-jdbc-uri"])
+	username := string(bindingSecret.Data[corev1.BasicAuthUsernameKey])
+	password := string(bindingSecret.Data[corev1.BasicAuthPasswordKey])
 	credentials := map[string]string{
 		"host":        host,
 		"port":        "5432",
 		"database":    database,
 		"username":    username,
 		"password":    password,
-		"uri":         fqdnUri,
-		"jdbc_uri":    jdbcUri,
+		"uri":         fmt.Sprintf("postgresql://%s:%s@%s-rw.%s.svc.cluster.local:5432/%s", username, password, clusterName(instanceId), instanceId, database),
+		"jdbc_uri":    fmt.Sprintf("jdbc:postgresql://%s-rw.%s.svc.cluster.local:5432/%s?password=%s&user=%s", clusterName(instanceId), instanceId, database, password, username),
 		"ro_host":     fmt.Sprintf("%s-ro", clusterName(instanceId)),
 		"ro_uri":      fmt.Sprintf("postgresql://%s:%s@%s-ro.%s.svc.cluster.local:5432/%s", username, password, clusterName(instanceId), instanceId, database),
 		"ro_jdbc_uri": fmt.Sprintf("jdbc:postgresql://%s-ro.%s.svc.cluster.local:5432/%s?password=%s&user=%s", clusterName(instanceId), instanceId, database, password, username),
 	}
 
-	logger.Debug("retrieved base credentials for instance %s", instanceId)
+	logger.DebugContext(ctx, "retrieved base credentials for instance %s", instanceId)
 
 	caCertSecretName := fmt.Sprintf("%s-ca", clusterName(instanceId))
-	caCertSecret, err := c.clientset.CoreV1().Secrets(instanceId).Get(ctx, caCertSecretName, metav1.GetOptions{})
+	caCertSecret, err := c.getSecret(ctx, instanceId, caCertSecretName)
 	if err == nil {
 		if caCert, ok := caCertSecret.Data["ca.crt"]; ok {
 			credentials["ca_cert"] = string(caCert)
-			logger.Debug("collected CA certificate for instance %s", instanceId)
+			logger.DebugContext(ctx, "collected CA certificate for instance %s", instanceId)
 		}
 	}
 
 	serverCertSecretName := fmt.Sprintf("%s-server", clusterName(instanceId))
-	serverCertSecret, err := c.clientset.CoreV1().Secrets(instanceId).Get(ctx, serverCertSecretName, metav1.GetOptions{})
+	serverCertSecret, err := c.getSecret(ctx, instanceId, serverCertSecretName)
 	if err == nil {
 		if tlsCert, ok := serverCertSecret.Data["tls.crt"]; ok {
 			credentials["server_cert"] = string(tlsCert)
@@ -406,12 +424,12 @@ func (c *Client) GetCredentials(ctx context.Context, instanceId string) (map[str
 			credentials["server_key"] = string(tlsKey)
 		}
 		if len(credentials["server_cert"]) > 0 {
-			logger.Debug("collected server certificate for instance %s", instanceId)
+			logger.DebugContext(ctx, "collected server certificate for instance %s", instanceId)
 		}
 	}
 
 	poolerCertSecretName := fmt.Sprintf("%s-pooler", clusterName(instanceId))
-	poolerCertSecret, err := c.clientset.CoreV1().Secrets(instanceId).Get(ctx, poolerCertSecretName, metav1.GetOptions{})
+	poolerCertSecret, err := c.getSecret(ctx, instanceId, poolerCertSecretName)
 	if err == nil {
 		if tlsCert, ok := poolerCertSecret.Data["tls.crt"]; ok {
 			credentials["pooler_cert"] = string(tlsCert)
@@ -420,33 +438,12 @@ func (c *Client) GetCredentials(ctx context.Context, instanceId string) (map[str
 			credentials["pooler_key"] = string(tlsKey)
 		}
 		if len(credentials["pooler_cert"]) > 0 {
-			logger.Debug("collected pooler certificate for instance %s", instanceId)
+			logger.DebugContext(ctx, "collected pooler certificate for instance %s", instanceId)
 		}
 	}
 
-	lbSvcName := fmt.Sprintf("%s-lb-rw", clusterName(instanceId))
-	lbSvc, err := c.clientset.CoreV1().Services(instanceId).Get(ctx, lbSvcName, metav1.GetOptions{})
-	if err == nil && len(lbSvc.Status.LoadBalancer.Ingress) > 0 {
-		lbHost := lbSvc.Status.LoadBalancer.Ingress[0].IP
-		if len(lbHost) == 0 {
-			lbHost = lbSvc.Status.LoadBalancer.Ingress[0].Hostname
-		}
-		credentials["lb_host"] = lbHost
-		credentials["lb_uri"] = fmt.Sprintf("postgresql://%s:%s@%s:5432/%s", username, password, lbHost, database)
-		credentials["lb_jdbc_uri"] = fmt.Sprintf("jdbc:postgresql://%s:5432/%s?password=%s&user=%s", lbHost, database, username, password)
-
-		poolerSvcName := fmt.Sprintf("%s-lb-pooler", clusterName(instanceId))
-		poolerSvc, err := c.clientset.CoreV1().Services(instanceId).Get(ctx, poolerSvcName, metav1.GetOptions{})
-		if err == nil && len(poolerSvc.Status.LoadBalancer.Ingress) > 0 {
-			lbHost := poolerSvc.Status.LoadBalancer.Ingress[0].IP
-			if len(lbHost) == 0 {
-				lbHost = poolerSvc.Status.LoadBalancer.Ingress[0].Hostname
-			}
-			credentials["pooler_host"] = lbHost
-			credentials["pooler_port"] = "6432"
-			credentials["pooler_uri"] = fmt.Sprintf("postgresql://%s:%s@%s:6432/%s", username, password, lbHost, database)
-			credentials["pooler_jdbc_uri"] = fmt.Sprintf("jdbc:postgresql://%s:6432/%s?password=%s&user=%s", lbHost, database, username, password)
-		}
+	if err := c.exposedCredentials(ctx, instanceId, credentials); err != nil {
+		logger.WarnContext(ctx, "failed to collect exposed endpoints of instance %s: %v", instanceId, err)
 	}
 
 	return credentials, nil
@@ -457,7 +454,7 @@ func (c *Client) GetNamespaceStatus(ctx context.Context, instanceId string) (*Na
 		Exists: false,
 	}
 
-	ns, err := c.clientset.CoreV1().Namespaces().Get(ctx, instanceId, metav1.GetOptions{})
+	ns, err := c.getNamespace(ctx, instanceId)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			return status, nil
@@ -470,20 +467,3 @@ func (c *Client) GetNamespaceStatus(ctx context.Context, instanceId string) (*Na
 
 	return status, nil
 }
-
-func (c *Client) CheckServicesReady(ctx context.Context, instanceId string) (bool, error) {
-	lbSvc, err := c.clientset.CoreV1().Services(instanceId).Get(ctx,
-		fmt.Sprintf("%s-lb-rw", clusterName(instanceId)), metav1.GetOptions{})
-	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			return false, nil
-		}
-		return false, err
-	}
-
-	if len(lbSvc.Status.LoadBalancer.Ingress) == 0 {
-		return false, nil
-	}
-
-	return true, nil
-}
@@ -0,0 +1,206 @@
+// Package cnpgtest provides fake Kubernetes clients, fixtures and catalog helpers for the tests of the
+// packages built on cnpg.Client
+package cnpgtest
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cnpg-broker/pkg/catalog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/managedfields"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// The services and plans of catalog.yaml used by the tests
+const (
+	ServiceID = "79f7fb16-c95d-4210-8930-1c758648327e" // postgresql-dev-db
+	HAService = "a651d10f-25ab-4a75-99a6-520c0abbe2ae" // postgresql-ha-cluster
+	DevSmall  = "22cedd15-900f-4625-9f10-a57f43c64585" // 1 instance, 1Gi
+	DevMedium = "de7acc66-412d-41c0-bf3e-763307a86c38" // 1 instance, 5Gi
+	HASmall   = "9098f862-fb7e-42b5-9e8c-94c49e231cc3" // 2 instances, 1Gi
+	HAMedium  = "31aaeae1-4716-4631-b43e-93144e689427" // 3 instances, 5Gi
+
+	InstanceID = "fe5556b9-1b2c-4d3e-8f4a-5b6c7d8e9f01"
+	BindingID  = "0b6f7e2a-3c4d-4e5f-8a9b-0c1d2e3f4a5b"
+
+	// CatalogPath is catalog.yaml relative to the directory of a package below pkg
+	CatalogPath = "../../catalog.yaml"
+)
+
+var (
+	ClusterResource         = schema.GroupVersionResource{Group: "postgresql.cnpg.io", Version: "v1", Resource: "clusters"}
+	PoolerResource          = schema.GroupVersionResource{Group: "postgresql.cnpg.io", Version: "v1", Resource: "poolers"}
+	BackupResource          = schema.GroupVersionResource{Group: "postgresql.cnpg.io", Version: "v1", Resource: "backups"}
+	ScheduledBackupResource = schema.GroupVersionResource{Group: "postgresql.cnpg.io", Version: "v1", Resource: "scheduledbackups"}
+	ObjectStoreResource     = schema.GroupVersionResource{Group: "barmancloud.cnpg.io", Version: "v1", Resource: "objectstores"}
+)
+
+// NewClients returns fake k8s clients holding the core objects and the CNPG objects. The dynamic
+// client supports server-side apply, with which the broker applies its objects.
+func NewClients(core []runtime.Object, objects []runtime.Object) (*dynamicfake.FakeDynamicClient, *k8sfake.Clientset) {
+	listKinds := map[schema.GroupVersionResource]string{
+		ClusterResource:         "ClusterList",
+		PoolerResource:          "PoolerList",
+		BackupResource:          "BackupList",
+		ScheduledBackupResource: "ScheduledBackupList",
+		ObjectStoreResource:     "ObjectStoreList",
+	}
+	scheme := runtime.NewScheme()
+	for gvr, listKind := range listKinds {
+		gv := gvr.GroupVersion()
+		scheme.AddKnownTypeWithName(gv.WithKind(strings.TrimSuffix(listKind, "List")), &unstructured.Unstructured{})
+		scheme.AddKnownTypeWithName(gv.WithKind(listKind), &unstructured.UnstructuredList{})
+	}
+	dynClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(scheme, listKinds)
+	tracker := clienttesting.NewFieldManagedObjectTracker(scheme, serializer.NewCodecFactory(scheme).UniversalDecoder(), managedfields.NewDeducedTypeConverter())
+	for _, obj := range objects {
+		if err := tracker.Add(obj); err != nil {
+			panic(err)
+		}
+	}
+	dynClient.ReactionChain = nil
+	dynClient.AddReactor("*", "*", clienttesting.ObjectReaction(tracker))
+	return dynClient, k8sfake.NewClientset(core...)
+}
+
+// Namespace returns the namespace of InstanceID
+func Namespace(terminating bool) *corev1.Namespace {
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   InstanceID,
+			Labels: map[string]string{"cnpg-broker.io/instance-id": InstanceID},
+		},
+	}
+	if terminating {
+		ns.Status.Phase = corev1.NamespaceTerminating
+	}
+	return ns
+}
+
+// LoadBalancer returns the LoadBalancer Service of the primary of InstanceID, with an ingress address if ready
+func LoadBalancer(ready bool) *corev1.Service {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db-" + InstanceID + "-lb-rw",
+			Namespace: InstanceID,
+		},
+		Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+	}
+	if ready {
+		svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}}
+	}
+	return svc
+}
+
+// Cluster returns the Cluster of InstanceID for a plan, with ready of its instances ready and phase
+func Cluster(serviceId, planId string, ready int64, phase string) *unstructured.Unstructured {
+	plan, _ := catalog.FindPlan(planId)
+	return &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "Cluster",
+			"metadata": map[string]any{
+				"name":      "db-" + InstanceID,
+				"namespace": InstanceID,
+				"labels": map[string]any{
+					"cnpg-broker.io/instance-id": InstanceID,
+				},
+				"annotations": map[string]any{
+					"cnpg-broker.io/service-id": serviceId,
+					"cnpg-broker.io/plan-id":    planId,
+				},
+			},
+			"spec": map[string]any{
+				"instances": plan.Metadata.Instances,
+				"storage": map[string]any{
+					"size": plan.Metadata.Storage,
+				},
+				"resources": map[string]any{
+					"requests": map[string]any{
+						"cpu":    plan.Metadata.CPU,
+						"memory": plan.Metadata.Memory,
+					},
+				},
+			},
+			"status": map[string]any{
+				"instances":      plan.Metadata.Instances,
+				"readyInstances": ready,
+				"phase":          phase,
+			},
+		},
+	}
+}
+
+// SetReady marks the Cluster of InstanceID as healthy with all its instances ready
+func SetReady(t testing.TB, dynClient *dynamicfake.FakeDynamicClient) *unstructured.Unstructured {
+	t.Helper()
+	ctx := context.Background()
+	cluster, err := dynClient.Resource(ClusterResource).Namespace(InstanceID).Get(ctx, "db-"+InstanceID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get cluster: %v", err)
+	}
+	instances, _, _ := unstructured.NestedInt64(cluster.Object, "spec", "instances")
+	_ = unstructured.SetNestedMap(cluster.Object, map[string]any{
+		"instances": instances, "readyInstances": instances, "phase": "Cluster in healthy state",
+	}, "status")
+	cluster, err = dynClient.Resource(ClusterResource).Namespace(InstanceID).Update(ctx, cluster, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("failed to update cluster status: %v", err)
+	}
+	return cluster
+}
+
+// GetCluster returns the Cluster of InstanceID
+func GetCluster(t testing.TB, dynClient *dynamicfake.FakeDynamicClient) *unstructured.Unstructured {
+	t.Helper()
+	cluster, err := dynClient.Resource(ClusterResource).Namespace(InstanceID).Get(context.Background(), "db-"+InstanceID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get cluster: %v", err)
+	}
+	return cluster
+}
+
+// LoadCatalog installs catalog.yaml, e.g. in TestMain
+func LoadCatalog() {
+	data, err := os.ReadFile(CatalogPath)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := catalog.Update(context.Background(), data, CatalogPath, nil); err != nil {
+		panic(err)
+	}
+}
+
+// ReadCatalog returns catalog.yaml, e.g. to be changed and installed with UseCatalog
+func ReadCatalog(t testing.TB) string {
+	t.Helper()
+	data, err := os.ReadFile(CatalogPath)
+	if err != nil {
+		t.Fatalf("failed to read catalog: %v", err)
+	}
+	return string(data)
+}
+
+// UseCatalog installs a catalog for the duration of a test, catalog.yaml is restored afterwards
+func UseCatalog(t testing.TB, data string) {
+	t.Helper()
+	original := ReadCatalog(t)
+	t.Cleanup(func() {
+		if _, err := catalog.Update(context.Background(), []byte(original), CatalogPath, nil); err != nil {
+			t.Fatalf("failed to restore catalog: %v", err)
+		}
+	})
+	if _, err := catalog.Update(context.Background(), []byte(data), "test", nil); err != nil {
+		t.Fatalf("failed to load catalog: %v", err)
+	}
+}
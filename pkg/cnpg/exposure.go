@@ -0,0 +1,242 @@
+package cnpg
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/cnpg-broker/pkg/audit"
+	"github.com/cnpg-broker/pkg/catalog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var tlsRouteResource = schema.GroupVersionResource{
+	Group:    "gateway.networking.k8s.io",
+	Version:  "v1alpha2",
+	Resource: "tlsroutes",
+}
+
+// endpoint is an address an instance is reachable at
+type endpoint struct {
+	host string
+	port int32
+}
+
+// endpoints are the exposed endpoints of an instance, replicas only for HA instances and poolers only
+// for pooled ones
+type endpoints struct {
+	primary  endpoint
+	replicas endpoint
+	pooler   endpoint
+	roPooler endpoint
+}
+
+// applyExposure applies the Services or the TLSRoute exposing an instance and deletes those of
+// another exposure, e.g. after a plan change
+func (c *Client) applyExposure(ctx context.Context, instanceId string, plan catalog.Plan, params InstanceParameters) error {
+	rendered := make(map[string]bool)
+	for _, svc := range renderServices(instanceId, plan, params) {
+		if err := c.applyService(ctx, svc); err != nil {
+			return err
+		}
+		rendered[*svc.Name] = true
+	}
+	for _, name := range exposedServiceNames(instanceId) {
+		if rendered[name] {
+			continue
+		}
+		if err := c.clientset.CoreV1().Services(instanceId).Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return fmt.Errorf("failed to delete service %s: %w", name, err)
+			}
+			continue
+		}
+		audit.Touched(ctx, "Service", instanceId, name)
+	}
+
+	if route := renderTLSRoute(instanceId, plan); route != nil {
+		return c.applyObject(ctx, tlsRouteResource, route)
+	}
+	// without any plan using TLSRoutes the Gateway API may not be installed, nor the broker allowed to use it
+	if !tlsRoutesEnabled() {
+		return nil
+	}
+	if err := c.dynamic.Resource(tlsRouteResource).Namespace(instanceId).Delete(ctx, clusterName(instanceId), metav1.DeleteOptions{}); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete TLSRoute %s: %w", clusterName(instanceId), err)
+	}
+	audit.Touched(ctx, "TLSRoute", instanceId, clusterName(instanceId))
+	return nil
+}
+
+// tlsRoutesEnabled returns true if any plan in the catalog is exposed with a TLSRoute
+func tlsRoutesEnabled() bool {
+	for _, plan := range catalog.Plans() {
+		if plan.ExposureConfig().Mode == catalog.ExposureTLSRoute {
+			return true
+		}
+	}
+	return false
+}
+
+// instancePlan returns the plan and parameters of an instance from the annotations of its Cluster
+func (c *Client) instancePlan(ctx context.Context, instanceId string) (catalog.Plan, InstanceParameters, error) {
+	cluster, err := c.getCluster(ctx, instanceId)
+	if err != nil {
+		return catalog.Plan{}, InstanceParameters{}, err
+	}
+	annotations := cluster.GetAnnotations()
+	plan, err := catalog.GetPlan(annotations["cnpg-broker.io/service-id"], annotations["cnpg-broker.io/plan-id"])
+	return plan, decodeParameters(annotations), err
+}
+
+// exposedEndpoints returns the endpoints of an instance as exposed by its plan. An endpoint is
+// empty while it is not ready, e.g. a LoadBalancer without ingress address or a TLSRoute not
+// accepted by its Gateway.
+func (c *Client) exposedEndpoints(ctx context.Context, instanceId string) (catalog.Exposure, endpoints, error) {
+	var exposed endpoints
+	plan, params, err := c.instancePlan(ctx, instanceId)
+	if err != nil {
+		return catalog.Exposure{}, exposed, err
+	}
+	exposure := plan.ExposureConfig()
+
+	switch exposure.Mode {
+	case catalog.ExposureNone:
+	case catalog.ExposureTLSRoute:
+		route, err := c.dynamic.Resource(tlsRouteResource).Namespace(instanceId).Get(ctx, clusterName(instanceId), metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				err = nil
+			}
+			return exposure, exposed, err
+		}
+		if routeAccepted(route) {
+			exposed.primary = endpoint{host: routeHostname(instanceId, exposure), port: exposure.Port}
+		}
+	default:
+		ha := plan.Metadata.Instances > 1
+		pooled := poolerConfig(plan, params).enabled
+		for _, svc := range []struct {
+			exposed  bool
+			endpoint *endpoint
+			name     string
+			port     int32
+		}{
+			{true, &exposed.primary, primaryServiceName(instanceId), 5432},
+			{ha, &exposed.replicas, replicaServiceName(instanceId), 5432},
+			{pooled, &exposed.pooler, poolerServiceName(instanceId), 6432},
+			{pooled && ha, &exposed.roPooler, roPoolerServiceName(instanceId), 6432},
+		} {
+			if !svc.exposed {
+				continue
+			}
+			if *svc.endpoint, err = c.serviceEndpoint(ctx, instanceId, svc.name, svc.port, exposure); err != nil {
+				return exposure, exposed, err
+			}
+		}
+	}
+	return exposure, exposed, nil
+}
+
+// serviceEndpoint returns the endpoint of an exposed Service with port, empty if it is not ready
+func (c *Client) serviceEndpoint(ctx context.Context, instanceId, name string, port int32, exposure catalog.Exposure) (endpoint, error) {
+	svc, err := c.getService(ctx, instanceId, name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return endpoint{}, nil
+		}
+		return endpoint{}, err
+	}
+	switch svc.Spec.Type {
+	case corev1.ServiceTypeLoadBalancer:
+		if len(svc.Status.LoadBalancer.Ingress) == 0 {
+			return endpoint{}, nil
+		}
+		host := svc.Status.LoadBalancer.Ingress[0].IP
+		if len(host) == 0 {
+			host = svc.Status.LoadBalancer.Ingress[0].Hostname
+		}
+		return endpoint{host: host, port: port}, nil
+	case corev1.ServiceTypeNodePort:
+		for _, servicePort := range svc.Spec.Ports {
+			if servicePort.Port == port && servicePort.NodePort != 0 {
+				return endpoint{host: exposure.NodeAddress, port: servicePort.NodePort}, nil
+			}
+		}
+		return endpoint{}, nil
+	default:
+		return endpoint{host: fmt.Sprintf("%s.%s.svc.cluster.local", name, instanceId), port: port}, nil
+	}
+}
+
+// routeAccepted returns true if a Gateway accepted the TLSRoute
+func routeAccepted(route *unstructured.Unstructured) bool {
+	parents, _, _ := unstructured.NestedSlice(route.Object, "status", "parents")
+	for _, parent := range parents {
+		conditions, _, _ := unstructured.NestedSlice(parent.(map[string]any), "conditions")
+		for _, condition := range conditions {
+			condition, _ := condition.(map[string]any)
+			if condition["type"] == "Accepted" && condition["status"] == string(metav1.ConditionTrue) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckServicesReady returns true once the primary of an instance is reachable as exposed by its plan
+func (c *Client) CheckServicesReady(ctx context.Context, instanceId string) (bool, error) {
+	exposure, exposed, err := c.exposedEndpoints(ctx, instanceId)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return exposure.Mode == catalog.ExposureNone || exposed.primary.port != 0, nil
+}
+
+// exposedCredentials adds the endpoints of an instance as exposed by its plan to the credentials of a binding
+func (c *Client) exposedCredentials(ctx context.Context, instanceId string, credentials map[string]string) error {
+	exposure, exposed, err := c.exposedEndpoints(ctx, instanceId)
+	if err != nil {
+		return err
+	}
+	username, password, database := credentials["username"], credentials["password"], credentials["database"]
+	set := func(prefix string, e endpoint, withPort bool) {
+		if len(e.host) == 0 {
+			return
+		}
+		credentials[prefix+"_host"] = e.host
+		if withPort {
+			credentials[prefix+"_port"] = strconv.Itoa(int(e.port))
+		}
+		credentials[prefix+"_uri"] = fmt.Sprintf("postgresql://%s:%s@%s:%d/%s", username, password, e.host, e.port, database)
+		credentials[prefix+"_jdbc_uri"] = fmt.Sprintf("jdbc:postgresql://%s:%d/%s?password=%s&user=%s", e.host, e.port, database, password, username)
+	}
+
+	set("external", exposed.primary, true)
+	set("external_ro", exposed.replicas, true)
+	set("pooler", exposed.pooler, true)
+	set("pooler_ro", exposed.roPooler, true)
+	switch exposure.Mode {
+	case catalog.ExposureTLSRoute:
+		if len(exposed.primary.host) > 0 {
+			// the Gateway routes by SNI, which needs TLS from the first byte instead of PostgreSQL's SSLRequest
+			credentials["external_uri"] += "?sslmode=require&sslnegotiation=direct"
+			credentials["external_jdbc_uri"] += "&sslmode=require&sslNegotiation=direct"
+		}
+	case catalog.ExposureLoadBalancer:
+		// the lb_ keys predate the other exposures
+		set("lb", exposed.primary, false)
+		set("lb_ro", exposed.replicas, false)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package cnpg
+
+import (
+	"context"
+
+	"github.com/cnpg-broker/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// bindingSelector selects the Secrets of bindings
+const bindingSelector = "cnpg-broker.io/binding-id"
+
+// FleetInstances returns the state of all service instances for the fleet metrics, served from the
+// cache if it is synced
+func (c *Client) FleetInstances(ctx context.Context) ([]metrics.FleetInstance, error) {
+	clusters, err := c.ListClusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := c.listSecrets(ctx, bindingSelector)
+	if err != nil {
+		return nil, err
+	}
+	services, err := c.listServices(ctx, instanceSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := make(map[string]int)
+	for _, secret := range secrets {
+		// projected Secrets carry the binding label too, but live outside of the instance namespace
+		if instanceId := secret.Labels[instanceSelector]; instanceId == secret.Namespace {
+			bindings[instanceId]++
+		}
+	}
+	pending := make(map[string]int)
+	for _, svc := range services {
+		if svc.Spec.Type == corev1.ServiceTypeLoadBalancer && len(svc.Status.LoadBalancer.Ingress) == 0 {
+			pending[svc.Labels[instanceSelector]]++
+		}
+	}
+
+	fleet := make([]metrics.FleetInstance, 0, len(clusters))
+	for _, cluster := range clusters {
+		fleet = append(fleet, metrics.FleetInstance{
+			InstanceID:           cluster.InstanceID,
+			ServiceID:            cluster.ServiceID,
+			PlanID:               cluster.PlanID,
+			Phase:                cluster.Phase,
+			Instances:            cluster.Instances,
+			ReadyInstances:       cluster.ReadyInstances,
+			Failed:               cluster.IsFailed,
+			Provisioning:         cluster.IsProvisioning,
+			CreatedAt:            cluster.CreatedAt,
+			Bindings:             bindings[cluster.InstanceID],
+			PendingLoadBalancers: pending[cluster.InstanceID],
+		})
+	}
+	return fleet, nil
+}
+
+func (c *Client) listSecrets(ctx context.Context, selector string) ([]*corev1.Secret, error) {
+	if c.cacheReady() {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			return nil, err
+		}
+		return c.cache.secrets.List(parsed)
+	}
+	list, err := c.clientset.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]*corev1.Secret, 0, len(list.Items))
+	for i := range list.Items {
+		secrets = append(secrets, &list.Items[i])
+	}
+	return secrets, nil
+}
+
+func (c *Client) listServices(ctx context.Context, selector string) ([]*corev1.Service, error) {
+	if c.cacheReady() {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			return nil, err
+		}
+		return c.cache.services.List(parsed)
+	}
+	list, err := c.clientset.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	services := make([]*corev1.Service, 0, len(list.Items))
+	for i := range list.Items {
+		services = append(services, &list.Items[i])
+	}
+	return services, nil
+}
+
+// PlanUsage returns the number of service instances per plan ID
+func (c *Client) PlanUsage(ctx context.Context) (map[string]int, error) {
+	clusters, err := c.ListClusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]int)
+	for _, cluster := range clusters {
+		usage[cluster.PlanID]++
+	}
+	return usage, nil
+}
@@ -0,0 +1,218 @@
+package cnpg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cnpg-broker/pkg/audit"
+	"github.com/cnpg-broker/pkg/identity"
+	"github.com/cnpg-broker/pkg/logger"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	OperationProvision   = "provision"
+	OperationUpdate      = "update"
+	OperationDeprovision = "deprovision"
+	OperationBind        = "bind"
+	OperationUnbind      = "unbind"
+
+	OperationInProgress = "in progress"
+	OperationSucceeded  = "succeeded"
+	OperationFailed     = "failed"
+
+	// maxOperations is the number of operations kept in the journal of an instance
+	maxOperations = 20
+)
+
+var ErrOperationNotFound = errors.New("operation not found")
+
+// operationsName is the name of the ConfigMap holding the operation journal of an instance
+func operationsName(instanceId string) string {
+	return fmt.Sprintf("%s-operations", clusterName(instanceId))
+}
+
+// StartOperation records a new in progress operation in the journal of an instance,
+// the returned operation carries the generated ID to be handed out as operation token.
+func (c *Client) StartOperation(ctx context.Context, instanceId string, op Operation) (*Operation, error) {
+	id, err := generateOperationID(op.Type)
+	if err != nil {
+		return nil, err
+	}
+	op.ID = id
+	op.State = OperationInProgress
+	op.StartedAt = time.Now().UTC()
+	if originator := identity.FromContext(ctx); originator != nil {
+		op.Identity = originator.String()
+	}
+
+	err = c.updateJournal(ctx, instanceId, func(journal map[string]*Operation) {
+		journal[op.ID] = &op
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record %s operation: %w", op.Type, err)
+	}
+	logger.DebugContext(ctx, "started %s operation %s for instance %s", op.Type, op.ID, instanceId)
+	return &op, nil
+}
+
+// FinishOperation records the final state of an operation in the journal of an instance
+func (c *Client) FinishOperation(ctx context.Context, instanceId, operationId, state, description string) error {
+	return c.updateJournal(ctx, instanceId, func(journal map[string]*Operation) {
+		if op, ok := journal[operationId]; ok && op.State == OperationInProgress {
+			now := time.Now().UTC()
+			op.State = state
+			op.Description = description
+			op.FinishedAt = &now
+		}
+	})
+}
+
+// GetOperation returns an operation from the journal of an instance, or ErrOperationNotFound
+func (c *Client) GetOperation(ctx context.Context, instanceId, operationId string) (*Operation, error) {
+	journal, _, err := c.readJournal(ctx, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	op, ok := journal[operationId]
+	if !ok {
+		return nil, ErrOperationNotFound
+	}
+	return op, nil
+}
+
+// LatestOperation returns the most recently started operation of a binding, or of the instance itself
+// if bindingId is empty. It returns ErrOperationNotFound if there is none, e.g. because the instance
+// was provisioned by an older broker version without journal.
+func (c *Client) LatestOperation(ctx context.Context, instanceId, bindingId string) (*Operation, error) {
+	journal, _, err := c.readJournal(ctx, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range sortedOperations(journal) {
+		if op.BindingID == bindingId {
+			return op, nil
+		}
+	}
+	return nil, ErrOperationNotFound
+}
+
+// readJournal returns the operations of an instance and the ConfigMap they are stored in,
+// which is nil if there is no journal yet
+func (c *Client) readJournal(ctx context.Context, instanceId string) (map[string]*Operation, *corev1.ConfigMap, error) {
+	journal := make(map[string]*Operation)
+	cm, err := c.clientset.CoreV1().ConfigMaps(instanceId).Get(ctx, operationsName(instanceId), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return journal, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	for id, data := range cm.Data {
+		var op Operation
+		if err := json.Unmarshal([]byte(data), &op); err != nil {
+			logger.WarnContext(ctx, "ignoring invalid operation %s of instance %s: %v", id, instanceId, err)
+			continue
+		}
+		journal[id] = &op
+	}
+	return journal, cm, nil
+}
+
+// updateJournal applies mutate to the operations of an instance and stores them,
+// only the most recent operations are kept
+func (c *Client) updateJournal(ctx context.Context, instanceId string, mutate func(map[string]*Operation)) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		journal, cm, err := c.readJournal(ctx, instanceId)
+		if err != nil {
+			return err
+		}
+		mutate(journal)
+
+		data := make(map[string]string)
+		for i, op := range sortedOperations(journal) {
+			if i >= maxOperations {
+				break
+			}
+			encoded, err := json.Marshal(op)
+			if err != nil {
+				return err
+			}
+			data[op.ID] = string(encoded)
+		}
+
+		if cm == nil {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      operationsName(instanceId),
+					Namespace: instanceId,
+					Labels: map[string]string{
+						"cnpg-broker.io/instance-id": instanceId,
+					},
+				},
+				Data: data,
+			}
+			_, err = c.clientset.CoreV1().ConfigMaps(instanceId).Create(ctx, cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// created concurrently, retry as update
+				return apierrors.NewConflict(corev1.Resource("configmaps"), cm.Name, err)
+			}
+			return err
+		}
+		cm.Data = data
+		_, err = c.clientset.CoreV1().ConfigMaps(instanceId).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	audit.Touched(ctx, "ConfigMap", instanceId, operationsName(instanceId))
+	return nil
+}
+
+// sortedOperations returns the operations of a journal, most recently started first
+func sortedOperations(journal map[string]*Operation) []*Operation {
+	operations := make([]*Operation, 0, len(journal))
+	for _, op := range journal {
+		operations = append(operations, op)
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		return operations[i].StartedAt.After(operations[j].StartedAt)
+	})
+	return operations
+}
+
+func generateOperationID(opType string) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to generate operation ID: %w", err)
+	}
+	return fmt.Sprintf("%s-%s", opType, hex.EncodeToString(suffix)), nil
+}
+
+// readyObservedGeneration returns the generation the Ready condition of a Cluster was observed for,
+// or 0 if the condition does not report it
+func readyObservedGeneration(cluster *unstructured.Unstructured) int64 {
+	conditions, _, _ := unstructured.NestedSlice(cluster.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]any)
+		if !ok || condition["type"] != "Ready" {
+			continue
+		}
+		if generation, ok := condition["observedGeneration"].(int64); ok {
+			return generation
+		}
+	}
+	return 0
+}
@@ -0,0 +1,298 @@
+package cnpg
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/cnpg-broker/pkg/audit"
+	"github.com/cnpg-broker/pkg/catalog"
+	"github.com/cnpg-broker/pkg/config"
+	"github.com/cnpg-broker/pkg/logger"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// The categories of inconsistencies between the instances the broker knows and the objects in the cluster
+const (
+	// OrphanNamespace is an instance namespace without Cluster
+	OrphanNamespace = "namespace-without-cluster"
+	// OrphanMissingService is a Cluster without one of the Services exposing it
+	OrphanMissingService = "cluster-without-service"
+	// OrphanVolume is a PVC of a Cluster that is gone or reports it as dangling
+	OrphanVolume = "dangling-volume"
+	// OrphanLoadBalancer is a LoadBalancer Service of an instance without Cluster, which keeps its address allocated
+	OrphanLoadBalancer = "loadbalancer-without-cluster"
+
+	OrphanActionDelete = "delete"
+	OrphanActionRepair = "repair"
+	// OrphanActionReport is an orphan that is only reported, it needs to be resolved manually
+	OrphanActionReport = "report"
+)
+
+// Orphan is an inconsistency found by FindOrphans
+type Orphan struct {
+	// ID identifies the orphan for CleanupOrphans
+	ID         string `json:"id"`
+	Category   string `json:"category"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	InstanceID string `json:"instance_id"`
+	Reason     string `json:"reason"`
+	// Action is how CleanupOrphans resolves it: deleting the object, reconciling the instance or not at all
+	Action    string    `json:"action"`
+	Addresses []string  `json:"addresses,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OrphanCleanup is the result of cleaning up an orphan
+type OrphanCleanup struct {
+	Orphan
+	DryRun bool   `json:"dry_run"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newOrphan(category, kind, action, instanceId string, obj metav1.Object, reason string) Orphan {
+	return Orphan{
+		ID:         fmt.Sprintf("%s/%s/%s", category, obj.GetNamespace(), obj.GetName()),
+		Category:   category,
+		Kind:       kind,
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+		InstanceID: instanceId,
+		Reason:     reason,
+		Action:     action,
+		CreatedAt:  obj.GetCreationTimestamp().Time,
+	}
+}
+
+// FindOrphans compares the instance namespaces with their Clusters, Services and PVCs
+// and returns every inconsistency. Objects younger than the grace period are skipped, as they may
+// belong to a provision in progress, as are namespaces being deleted.
+func (c *Client) FindOrphans(ctx context.Context) ([]Orphan, error) {
+	grace := config.Get().Orphans.GracePeriod
+	settled := func(obj metav1.Object) bool {
+		return time.Since(obj.GetCreationTimestamp().Time) >= grace
+	}
+
+	namespaces, err := c.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: instanceSelector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	clusterList, err := c.listClusterObjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list clusters: %w", err)
+	}
+	services, err := c.listServices(ctx, instanceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: "cnpg.io/cluster"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %w", err)
+	}
+
+	instances := make(map[string]*corev1.Namespace)
+	for i := range namespaces.Items {
+		ns := &namespaces.Items[i]
+		instances[ns.Name] = ns
+	}
+	clusters := make(map[string]*unstructured.Unstructured)
+	for _, cluster := range clusterList {
+		if _, found := instances[cluster.GetNamespace()]; found && cluster.GetName() == clusterName(cluster.GetNamespace()) {
+			clusters[cluster.GetNamespace()] = cluster
+		}
+	}
+	existingServices := make(map[string]bool)
+	for _, svc := range services {
+		existingServices[svc.Namespace+"/"+svc.Name] = true
+	}
+
+	var orphans []Orphan
+	for instanceId, ns := range instances {
+		if ns.DeletionTimestamp != nil {
+			continue
+		}
+		cluster, found := clusters[instanceId]
+		if !found {
+			if settled(ns) {
+				orphans = append(orphans, namespaceOrphan(instanceId, ns))
+			}
+			continue
+		}
+		if !settled(cluster) {
+			continue
+		}
+		annotations := cluster.GetAnnotations()
+		plan, err := catalog.GetPlan(annotations["cnpg-broker.io/service-id"], annotations["cnpg-broker.io/plan-id"])
+		if err != nil {
+			continue
+		}
+		for _, svc := range renderServices(instanceId, plan, decodeParameters(annotations)) {
+			if !existingServices[instanceId+"/"+*svc.Name] {
+				orphan := newOrphan(OrphanMissingService, "Service", OrphanActionRepair, instanceId, cluster,
+					fmt.Sprintf("Cluster without Service %s", *svc.Name))
+				orphan.ID = fmt.Sprintf("%s/%s/%s", OrphanMissingService, instanceId, *svc.Name)
+				orphan.Name = *svc.Name
+				orphans = append(orphans, orphan)
+			}
+		}
+	}
+
+	for _, svc := range services {
+		instanceId := svc.Labels[instanceSelector]
+		if svc.Spec.Type != corev1.ServiceTypeLoadBalancer || svc.DeletionTimestamp != nil || !settled(svc) {
+			continue
+		}
+		if _, found := clusters[instanceId]; found {
+			continue
+		}
+		if ns, found := instances[svc.Namespace]; found && ns.DeletionTimestamp != nil {
+			continue
+		}
+		orphan := newOrphan(OrphanLoadBalancer, "Service", OrphanActionDelete, instanceId, svc,
+			"LoadBalancer Service of an instance without Cluster")
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			orphan.Addresses = append(orphan.Addresses, ingress.IP+ingress.Hostname)
+		}
+		orphans = append(orphans, orphan)
+	}
+
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		ns, found := instances[pvc.Namespace]
+		if !found || ns.DeletionTimestamp != nil || pvc.DeletionTimestamp != nil || !settled(pvc) {
+			continue
+		}
+		cluster, found := clusters[pvc.Namespace]
+		action, reason := OrphanActionDelete, "volume of a Cluster that does not exist"
+		if found {
+			dangling, _, _ := unstructured.NestedStringSlice(cluster.Object, "status", "danglingPVC")
+			if !slices.Contains(dangling, pvc.Name) {
+				continue
+			}
+			reason = "volume reported as dangling by its Cluster"
+		} else if namespaceOrphan(pvc.Namespace, ns).Action != OrphanActionDelete {
+			// the data of a namespace that is repaired or kept is kept as well
+			action, reason = OrphanActionReport, "volume of a Cluster that does not exist, not deleted as its namespace is kept"
+		}
+		orphans = append(orphans, newOrphan(OrphanVolume, "PersistentVolumeClaim", action, pvc.Namespace, pvc, reason))
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].ID < orphans[j].ID
+	})
+	return orphans, nil
+}
+
+// namespaceOrphan returns the orphan of an instance namespace without Cluster. Namespaces annotated with the
+// plan of their instance are repaired by reconciling it, the data may still be in their volumes. Only
+// namespaces without annotations, which cannot be reconciled, are deleted, others are reported.
+func namespaceOrphan(instanceId string, ns *corev1.Namespace) Orphan {
+	switch {
+	case len(ns.Annotations["cnpg-broker.io/plan-id"]) > 0:
+		return newOrphan(OrphanNamespace, "Namespace", OrphanActionRepair, instanceId, ns,
+			"instance namespace without Cluster, re-created from the plan annotated on the namespace")
+	case len(ns.Annotations) == 0:
+		return newOrphan(OrphanNamespace, "Namespace", OrphanActionDelete, instanceId, ns,
+			"instance namespace without Cluster")
+	default:
+		return newOrphan(OrphanNamespace, "Namespace", OrphanActionReport, instanceId, ns,
+			"instance namespace without Cluster, not deleted as it has annotations")
+	}
+}
+
+// listClusterObjects returns all Clusters, served from the cache if it is synced
+func (c *Client) listClusterObjects(ctx context.Context) ([]*unstructured.Unstructured, error) {
+	if c.cacheReady() {
+		return c.listClusters()
+	}
+	list, err := c.dynamic.Resource(clusterResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: instanceSelector})
+	if err != nil {
+		return nil, err
+	}
+	clusters := make([]*unstructured.Unstructured, 0, len(list.Items))
+	for i := range list.Items {
+		clusters = append(clusters, &list.Items[i])
+	}
+	return clusters, nil
+}
+
+// CleanupOrphans resolves the orphans with the given IDs, which must still be reported by FindOrphans.
+// With dryRun the actions are only reported.
+func (c *Client) CleanupOrphans(ctx context.Context, ids []string, dryRun bool) ([]OrphanCleanup, error) {
+	orphans, err := c.FindOrphans(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]OrphanCleanup, 0, len(ids))
+	for _, id := range ids {
+		index := slices.IndexFunc(orphans, func(orphan Orphan) bool {
+			return orphan.ID == id
+		})
+		if index < 0 {
+			results = append(results, OrphanCleanup{Orphan: Orphan{ID: id}, DryRun: dryRun, Error: "not an orphan"})
+			continue
+		}
+		result := OrphanCleanup{Orphan: orphans[index], DryRun: dryRun}
+		if !dryRun {
+			if err := c.cleanupOrphan(ctx, result.Orphan); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		logger.InfoContext(ctx, "cleaned up orphan %s with %s (dry run: %t): %s", id, result.Action, dryRun, result.Error)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (c *Client) cleanupOrphan(ctx context.Context, orphan Orphan) error {
+	switch orphan.Action {
+	case OrphanActionReport:
+		return fmt.Errorf("orphan %s is only reported, it needs to be resolved manually", orphan.ID)
+	case OrphanActionRepair:
+		_, err := c.ReconcileInstance(ctx, orphan.InstanceID)
+		return err
+	}
+
+	var err error
+	switch orphan.Category {
+	case OrphanNamespace:
+		err = c.clientset.CoreV1().Namespaces().Delete(ctx, orphan.Name, metav1.DeleteOptions{})
+	case OrphanLoadBalancer:
+		err = c.clientset.CoreV1().Services(orphan.Namespace).Delete(ctx, orphan.Name, metav1.DeleteOptions{})
+	case OrphanVolume:
+		err = c.clientset.CoreV1().PersistentVolumeClaims(orphan.Namespace).Delete(ctx, orphan.Name, metav1.DeleteOptions{})
+	default:
+		return fmt.Errorf("unknown orphan category %s", orphan.Category)
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	audit.Touched(ctx, orphan.Kind, orphan.Namespace, orphan.Name)
+	return nil
+}
+
+// OrphanCounts returns the number of orphans per category for the metrics
+func (c *Client) OrphanCounts(ctx context.Context) (map[string]int, error) {
+	orphans, err := c.FindOrphans(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{
+		OrphanNamespace:      0,
+		OrphanMissingService: 0,
+		OrphanVolume:         0,
+		OrphanLoadBalancer:   0,
+	}
+	for _, orphan := range orphans {
+		counts[orphan.Category]++
+	}
+	return counts, nil
+}
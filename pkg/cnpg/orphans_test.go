@@ -0,0 +1,141 @@
+package cnpg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cnpg-broker/pkg/cnpg/cnpgtest"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestOrphans(t *testing.T) {
+	created := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	labels := map[string]string{"cnpg-broker.io/instance-id": cnpgtest.InstanceID}
+	ns := cnpgtest.Namespace(false)
+	ns.CreationTimestamp = created
+	svc := cnpgtest.LoadBalancer(true)
+	svc.Labels = labels
+	svc.CreationTimestamp = created
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "db-" + cnpgtest.InstanceID + "-1",
+			Namespace:         cnpgtest.InstanceID,
+			Labels:            map[string]string{"cnpg.io/cluster": "db-" + cnpgtest.InstanceID},
+			CreationTimestamp: created,
+		},
+	}
+	// a namespace of a provision in progress is not an orphan yet
+	recent := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "recent",
+			Labels:            map[string]string{"cnpg-broker.io/instance-id": "recent"},
+			CreationTimestamp: metav1.Now(),
+		},
+	}
+	// namespaces with annotations are not deleted, those with the plan of their instance are repaired
+	annotated := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "annotated",
+			Labels:            map[string]string{"cnpg-broker.io/instance-id": "annotated"},
+			Annotations:       map[string]string{"example.com/owner": "team"},
+			CreationTimestamp: created,
+		},
+	}
+	planned := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "planned",
+			Labels: map[string]string{"cnpg-broker.io/instance-id": "planned"},
+			Annotations: map[string]string{
+				"cnpg-broker.io/service-id": cnpgtest.ServiceID,
+				"cnpg-broker.io/plan-id":    cnpgtest.DevSmall,
+			},
+			CreationTimestamp: created,
+		},
+	}
+	// the volumes of a repaired namespace keep the data of its instance
+	plannedPVC := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "db-planned-1",
+			Namespace:         "planned",
+			Labels:            map[string]string{"cnpg.io/cluster": "db-planned"},
+			CreationTimestamp: created,
+		},
+	}
+	client, _, clientset := newTestClient([]runtime.Object{ns, svc, pvc, recent, annotated, planned, plannedPVC}, nil)
+	ctx := context.Background()
+
+	orphans, err := client.FindOrphans(ctx)
+	if err != nil {
+		t.Fatalf("failed to find orphans: %v", err)
+	}
+	categories := make(map[string]string)
+	actions := make(map[string]string)
+	for _, orphan := range orphans {
+		categories[orphan.Category] = orphan.ID
+		actions[orphan.ID] = orphan.Action
+	}
+	for _, category := range []string{OrphanNamespace, OrphanLoadBalancer, OrphanVolume} {
+		if categories[category] == "" {
+			t.Errorf("expected a %s orphan, got %v", category, orphans)
+		}
+	}
+	if len(orphans) != 6 {
+		t.Errorf("expected 6 orphans, got %v", orphans)
+	}
+	for id, action := range map[string]string{
+		OrphanNamespace + "//" + cnpgtest.InstanceID:              OrphanActionDelete,
+		OrphanNamespace + "//annotated":                           OrphanActionReport,
+		OrphanNamespace + "//planned":                             OrphanActionRepair,
+		OrphanVolume + "/" + cnpgtest.InstanceID + "/" + pvc.Name: OrphanActionDelete,
+		OrphanVolume + "/planned/" + plannedPVC.Name:              OrphanActionReport,
+	} {
+		if actions[id] != action {
+			t.Errorf("expected action %s for %s, got %s", action, id, actions[id])
+		}
+	}
+
+	ids := []string{categories[OrphanLoadBalancer], "unknown"}
+	results, err := client.CleanupOrphans(ctx, ids, true)
+	if err != nil {
+		t.Fatalf("failed to clean up orphans: %v", err)
+	}
+	if len(results) != 2 || results[0].Error != "" || results[1].Error == "" {
+		t.Errorf("expected the unknown orphan to fail, got %v", results)
+	}
+	if _, err := clientset.CoreV1().Services(cnpgtest.InstanceID).Get(ctx, svc.Name, metav1.GetOptions{}); err != nil {
+		t.Errorf("expected a dry run to keep the service: %v", err)
+	}
+
+	if _, err := client.CleanupOrphans(ctx, ids[:1], false); err != nil {
+		t.Fatalf("failed to clean up orphans: %v", err)
+	}
+	if _, err := clientset.CoreV1().Services(cnpgtest.InstanceID).Get(ctx, svc.Name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the service to be deleted, got %v", err)
+	}
+
+	results, err = client.CleanupOrphans(ctx, []string{OrphanNamespace + "//annotated"}, false)
+	if err != nil {
+		t.Fatalf("failed to clean up orphans: %v", err)
+	}
+	if len(results) != 1 || results[0].Error == "" {
+		t.Errorf("expected a reported orphan not to be cleaned up, got %v", results)
+	}
+	if _, err := clientset.CoreV1().Namespaces().Get(ctx, "annotated", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the annotated namespace to be kept: %v", err)
+	}
+
+	results, err = client.CleanupOrphans(ctx, []string{OrphanVolume + "/planned/" + plannedPVC.Name}, false)
+	if err != nil {
+		t.Fatalf("failed to clean up orphans: %v", err)
+	}
+	if len(results) != 1 || results[0].Error == "" {
+		t.Errorf("expected a volume of a repaired namespace not to be cleaned up, got %v", results)
+	}
+	if _, err := clientset.CoreV1().PersistentVolumeClaims("planned").Get(ctx, plannedPVC.Name, metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the volume of the repaired namespace to be kept: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package cnpg
+
+import (
+	"encoding/json"
+	"fmt"
+
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+)
+
+// planOverlay returns a copy of a spec overlay from the catalog, with numbers converted to the
+// int64 and float64 values unstructured objects expect
+func planOverlay(overlay map[string]any) (map[string]any, error) {
+	if len(overlay) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(overlay)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spec overlay: %w", err)
+	}
+	var copied map[string]any
+	if err := utiljson.Unmarshal(data, &copied); err != nil {
+		return nil, fmt.Errorf("invalid spec overlay: %w", err)
+	}
+	return copied, nil
+}
+
+// mergeOverlay merges overlay onto spec. Objects are merged recursively, any other value, lists
+// included, replaces the value in spec.
+func mergeOverlay(spec, overlay map[string]any) {
+	for key, value := range overlay {
+		if nested, ok := value.(map[string]any); ok {
+			if existing, ok := spec[key].(map[string]any); ok {
+				mergeOverlay(existing, nested)
+				continue
+			}
+			copied := make(map[string]any, len(nested))
+			mergeOverlay(copied, nested)
+			spec[key] = copied
+			continue
+		}
+		spec[key] = value
+	}
+}
@@ -0,0 +1,159 @@
+package cnpg
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/cnpg-broker/pkg/catalog"
+	"github.com/cnpg-broker/pkg/logger"
+)
+
+// postgresImageRepository provides the images of PostgreSQL versions if the catalog declares none
+const postgresImageRepository = "ghcr.io/cloudnative-pg/postgresql"
+
+var extensionNameRegex = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// applyParameters renders the instance parameters onto the spec of a new Cluster
+func applyParameters(spec map[string]any, params InstanceParameters) error {
+	if len(params.PostgresVersion) > 0 {
+		if err := setPostgresVersion(spec, params.PostgresVersion); err != nil {
+			return err
+		}
+	}
+
+	// merged, so parameters set by the plan are kept
+	if pgParams := postgresqlParameters(params); len(pgParams) > 0 {
+		mergeOverlay(spec, map[string]any{
+			"postgresql": map[string]any{
+				"parameters": pgParams,
+			},
+		})
+	}
+
+	if len(params.Extensions) > 0 {
+		statements := make([]any, 0, len(params.Extensions))
+		for _, extension := range params.Extensions {
+			if !extensionNameRegex.MatchString(extension) {
+				return fmt.Errorf("invalid extension name: %s", extension)
+			}
+			statements = append(statements, fmt.Sprintf(`CREATE EXTENSION IF NOT EXISTS "%s"`, extension))
+		}
+		spec["bootstrap"] = map[string]any{
+			"initdb": map[string]any{
+				"database":               "app",
+				"owner":                  "app",
+				"postInitApplicationSQL": statements,
+			},
+		}
+	}
+	return nil
+}
+
+// setPostgresVersion sets the image of a PostgreSQL major version in a Cluster spec, from the
+// versions of the catalog if it declares any. Changing it on an existing Cluster makes the operator
+// upgrade the data directory to the new major version.
+func setPostgresVersion(spec map[string]any, version string) error {
+	// the overlay of the plan may have set either
+	delete(spec, "imageName")
+	delete(spec, "imageCatalogRef")
+	if len(catalog.PostgresVersions()) == 0 {
+		spec["imageName"] = fmt.Sprintf("%s:%s", postgresImageRepository, version)
+		return nil
+	}
+	v, found := catalog.FindPostgresVersion(version)
+	if !found {
+		return fmt.Errorf("unsupported PostgreSQL version %s", version)
+	}
+	if v.ImageCatalog == nil {
+		spec["imageName"] = v.ImageName
+		return nil
+	}
+	major, _ := strconv.Atoi(v.Version)
+	spec["imageCatalogRef"] = map[string]any{
+		"apiGroup": clusterResource.Group,
+		"kind":     v.ImageCatalog.Kind,
+		"name":     v.ImageCatalog.Name,
+		"major":    int64(major),
+	}
+	return nil
+}
+
+// postgresqlParameters returns the postgresql.parameters section for a Cluster
+func postgresqlParameters(params InstanceParameters) map[string]any {
+	pgParams := make(map[string]any)
+	for key, value := range params.PostgresqlParameters {
+		pgParams[key] = value
+	}
+	if len(params.Timezone) > 0 {
+		pgParams["timezone"] = params.Timezone
+	}
+	return pgParams
+}
+
+// mergeParameters applies the parameters of an update onto the existing parameters of an instance
+func mergeParameters(existing, update InstanceParameters) InstanceParameters {
+	merged := existing
+	if len(update.PostgresVersion) > 0 {
+		merged.PostgresVersion = update.PostgresVersion
+	}
+	if len(update.PostgresqlParameters) > 0 {
+		merged.PostgresqlParameters = make(map[string]string)
+		for key, value := range existing.PostgresqlParameters {
+			merged.PostgresqlParameters[key] = value
+		}
+		for key, value := range update.PostgresqlParameters {
+			merged.PostgresqlParameters[key] = value
+		}
+	}
+	if len(update.Extensions) > 0 {
+		merged.Extensions = update.Extensions
+	}
+	if len(update.Timezone) > 0 {
+		merged.Timezone = update.Timezone
+	}
+	if update.Pooler != nil {
+		pooler := PoolerParameters{}
+		if existing.Pooler != nil {
+			pooler = *existing.Pooler
+		}
+		if update.Pooler.Enabled != nil {
+			pooler.Enabled = update.Pooler.Enabled
+		}
+		if len(update.Pooler.PoolMode) > 0 {
+			pooler.PoolMode = update.Pooler.PoolMode
+		}
+		if update.Pooler.DefaultPoolSize > 0 {
+			pooler.DefaultPoolSize = update.Pooler.DefaultPoolSize
+		}
+		if update.Pooler.MaxClientConn > 0 {
+			pooler.MaxClientConn = update.Pooler.MaxClientConn
+		}
+		if update.Pooler.Instances > 0 {
+			pooler.Instances = update.Pooler.Instances
+		}
+		merged.Pooler = &pooler
+	}
+	return merged
+}
+
+func encodeParameters(params InstanceParameters) string {
+	data, err := json.Marshal(params)
+	if err != nil {
+		// can't happen with the plain types of InstanceParameters
+		logger.Error("failed to encode instance parameters: %v", err)
+		return "{}"
+	}
+	return string(data)
+}
+
+func decodeParameters(annotations map[string]string) InstanceParameters {
+	var params InstanceParameters
+	if data, ok := annotations["cnpg-broker.io/parameters"]; ok {
+		if err := json.Unmarshal([]byte(data), &params); err != nil {
+			logger.Warn("failed to decode instance parameters annotation: %v", err)
+		}
+	}
+	return params
+}
@@ -0,0 +1,200 @@
+package cnpg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/cnpg-broker/pkg/catalog"
+	"github.com/cnpg-broker/pkg/config"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Permission is an RBAC permission the broker needs for a feature. Instance namespaces do not exist
+// up front, so permissions without a namespace are needed cluster-wide.
+type Permission struct {
+	Feature   string
+	Group     string
+	Resource  string
+	Verb      string
+	Namespace string
+	Name      string
+}
+
+// PermissionResult is the outcome of a SelfSubjectAccessReview of a Permission
+type PermissionResult struct {
+	Permission
+	Allowed bool
+	Reason  string
+}
+
+func (p Permission) String() string {
+	resource := p.Resource
+	if len(p.Group) > 0 {
+		resource = p.Resource + "." + p.Group
+	}
+	if len(p.Name) > 0 {
+		resource = resource + "/" + p.Name
+	}
+	if len(p.Namespace) > 0 {
+		return fmt.Sprintf("%s %s in %s", p.Verb, resource, p.Namespace)
+	}
+	return fmt.Sprintf("%s %s", p.Verb, resource)
+}
+
+// RequiredPermissions returns the permissions needed by the features enabled in the config and catalog
+func RequiredPermissions() []Permission {
+	cfg := config.Get()
+	var perms []Permission
+	add := func(feature, group, resource string, verbs ...string) {
+		for _, verb := range verbs {
+			perms = append(perms, Permission{Feature: feature, Group: group, Resource: resource, Verb: verb})
+		}
+	}
+
+	add("instances", "", "namespaces", "get", "list", "create", "patch", "delete")
+	add("instances", "", "services", "get", "list", "create", "patch", "delete")
+	add("instances", "", "configmaps", "get", "create", "update")
+	add("instances", "", "persistentvolumeclaims", "list", "patch", "delete")
+	add("instances", clusterResource.Group, clusterResource.Resource, "get", "list", "create", "patch")
+	add("instances", poolerResource.Group, poolerResource.Resource, "get", "list", "create", "patch", "delete")
+	add("bindings", "", "secrets", "get", "list", "create", "patch", "delete")
+
+	if cfg.Cache.Enabled {
+		add("cache", "", "namespaces", "list", "watch")
+		add("cache", "", "services", "list", "watch")
+		add("cache", "", "secrets", "list", "watch")
+		add("cache", clusterResource.Group, clusterResource.Resource, "list", "watch")
+		add("cache", poolerResource.Group, poolerResource.Resource, "list", "watch")
+	}
+	if backupsEnabled() {
+		add("backups", backupResource.Group, backupResource.Resource, "list", "create")
+		add("backups", scheduledBackupResource.Group, scheduledBackupResource.Resource, "create", "patch", "delete")
+		add("backups", objectStoreResource.Group, objectStoreResource.Resource, "get", "create", "patch", "delete")
+		perms = append(perms, Permission{Feature: "backups", Resource: "secrets", Verb: "get", Namespace: cfg.Backup.CredentialsNamespace})
+	}
+	if tlsRoutesEnabled() {
+		add("exposure", tlsRouteResource.Group, tlsRouteResource.Resource, "get", "create", "patch", "delete")
+	}
+	if namespace, name, found := strings.Cut(cfg.Catalog.ConfigMap, "/"); found {
+		// the catalog is watched with a field selector, so get is the only verb that can be restricted to its name
+		perms = append(perms,
+			Permission{Feature: "catalog", Resource: "configmaps", Verb: "get", Namespace: namespace, Name: name},
+			Permission{Feature: "catalog", Resource: "configmaps", Verb: "list", Namespace: namespace},
+			Permission{Feature: "catalog", Resource: "configmaps", Verb: "watch", Namespace: namespace})
+	}
+	if slices.Contains(cfg.Audit.Sinks, "event") {
+		add("audit", "", "events", "create")
+	}
+	if cfg.Reconciler.Enabled {
+		for _, verb := range []string{"get", "create", "update"} {
+			perms = append(perms, Permission{Feature: "reconciler", Group: "coordination.k8s.io", Resource: "leases", Verb: verb, Namespace: cfg.Reconciler.LeaseNamespace})
+		}
+		add("reconciler", "", "events", "create")
+	}
+	perms = append(perms, Permission{
+		Feature:   "readiness",
+		Group:     "apps",
+		Resource:  "deployments",
+		Verb:      "get",
+		Namespace: cfg.Operator.Namespace,
+		Name:      cfg.Operator.Deployment,
+	})
+	return perms
+}
+
+// backupsEnabled returns true if any plan in the catalog has backups and an object store to write them to
+func backupsEnabled() bool {
+	for _, plan := range catalog.Plans() {
+		if plan.Metadata.Backup != nil && backupConfiguration(plan.ID) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPermissions reviews the permissions of the broker's service account with SelfSubjectAccessReviews
+func (c *Client) CheckPermissions(ctx context.Context, perms []Permission) ([]PermissionResult, error) {
+	results := make([]PermissionResult, len(perms))
+	errs := make([]error, len(perms))
+	var wg sync.WaitGroup
+	for i, perm := range perms {
+		wg.Go(func() {
+			review := &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Namespace: perm.Namespace,
+						Verb:      perm.Verb,
+						Group:     perm.Group,
+						Resource:  perm.Resource,
+						Name:      perm.Name,
+					},
+				},
+			}
+			review, err := c.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to review permission to %s: %w", perm, err)
+				return
+			}
+			results[i] = PermissionResult{Permission: perm, Allowed: review.Status.Allowed, Reason: review.Status.Reason}
+		})
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// CheckRBAC reviews the permissions needed by the enabled features and returns an error listing the missing ones
+func (c *Client) CheckRBAC(ctx context.Context) error {
+	results, err := c.CheckPermissions(ctx, RequiredPermissions())
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, result := range MissingPermissions(results) {
+		missing = append(missing, result.String())
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %d permission(s): %s", len(missing), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// MissingPermissions returns the results of permissions that are not allowed
+func MissingPermissions(results []PermissionResult) []PermissionResult {
+	var missing []PermissionResult
+	for _, result := range results {
+		if !result.Allowed {
+			missing = append(missing, result)
+		}
+	}
+	return missing
+}
+
+// WritePermissions writes results as a table
+func WritePermissions(w io.Writer, results []PermissionResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FEATURE\tVERB\tRESOURCE\tGROUP\tNAMESPACE\tNAME\tALLOWED")
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%t\n",
+			result.Feature, result.Verb, result.Resource, dash(result.Group),
+			dash(result.Namespace), dash(result.Name), result.Allowed)
+	}
+	return tw.Flush()
+}
+
+func dash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,143 @@
+package cnpg
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/cnpg-broker/pkg/audit"
+	"github.com/cnpg-broker/pkg/catalog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// poolerSettings are the PgBouncer settings of an instance, from its plan and parameters
+type poolerSettings struct {
+	enabled         bool
+	poolMode        string
+	defaultPoolSize int
+	maxClientConn   int
+	instances       int64
+}
+
+// poolerConfig returns the pooler settings of an instance. HA plans have a pooler unless it is
+// disabled, single instance plans only if it is enabled by the plan or the instance.
+func poolerConfig(plan catalog.Plan, params InstanceParameters) poolerSettings {
+	settings := poolerSettings{
+		enabled:   plan.Metadata.Instances > 1,
+		instances: plan.Metadata.Instances,
+	}
+	if config := plan.Metadata.Pooler; config != nil {
+		settings.apply(config.Enabled, config.PoolMode, config.DefaultPoolSize, config.MaxClientConn, config.Instances)
+	}
+	if params := params.Pooler; params != nil {
+		settings.apply(params.Enabled, params.PoolMode, params.DefaultPoolSize, params.MaxClientConn, params.Instances)
+	}
+	return settings
+}
+
+func (s *poolerSettings) apply(enabled *bool, poolMode string, defaultPoolSize, maxClientConn int, instances int64) {
+	if enabled != nil {
+		s.enabled = *enabled
+	}
+	if len(poolMode) > 0 {
+		s.poolMode = poolMode
+	}
+	if defaultPoolSize > 0 {
+		s.defaultPoolSize = defaultPoolSize
+	}
+	if maxClientConn > 0 {
+		s.maxClientConn = maxClientConn
+	}
+	if instances > 0 {
+		s.instances = instances
+	}
+}
+
+// pgbouncer returns the pgbouncer section of the Pooler spec with the settings that are set
+func (s poolerSettings) pgbouncer() map[string]any {
+	pgbouncer := make(map[string]any)
+	if len(s.poolMode) > 0 {
+		pgbouncer["poolMode"] = s.poolMode
+	}
+	parameters := make(map[string]any)
+	if s.defaultPoolSize > 0 {
+		parameters["default_pool_size"] = strconv.Itoa(s.defaultPoolSize)
+	}
+	if s.maxClientConn > 0 {
+		parameters["max_client_conn"] = strconv.Itoa(s.maxClientConn)
+	}
+	if len(parameters) > 0 {
+		pgbouncer["parameters"] = parameters
+	}
+	return pgbouncer
+}
+
+// applyPoolers applies the Poolers of an instance and deletes those it no longer has, e.g. after
+// the pooler was disabled
+func (c *Client) applyPoolers(ctx context.Context, instanceId string, plan catalog.Plan, params InstanceParameters) error {
+	poolers, err := renderPoolers(instanceId, plan, params)
+	if err != nil {
+		return err
+	}
+	rendered := make(map[string]bool)
+	for _, pooler := range poolers {
+		if err := c.applyObject(ctx, poolerResource, pooler); err != nil {
+			return err
+		}
+		rendered[pooler.GetName()] = true
+	}
+	for _, name := range []string{poolerName(instanceId), roPoolerName(instanceId)} {
+		if rendered[name] {
+			continue
+		}
+		if err := c.dynamic.Resource(poolerResource).Namespace(instanceId).Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return fmt.Errorf("failed to delete pooler %s: %w", name, err)
+			}
+			continue
+		}
+		audit.Touched(ctx, "Pooler", instanceId, name)
+	}
+	return nil
+}
+
+// GetPoolers returns the state of the Poolers of an instance
+func (c *Client) GetPoolers(ctx context.Context, instanceId string) ([]PoolerStatus, error) {
+	var poolers []*unstructured.Unstructured
+	if c.cacheReady() {
+		objs, err := c.cache.poolers.ByNamespace(instanceId).List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			if pooler, ok := obj.(*unstructured.Unstructured); ok {
+				poolers = append(poolers, pooler)
+			}
+		}
+	} else {
+		list, err := c.dynamic.Resource(poolerResource).Namespace(instanceId).List(ctx, metav1.ListOptions{LabelSelector: instanceSelector})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			poolers = append(poolers, &list.Items[i])
+		}
+	}
+
+	statuses := make([]PoolerStatus, 0, len(poolers))
+	for _, pooler := range poolers {
+		status := PoolerStatus{Name: pooler.GetName()}
+		status.Type, _, _ = unstructured.NestedString(pooler.Object, "spec", "type")
+		status.PoolMode, _, _ = unstructured.NestedString(pooler.Object, "spec", "pgbouncer", "poolMode")
+		status.DefaultPoolSize, _, _ = unstructured.NestedString(pooler.Object, "spec", "pgbouncer", "parameters", "default_pool_size")
+		status.MaxClientConn, _, _ = unstructured.NestedString(pooler.Object, "spec", "pgbouncer", "parameters", "max_client_conn")
+		status.Instances, _, _ = unstructured.NestedInt64(pooler.Object, "spec", "instances")
+		status.CurrentInstances, _, _ = unstructured.NestedInt64(pooler.Object, "status", "instances")
+		status.IsReady = status.Instances > 0 && status.CurrentInstances >= status.Instances
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,54 @@
+package cnpg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// cnpgResources are the CNPG resources the broker manages, they must be served at the version of clusterResource
+var cnpgResources = []string{"clusters", "poolers", "backups", "scheduledbackups"}
+
+// CheckCRDs checks that the API server serves all CNPG resources the broker uses at the expected version
+func (c *Client) CheckCRDs(ctx context.Context) error {
+	groupVersion := clusterResource.GroupVersion().String()
+	resources, err := c.clientset.Discovery().ServerResourcesForGroupVersion(groupVersion)
+	if err != nil {
+		return fmt.Errorf("failed to discover %s: %w", groupVersion, err)
+	}
+	served := make(map[string]bool, len(resources.APIResources))
+	for _, resource := range resources.APIResources {
+		served[resource.Name] = true
+	}
+	var missing []string
+	for _, name := range cnpgResources {
+		if !served[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s not served at %s", strings.Join(missing, ", "), groupVersion)
+	}
+	return nil
+}
+
+// CheckOperator checks that the deployment of the CNPG operator is available
+func (c *Client) CheckOperator(ctx context.Context, namespace, name string) error {
+	deployment, err := c.clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get operator deployment %s/%s: %w", namespace, name, err)
+	}
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentAvailable {
+			if condition.Status == corev1.ConditionTrue {
+				return nil
+			}
+			return fmt.Errorf("operator deployment %s/%s is not available: %s", namespace, name, condition.Message)
+		}
+	}
+	return fmt.Errorf("operator deployment %s/%s is not available", namespace, name)
+}
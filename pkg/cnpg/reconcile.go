@@ -0,0 +1,108 @@
+package cnpg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cnpg-broker/pkg/catalog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// reconcileGrace is how long an operation in progress keeps the reconciler away from an instance,
+// older ones were interrupted, e.g. by a restart of the broker during a provision
+const reconcileGrace = 10 * time.Minute
+
+// ErrNoDesiredState is returned for instances whose Cluster and namespace carry no plan annotation
+var ErrNoDesiredState = errors.New("no plan annotation to reconcile from")
+
+// Reconciliation is the result of reconciling an instance
+type Reconciliation struct {
+	InstanceID string
+	// Skipped is set if the instance was not reconciled, e.g. because it is being deprovisioned
+	Skipped string
+	Changes []Change
+}
+
+// ListInstances returns the IDs of all instance namespaces
+func (c *Client) ListInstances(ctx context.Context) ([]string, error) {
+	namespaces, err := c.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{
+		LabelSelector: "cnpg-broker.io/instance-id",
+	})
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]string, 0, len(namespaces.Items))
+	for _, ns := range namespaces.Items {
+		instances = append(instances, ns.Labels["cnpg-broker.io/instance-id"])
+	}
+	return instances, nil
+}
+
+// ReconcileInstance renders the objects of an instance from the plan and parameters annotated on its
+// Cluster, or on its namespace if the Cluster is missing, and applies them. Missing objects are
+// created and drifted ones updated, the changes are returned.
+func (c *Client) ReconcileInstance(ctx context.Context, instanceId string) (*Reconciliation, error) {
+	result := &Reconciliation{InstanceID: instanceId}
+	ns, err := c.clientset.CoreV1().Namespaces().Get(ctx, instanceId, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if ns.DeletionTimestamp != nil {
+		result.Skipped = "namespace is terminating"
+		return result, nil
+	}
+	if op, err := c.LatestOperation(ctx, instanceId, ""); err == nil && op.State == OperationInProgress && time.Since(op.StartedAt) < reconcileGrace {
+		result.Skipped = fmt.Sprintf("%s operation %s is in progress", op.Type, op.ID)
+		return result, nil
+	} else if err != nil && !errors.Is(err, ErrOperationNotFound) {
+		return nil, err
+	}
+
+	existing, err := c.clusterObject(ctx, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	source := ns.Annotations
+	if existing != nil {
+		source = existing.GetAnnotations()
+	}
+	serviceId, planId := source["cnpg-broker.io/service-id"], source["cnpg-broker.io/plan-id"]
+	if len(planId) == 0 {
+		return nil, ErrNoDesiredState
+	}
+	plan, err := catalog.GetPlan(serviceId, planId)
+	if err != nil {
+		return nil, err
+	}
+
+	// the originating identities are kept, there is none when reconciling
+	annotations := make(map[string]string)
+	for _, key := range keptAnnotations {
+		if value, found := source[key]; found {
+			annotations[key] = value
+		}
+	}
+	ctx, changes := recordChanges(ctx)
+	if err := c.converge(ctx, instanceId, serviceId, plan, decodeParameters(source), annotations, existing, false); err != nil {
+		result.Changes = changes.list()
+		return result, err
+	}
+	result.Changes = changes.list()
+
+	// roles of unbound bindings are pruned here as well, unbinds without polling never prune them
+	if existing != nil {
+		if _, err := c.PruneBindingRoles(ctx, instanceId); err != nil {
+			return result, err
+		}
+	}
+
+	// the bootstrap of a restored instance is over once its Cluster is ready
+	if existing != nil && clusterInfo(instanceId, existing).IsReady {
+		if err := c.RemoveRestoreCopies(ctx, instanceId); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package cnpg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cnpg-broker/pkg/cnpg/cnpgtest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestReconcileInstance(t *testing.T) {
+	client, dynClient, clientset := newTestClient(nil, nil)
+	ctx := context.Background()
+	op := provision(t, client, cnpgtest.HAService, cnpgtest.HASmall)
+
+	// the provision is still in progress
+	result, err := client.ReconcileInstance(ctx, cnpgtest.InstanceID)
+	if err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	if len(result.Skipped) == 0 {
+		t.Fatal("expected an instance with an operation in progress to be skipped")
+	}
+	if err := client.FinishOperation(ctx, cnpgtest.InstanceID, op.ID, OperationSucceeded, ""); err != nil {
+		t.Fatalf("failed to finish operation: %v", err)
+	}
+
+	if err := dynClient.Resource(cnpgtest.PoolerResource).Namespace(cnpgtest.InstanceID).Delete(ctx, "db-"+cnpgtest.InstanceID+"-pooler", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete pooler: %v", err)
+	}
+	if err := clientset.CoreV1().Services(cnpgtest.InstanceID).Delete(ctx, "db-"+cnpgtest.InstanceID+"-lb-rw", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete service: %v", err)
+	}
+	cluster, err := dynClient.Resource(cnpgtest.ClusterResource).Namespace(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get cluster: %v", err)
+	}
+	_ = unstructured.SetNestedField(cluster.Object, int64(5), "spec", "instances")
+	if _, err := dynClient.Resource(cnpgtest.ClusterResource).Namespace(cnpgtest.InstanceID).Update(ctx, cluster, metav1.UpdateOptions{FieldManager: "kubectl-edit"}); err != nil {
+		t.Fatalf("failed to update cluster: %v", err)
+	}
+
+	result, err = client.ReconcileInstance(ctx, cnpgtest.InstanceID)
+	if err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	changes := make(map[string]string)
+	for _, change := range result.Changes {
+		changes[change.Kind+" "+change.Name] = change.Action
+	}
+	want := map[string]string{
+		"Pooler db-" + cnpgtest.InstanceID + "-pooler": ChangeCreated,
+		"Service db-" + cnpgtest.InstanceID + "-lb-rw": ChangeCreated,
+		"Cluster db-" + cnpgtest.InstanceID:            ChangeUpdated,
+	}
+	for object, action := range want {
+		if changes[object] != action {
+			t.Errorf("expected %s to be %s, got changes %v", object, action, changes)
+		}
+	}
+	cluster, err = dynClient.Resource(cnpgtest.ClusterResource).Namespace(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get cluster: %v", err)
+	}
+	if instances, _, _ := unstructured.NestedInt64(cluster.Object, "spec", "instances"); instances != 2 {
+		t.Errorf("expected the drifted instances to be reset to 2, got %d", instances)
+	}
+
+	result, err = client.ReconcileInstance(ctx, cnpgtest.InstanceID)
+	if err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	if len(result.Changes) > 0 {
+		t.Errorf("expected no changes for a reconciled instance, got %v", result.Changes)
+	}
+}
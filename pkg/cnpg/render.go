@@ -0,0 +1,341 @@
+package cnpg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cnpg-broker/pkg/catalog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+// The render functions return the desired state of the objects of an instance, which is applied
+// with server-side apply on provision, on retried provision and on update alike.
+
+// ownerAnnotation records the platform context an instance was provisioned in, see Owner
+const ownerAnnotation = "cnpg-broker.io/owner"
+
+// keptAnnotations are only set by some operations, e.g. on creation, and kept by all later ones
+var keptAnnotations = []string{"cnpg-broker.io/created-by", "cnpg-broker.io/updated-by", ownerAnnotation}
+
+func poolerName(instanceId string) string {
+	return fmt.Sprintf("%s-pooler", clusterName(instanceId))
+}
+
+// roPoolerName is the Pooler of HA instances balancing connections over the replicas
+func roPoolerName(instanceId string) string {
+	return fmt.Sprintf("%s-pooler-ro", clusterName(instanceId))
+}
+
+// renderNamespace renders the namespace of an instance. It carries the annotations of the Cluster,
+// so an instance can be reconciled from its plan and parameters if the Cluster is missing.
+func renderNamespace(instanceId string, annotations map[string]string) *corev1ac.NamespaceApplyConfiguration {
+	return corev1ac.Namespace(instanceId).
+		WithLabels(map[string]string{
+			"cnpg-broker.io/instance-id": instanceId,
+		}).
+		WithAnnotations(annotations)
+}
+
+// renderCluster renders the Cluster of an instance from its plan and parameters. Restores are not
+// rendered, as they need the source instance, see prepareRestore.
+func renderCluster(instanceId, serviceId string, plan catalog.Plan, params InstanceParameters, annotations map[string]string) (*unstructured.Unstructured, error) {
+	spec := map[string]any{
+		"instances": plan.Metadata.Instances,
+		"storage": map[string]any{
+			"size": plan.Metadata.Storage,
+		},
+		"resources": map[string]any{
+			"requests": map[string]any{
+				"cpu":    plan.Metadata.CPU,
+				"memory": plan.Metadata.Memory,
+			},
+			"limits": map[string]any{
+				"cpu":    plan.Metadata.CPU,
+				"memory": plan.Metadata.Memory,
+			},
+		},
+	}
+	// the plan's spec overlay, parameters of the instance take precedence
+	overlay, err := planOverlay(plan.Metadata.ClusterSpec)
+	if err != nil {
+		return nil, err
+	}
+	mergeOverlay(spec, overlay)
+	if err := applyParameters(spec, params); err != nil {
+		return nil, err
+	}
+	if backupConfiguration(plan.ID) != nil {
+		setBarmanPlugin(spec, instanceId)
+	}
+	// propagate the instance label to all objects created by CNPG, so they are picked up by the cache
+	spec["inheritedMetadata"] = map[string]any{
+		"labels": map[string]any{
+			"cnpg-broker.io/instance-id": instanceId,
+		},
+	}
+
+	annotations["cnpg-broker.io/instance-id"] = instanceId
+	annotations["cnpg-broker.io/service-id"] = serviceId
+	annotations["cnpg-broker.io/plan-id"] = plan.ID
+	annotations["cnpg-broker.io/parameters"] = encodeParameters(params)
+	cluster := &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "Cluster",
+			"metadata": map[string]any{
+				"name":      clusterName(instanceId),
+				"namespace": instanceId,
+				"labels": map[string]any{
+					"cnpg-broker.io/instance-id": instanceId,
+					"cnpg-broker.io/service-id":  serviceId,
+					"cnpg-broker.io/plan-id":     plan.ID,
+				},
+			},
+			"spec": spec,
+		},
+	}
+	cluster.SetAnnotations(annotations)
+	return cluster, nil
+}
+
+// keepClusterFields copies the fields of an existing Cluster into a rendered one that are only
+// rendered on creation or must not be dropped afterwards:
+//   - bootstrap and externalClusters, which only take effect on creation and may refer to a source instance that is gone
+//   - imageName or imageCatalogRef, which may have been taken from a restore source, dropping it would change the PostgreSQL version.
+//     With keepImage the existing one replaces the rendered one.
+//   - plugins if backups were turned off, WAL archiving continues so the archive stays usable
+//   - the originating identity and owner annotations
+func keepClusterFields(rendered, existing *unstructured.Unstructured, backups, keepImage bool) {
+	keep := []string{"bootstrap", "externalClusters"}
+	spec := rendered.Object["spec"].(map[string]any)
+	_, image := spec["imageName"]
+	_, imageCatalog := spec["imageCatalogRef"]
+	_, existingImage, _ := unstructured.NestedFieldNoCopy(existing.Object, "spec", "imageName")
+	_, existingImageCatalog, _ := unstructured.NestedFieldNoCopy(existing.Object, "spec", "imageCatalogRef")
+	if keepImage && (existingImage || existingImageCatalog) {
+		delete(spec, "imageName")
+		delete(spec, "imageCatalogRef")
+		image, imageCatalog = false, false
+	}
+	if !image && !imageCatalog {
+		keep = append(keep, "imageName", "imageCatalogRef")
+	}
+	if !backups {
+		keep = append(keep, "plugins")
+	}
+	for _, field := range keep {
+		if value, found, _ := unstructured.NestedFieldCopy(existing.Object, "spec", field); found {
+			_ = unstructured.SetNestedField(rendered.Object, value, "spec", field)
+		}
+	}
+
+	annotations := rendered.GetAnnotations()
+	for _, key := range keptAnnotations {
+		if _, found := annotations[key]; !found {
+			if value, found := existing.GetAnnotations()[key]; found {
+				annotations[key] = value
+			}
+		}
+	}
+	rendered.SetAnnotations(annotations)
+}
+
+// renderPoolers renders the PgBouncer Poolers of an instance, rw for the primary and, for HA instances,
+// ro for the replicas. Instances without pooler have none.
+func renderPoolers(instanceId string, plan catalog.Plan, params InstanceParameters) ([]*unstructured.Unstructured, error) {
+	settings := poolerConfig(plan, params)
+	if !settings.enabled {
+		return nil, nil
+	}
+	rw, err := renderPooler(instanceId, plan, settings, poolerName(instanceId), "rw")
+	if err != nil {
+		return nil, err
+	}
+	poolers := []*unstructured.Unstructured{rw}
+	if plan.Metadata.Instances > 1 {
+		ro, err := renderPooler(instanceId, plan, settings, roPoolerName(instanceId), "ro")
+		if err != nil {
+			return nil, err
+		}
+		poolers = append(poolers, ro)
+	}
+	return poolers, nil
+}
+
+func renderPooler(instanceId string, plan catalog.Plan, settings poolerSettings, name, poolerType string) (*unstructured.Unstructured, error) {
+	spec := map[string]any{
+		"cluster": map[string]any{
+			"name": clusterName(instanceId),
+		},
+		"instances": settings.instances,
+		"type":      poolerType,
+		"pgbouncer": map[string]any{
+			"poolMode": "session",
+		},
+	}
+	overlay, err := planOverlay(plan.Metadata.PoolerSpec)
+	if err != nil {
+		return nil, err
+	}
+	mergeOverlay(spec, overlay)
+	// the pooler settings of plan and instance take precedence over the overlay
+	mergeOverlay(spec, map[string]any{"pgbouncer": settings.pgbouncer()})
+
+	return &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "postgresql.cnpg.io/v1",
+			"kind":       "Pooler",
+			"metadata": map[string]any{
+				"name":      name,
+				"namespace": instanceId,
+				"labels": map[string]any{
+					"cnpg-broker.io/instance-id": instanceId,
+				},
+			},
+			"spec": spec,
+		},
+	}, nil
+}
+
+// renderServices renders the Services exposing an instance, we create our own because we expose the
+// primary and the poolers with different ports. HA instances get Services for the replicas, and the
+// ro pooler if pooled, as well. Plans exposing with none or a TLSRoute have none.
+func renderServices(instanceId string, plan catalog.Plan, params InstanceParameters) []*corev1ac.ServiceApplyConfiguration {
+	exposure := plan.ExposureConfig()
+	var serviceType corev1.ServiceType
+	switch exposure.Mode {
+	case catalog.ExposureClusterIP:
+		serviceType = corev1.ServiceTypeClusterIP
+	case catalog.ExposureNodePort:
+		serviceType = corev1.ServiceTypeNodePort
+	case catalog.ExposureLoadBalancer:
+		serviceType = corev1.ServiceTypeLoadBalancer
+	default:
+		return nil
+	}
+	services := []*corev1ac.ServiceApplyConfiguration{
+		exposedService(instanceId, primaryServiceName(instanceId), 5432, serviceType, exposure, map[string]string{
+			"cnpg.io/cluster":      clusterName(instanceId),
+			"cnpg.io/instanceRole": "primary",
+		}),
+	}
+	ha := plan.Metadata.Instances > 1
+	pooled := poolerConfig(plan, params).enabled
+	if ha {
+		services = append(services, exposedService(instanceId, replicaServiceName(instanceId), 5432, serviceType, exposure, map[string]string{
+			"cnpg.io/cluster":      clusterName(instanceId),
+			"cnpg.io/instanceRole": "replica",
+		}))
+	}
+	if pooled {
+		services = append(services, exposedService(instanceId, poolerServiceName(instanceId), 6432, serviceType, exposure, map[string]string{
+			"cnpg.io/poolerName": poolerName(instanceId),
+		}))
+	}
+	if pooled && ha {
+		services = append(services, exposedService(instanceId, roPoolerServiceName(instanceId), 6432, serviceType, exposure, map[string]string{
+			"cnpg.io/poolerName": roPoolerName(instanceId),
+		}))
+	}
+	return services
+}
+
+// The names of the exposed Services are kept for all Service types, so instances keep their
+// Services when the exposure of their plan changes
+func primaryServiceName(instanceId string) string {
+	return fmt.Sprintf("%s-lb-rw", clusterName(instanceId))
+}
+
+func replicaServiceName(instanceId string) string {
+	return fmt.Sprintf("%s-lb-ro", clusterName(instanceId))
+}
+
+func poolerServiceName(instanceId string) string {
+	return fmt.Sprintf("%s-lb-pooler", clusterName(instanceId))
+}
+
+func roPoolerServiceName(instanceId string) string {
+	return fmt.Sprintf("%s-lb-pooler-ro", clusterName(instanceId))
+}
+
+// exposedServiceNames returns the names of all Services renderServices may render for an instance
+func exposedServiceNames(instanceId string) []string {
+	return []string{primaryServiceName(instanceId), replicaServiceName(instanceId), poolerServiceName(instanceId), roPoolerServiceName(instanceId)}
+}
+
+func exposedService(instanceId, name string, port int32, serviceType corev1.ServiceType, exposure catalog.Exposure, selector map[string]string) *corev1ac.ServiceApplyConfiguration {
+	spec := corev1ac.ServiceSpec().
+		WithType(serviceType).
+		WithPorts(corev1ac.ServicePort().
+			WithName("postgres").
+			WithPort(port).
+			WithTargetPort(intstr.FromInt(5432))).
+		WithSelector(selector)
+	if len(exposure.LoadBalancerClass) > 0 {
+		spec.WithLoadBalancerClass(exposure.LoadBalancerClass)
+	}
+	if len(exposure.LoadBalancerSourceRanges) > 0 {
+		spec.WithLoadBalancerSourceRanges(exposure.LoadBalancerSourceRanges...)
+	}
+	svc := corev1ac.Service(name, instanceId).
+		WithLabels(map[string]string{
+			"cnpg-broker.io/instance-id": instanceId,
+		}).
+		WithSpec(spec)
+	if len(exposure.Annotations) > 0 {
+		svc.WithAnnotations(exposure.Annotations)
+	}
+	return svc
+}
+
+// renderTLSRoute renders the Gateway API TLSRoute routing the hostname of an instance to its primary,
+// or nil if its plan is not exposed with a TLSRoute
+func renderTLSRoute(instanceId string, plan catalog.Plan) *unstructured.Unstructured {
+	exposure := plan.ExposureConfig()
+	if exposure.Mode != catalog.ExposureTLSRoute {
+		return nil
+	}
+	parent := map[string]any{
+		"name": exposure.Gateway.Name,
+	}
+	if len(exposure.Gateway.Namespace) > 0 {
+		parent["namespace"] = exposure.Gateway.Namespace
+	}
+	if len(exposure.Gateway.SectionName) > 0 {
+		parent["sectionName"] = exposure.Gateway.SectionName
+	}
+	return &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": tlsRouteResource.GroupVersion().String(),
+			"kind":       "TLSRoute",
+			"metadata": map[string]any{
+				"name":      clusterName(instanceId),
+				"namespace": instanceId,
+				"labels": map[string]any{
+					"cnpg-broker.io/instance-id": instanceId,
+				},
+			},
+			"spec": map[string]any{
+				"parentRefs": []any{parent},
+				"hostnames":  []any{routeHostname(instanceId, exposure)},
+				"rules": []any{
+					map[string]any{
+						"backendRefs": []any{
+							map[string]any{
+								"name": fmt.Sprintf("%s-rw", clusterName(instanceId)),
+								"port": int64(5432),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func routeHostname(instanceId string, exposure catalog.Exposure) string {
+	return strings.ReplaceAll(exposure.Hostname, "{instance_id}", instanceId)
+}
@@ -0,0 +1,397 @@
+package cnpg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cnpg-broker/pkg/audit"
+	"github.com/cnpg-broker/pkg/catalog"
+	"github.com/cnpg-broker/pkg/logger"
+	"github.com/cnpg-broker/pkg/validation"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+// ErrForeignSource is returned by ValidateRestore if the source instance belongs to another owner
+var ErrForeignSource = errors.New("restore_from_instance must be an instance of the same organization and space, or namespace")
+
+const (
+	barmanCloudPlugin = "barman-cloud.cloudnative-pg.io"
+	restoreSource     = "origin"
+
+	RestoreMethodRecovery     = "recovery"
+	RestoreMethodPgBasebackup = "pg_basebackup"
+)
+
+// ValidateRestore checks the restore parameters of a new instance against its source instance, which
+// must have the same owner. Parameter errors are returned as *validation.ValidationError.
+func (c *Client) ValidateRestore(ctx context.Context, instanceId string, params InstanceParameters, plan catalog.Plan) error {
+	if len(params.RestoreFromInstance) == 0 {
+		if len(params.RestoreMethod) > 0 || len(params.TargetTime) > 0 || len(params.TargetLSN) > 0 {
+			return &validation.ValidationError{Field: "parameters.restore_from_instance", Message: "required for restore_method, target_time and target_lsn"}
+		}
+		return nil
+	}
+	if params.RestoreFromInstance == instanceId {
+		return &validation.ValidationError{Field: "parameters.restore_from_instance", Message: "must not be the instance itself"}
+	}
+	if len(params.TargetTime) > 0 && len(params.TargetLSN) > 0 {
+		return &validation.ValidationError{Field: "parameters.target_lsn", Message: "must not be combined with target_time"}
+	}
+	if restoreMethod(params) == RestoreMethodPgBasebackup && (len(params.TargetTime) > 0 || len(params.TargetLSN) > 0) {
+		return &validation.ValidationError{Field: "parameters.restore_method", Message: "pg_basebackup always clones the current state, recovery targets are not supported"}
+	}
+	if len(params.TargetTime) > 0 {
+		if targetTime, err := time.Parse(time.RFC3339, params.TargetTime); err != nil || targetTime.After(time.Now()) {
+			return &validation.ValidationError{Field: "parameters.target_time", Message: "must be a RFC3339 timestamp in the past"}
+		}
+	}
+	if len(params.Extensions) > 0 {
+		return &validation.ValidationError{Field: "parameters.extensions", Message: "not supported when restoring, extensions are taken over from the source instance"}
+	}
+
+	source, err := c.dynamic.Resource(clusterResource).Namespace(params.RestoreFromInstance).Get(ctx, clusterName(params.RestoreFromInstance), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return &validation.ValidationError{Field: "parameters.restore_from_instance", Message: "instance not found"}
+		}
+		return err
+	}
+	// instances without owner, e.g. provisioned without context, cannot be restored from
+	if owner := source.GetAnnotations()[ownerAnnotation]; len(owner) == 0 || owner != params.Owner {
+		return ErrForeignSource
+	}
+
+	// the new instance must be able to hold the data of the source
+	sourceStorage, _, _ := unstructured.NestedString(source.Object, "spec", "storage", "size")
+	if len(sourceStorage) > 0 && len(plan.Metadata.Storage) > 0 {
+		sourceSize, sourceErr := resource.ParseQuantity(sourceStorage)
+		size, err := resource.ParseQuantity(plan.Metadata.Storage)
+		if sourceErr == nil && err == nil && size.Cmp(sourceSize) < 0 {
+			return &validation.ValidationError{Field: "plan_id", Message: fmt.Sprintf("storage of plan is smaller than the %s of the source instance", sourceStorage)}
+		}
+	}
+
+	// the data directory can only be used by the same major version
+	sourceVersion := clusterPostgresVersion(source)
+	if len(sourceVersion) > 0 && len(params.PostgresVersion) > 0 {
+		if sourceVersion != params.PostgresVersion {
+			return &validation.ValidationError{Field: "parameters.postgres_version", Message: fmt.Sprintf("must match version %s of the source instance", sourceVersion)}
+		}
+	}
+	if err := plan.CheckPostgresVersion(sourceVersion); err != nil {
+		return &validation.ValidationError{Field: "plan_id", Message: fmt.Sprintf("%v of the source instance", err)}
+	}
+
+	switch restoreMethod(params) {
+	case RestoreMethodRecovery:
+		if _, _, found := barmanCloudConfiguration(source); !found {
+			return &validation.ValidationError{Field: "parameters.restore_from_instance", Message: "instance has no backups configured"}
+		}
+	case RestoreMethodPgBasebackup:
+		phase, _, _ := unstructured.NestedString(source.Object, "status", "phase")
+		if phase != "Cluster in healthy state" {
+			return &validation.ValidationError{Field: "parameters.restore_from_instance", Message: fmt.Sprintf("instance must be healthy to be cloned, current phase: %s", phase)}
+		}
+	}
+	return nil
+}
+
+// prepareRestore renders the bootstrap and externalClusters sections of a restored Cluster, and copies
+// the Secrets and ObjectStore it needs to access its source into the namespace of the new instance
+func (c *Client) prepareRestore(ctx context.Context, instanceId string, params InstanceParameters, spec map[string]any) error {
+	sourceId := params.RestoreFromInstance
+	source, err := c.dynamic.Resource(clusterResource).Namespace(sourceId).Get(ctx, clusterName(sourceId), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	_, image := spec["imageName"]
+	_, imageCatalog := spec["imageCatalogRef"]
+	if !image && !imageCatalog {
+		for _, field := range []string{"imageName", "imageCatalogRef"} {
+			if value, found, _ := unstructured.NestedFieldCopy(source.Object, "spec", field); found {
+				spec[field] = value
+			}
+		}
+	}
+
+	switch restoreMethod(params) {
+	case RestoreMethodRecovery:
+		objectStoreName, serverName, found := barmanCloudConfiguration(source)
+		if !found {
+			return fmt.Errorf("instance %s has no backups configured", sourceId)
+		}
+		if err := c.copyObjectStore(ctx, sourceId, objectStoreName, instanceId); err != nil {
+			return err
+		}
+
+		recovery := map[string]any{
+			"source":   restoreSource,
+			"database": "app",
+			"owner":    "app",
+		}
+		if len(params.TargetTime) > 0 {
+			recovery["recoveryTarget"] = map[string]any{"targetTime": params.TargetTime}
+		} else if len(params.TargetLSN) > 0 {
+			recovery["recoveryTarget"] = map[string]any{"targetLSN": params.TargetLSN}
+		}
+		spec["bootstrap"] = map[string]any{"recovery": recovery}
+		spec["externalClusters"] = []any{
+			map[string]any{
+				"name": restoreSource,
+				"plugin": map[string]any{
+					"name": barmanCloudPlugin,
+					"parameters": map[string]any{
+						"barmanObjectName": objectStoreName,
+						"serverName":       serverName,
+					},
+				},
+			},
+		}
+		logger.InfoContext(ctx, "instance %s will be recovered from backups of instance %s", instanceId, sourceId)
+
+	case RestoreMethodPgBasebackup:
+		replicationSecret := fmt.Sprintf("%s-replication", clusterName(sourceId))
+		caSecret := fmt.Sprintf("%s-ca", clusterName(sourceId))
+		for _, name := range []string{replicationSecret, caSecret} {
+			if err := c.copySecret(ctx, sourceId, name, instanceId); err != nil {
+				return err
+			}
+		}
+
+		spec["bootstrap"] = map[string]any{
+			"pg_basebackup": map[string]any{
+				"source":   restoreSource,
+				"database": "app",
+				"owner":    "app",
+			},
+		}
+		spec["externalClusters"] = []any{
+			map[string]any{
+				"name": restoreSource,
+				"connectionParameters": map[string]any{
+					"host":    fmt.Sprintf("%s-rw.%s.svc", clusterName(sourceId), sourceId),
+					"user":    "streaming_replica",
+					"dbname":  "postgres",
+					"sslmode": "verify-full",
+				},
+				"sslKey":      map[string]any{"name": replicationSecret, "key": "tls.key"},
+				"sslCert":     map[string]any{"name": replicationSecret, "key": "tls.crt"},
+				"sslRootCert": map[string]any{"name": caSecret, "key": "ca.crt"},
+			},
+		}
+		logger.InfoContext(ctx, "instance %s will be cloned from instance %s", instanceId, sourceId)
+	}
+	return nil
+}
+
+// RemoveRestoreCopies deletes the copies of the objects of the source of a restored instance: the
+// replication and CA Secrets of a clone, which grant streaming replication access to the source, and the
+// ObjectStore of a recovery with the object store credentials of the source. They are only needed for the
+// bootstrap.
+func (c *Client) RemoveRestoreCopies(ctx context.Context, instanceId string) error {
+	cluster, err := c.clusterObject(ctx, instanceId)
+	if err != nil || cluster == nil {
+		return err
+	}
+	externalClusters, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "externalClusters")
+	for _, e := range externalClusters {
+		external, ok := e.(map[string]any)
+		if !ok || external["name"] != restoreSource {
+			continue
+		}
+		if _, found, _ := unstructured.NestedMap(cluster.Object, "spec", "bootstrap", "pg_basebackup"); found {
+			if err := c.removeCopiedSecrets(ctx, instanceId, secretReferences(external)); err != nil {
+				return err
+			}
+		}
+		if _, found, _ := unstructured.NestedMap(cluster.Object, "spec", "bootstrap", "recovery"); found {
+			objectStoreName, _, _ := unstructured.NestedString(external, "plugin", "parameters", "barmanObjectName")
+			if err := c.removeCopiedObjectStore(ctx, instanceId, objectStoreName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeCopiedObjectStore deletes an ObjectStore copied from the source of an instance and the Secrets it references
+func (c *Client) removeCopiedObjectStore(ctx context.Context, instanceId, name string) error {
+	if len(name) == 0 {
+		return nil
+	}
+	objectStores := c.dynamic.Resource(objectStoreResource).Namespace(instanceId)
+	objectStore, err := objectStores.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// only copies are deleted, never the ObjectStore the instance archives to
+	if _, copied := objectStore.GetAnnotations()["cnpg-broker.io/copied-from"]; !copied {
+		return nil
+	}
+	configuration, _, _ := unstructured.NestedMap(objectStore.Object, "spec", "configuration")
+	if err := c.removeCopiedSecrets(ctx, instanceId, secretReferences(configuration)); err != nil {
+		return err
+	}
+	if err := objectStores.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete object store %s: %w", name, err)
+	}
+	audit.Touched(ctx, "ObjectStore", instanceId, name)
+	logger.InfoContext(ctx, "deleted object store %s copied from the source of instance %s", name, instanceId)
+	return nil
+}
+
+// removeCopiedSecrets deletes those of the Secrets of an instance that were copied from its source
+func (c *Client) removeCopiedSecrets(ctx context.Context, instanceId string, names []string) error {
+	for _, name := range names {
+		secret, err := c.clientset.CoreV1().Secrets(instanceId).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		// only copies are deleted, never Secrets of the instance itself
+		if _, copied := secret.Annotations["cnpg-broker.io/copied-from"]; !copied {
+			continue
+		}
+		if err := c.clientset.CoreV1().Secrets(instanceId).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete secret %s: %w", name, err)
+		}
+		audit.Touched(ctx, "Secret", instanceId, name)
+		logger.InfoContext(ctx, "deleted secret %s copied from the source of instance %s", name, instanceId)
+	}
+	return nil
+}
+
+// copyObjectStore copies a barman-cloud ObjectStore and all Secrets it references into another namespace
+func (c *Client) copyObjectStore(ctx context.Context, sourceId, name, instanceId string) error {
+	objectStore, err := c.dynamic.Resource(objectStoreResource).Namespace(sourceId).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get object store of instance %s: %w", sourceId, err)
+	}
+	configuration, _, _ := unstructured.NestedMap(objectStore.Object, "spec", "configuration")
+	for _, secretName := range secretReferences(configuration) {
+		if err := c.copySecret(ctx, sourceId, secretName, instanceId); err != nil {
+			return err
+		}
+	}
+
+	spec, _, _ := unstructured.NestedMap(objectStore.Object, "spec")
+	copied := &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": objectStore.GetAPIVersion(),
+			"kind":       objectStore.GetKind(),
+			"metadata": map[string]any{
+				"name":      name,
+				"namespace": instanceId,
+				"labels": map[string]any{
+					"cnpg-broker.io/instance-id": instanceId,
+				},
+				"annotations": map[string]any{
+					"cnpg-broker.io/copied-from": sourceId,
+				},
+			},
+			"spec": spec,
+		},
+	}
+	// the copy is only used to read the backups of the source instance
+	unstructured.RemoveNestedField(copied.Object, "spec", "retentionPolicy")
+
+	return c.applyObject(ctx, objectStoreResource, copied)
+}
+
+func (c *Client) copySecret(ctx context.Context, sourceId, name, instanceId string) error {
+	secret, err := c.clientset.CoreV1().Secrets(sourceId).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get secret %s of instance %s: %w", name, sourceId, err)
+	}
+	copied := corev1ac.Secret(name, instanceId).
+		WithLabels(map[string]string{
+			"cnpg-broker.io/instance-id": instanceId,
+		}).
+		WithAnnotations(map[string]string{
+			"cnpg-broker.io/copied-from": sourceId,
+		}).
+		WithType(secret.Type).
+		WithData(secret.Data)
+	return c.applySecret(ctx, copied)
+}
+
+// barmanCloudConfiguration returns the ObjectStore name and server name a Cluster archives its backups to
+func barmanCloudConfiguration(cluster *unstructured.Unstructured) (string, string, bool) {
+	plugins, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "plugins")
+	for _, p := range plugins {
+		plugin, ok := p.(map[string]any)
+		if !ok || plugin["name"] != barmanCloudPlugin {
+			continue
+		}
+		objectStoreName, _, _ := unstructured.NestedString(plugin, "parameters", "barmanObjectName")
+		if len(objectStoreName) == 0 {
+			continue
+		}
+		serverName, _, _ := unstructured.NestedString(plugin, "parameters", "serverName")
+		if len(serverName) == 0 {
+			serverName = cluster.GetName()
+		}
+		return objectStoreName, serverName, true
+	}
+	return "", "", false
+}
+
+// secretReferences collects the names of all secret key selectors ({name, key}) within an object
+func secretReferences(object map[string]any) []string {
+	var names []string
+	for _, value := range object {
+		switch v := value.(type) {
+		case map[string]any:
+			name, hasName := v["name"].(string)
+			if _, hasKey := v["key"].(string); hasName && hasKey {
+				names = append(names, name)
+				continue
+			}
+			names = append(names, secretReferences(v)...)
+		}
+	}
+	return names
+}
+
+func restoreMethod(params InstanceParameters) string {
+	if len(params.RestoreMethod) > 0 {
+		return params.RestoreMethod
+	}
+	return RestoreMethodRecovery
+}
+
+// clusterPostgresVersion returns the PostgreSQL major version of a Cluster, as reported by the operator
+// once it ran the image, else from its image or image catalog reference. It is empty for the default
+// image of the operator.
+func clusterPostgresVersion(cluster *unstructured.Unstructured) string {
+	if major, found, _ := unstructured.NestedInt64(cluster.Object, "status", "pgDataImageInfo", "majorVersion"); found && major > 0 {
+		return strconv.FormatInt(major, 10)
+	}
+	if imageName, _, _ := unstructured.NestedString(cluster.Object, "spec", "imageName"); len(imageName) > 0 {
+		return majorVersion(imageName)
+	}
+	if major, found, _ := unstructured.NestedInt64(cluster.Object, "spec", "imageCatalogRef", "major"); found {
+		return strconv.FormatInt(major, 10)
+	}
+	return ""
+}
+
+// majorVersion returns the major version from the tag of a PostgreSQL image, e.g. 17 for postgresql:17.6-system-trixie
+func majorVersion(imageName string) string {
+	tag := imageName[strings.LastIndex(imageName, ":")+1:]
+	if i := strings.IndexAny(tag, ".-"); i > 0 {
+		return tag[:i]
+	}
+	return tag
+}
@@ -0,0 +1,87 @@
+package cnpg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cnpg-broker/pkg/cnpg/cnpgtest"
+	"github.com/cnpg-broker/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestRemoveRestoreCopies(t *testing.T) {
+	backupConfig := config.Get().Backup
+	defer func() { config.Get().Backup = backupConfig }()
+	config.Get().Backup.DestinationPath = "s3://backups/"
+	config.Get().Backup.CredentialsNamespace = "cnpg-broker"
+
+	sourceId := "5d8e2b1a-7c3f-4e6a-9b0d-1f2e3a4b5c6d"
+	owner := "kubernetes/orders"
+	for _, method := range []string{RestoreMethodRecovery, RestoreMethodPgBasebackup} {
+		t.Run(method, func(t *testing.T) {
+			core := []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: config.Get().Backup.CredentialsSecret, Namespace: "cnpg-broker"},
+				Data:       map[string][]byte{"ACCESS_KEY_ID": []byte("key"), "ACCESS_SECRET_KEY": []byte("secret")},
+			}}
+			for _, name := range []string{"db-" + sourceId + "-replication", "db-" + sourceId + "-ca"} {
+				core = append(core, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: sourceId}})
+			}
+			client, dynClient, clientset := newTestClient(core, nil)
+			ctx := context.Background()
+			if _, err := client.CreateCluster(ctx, sourceId, cnpgtest.ServiceID, cnpgtest.DevSmall, InstanceParameters{Owner: owner}); err != nil {
+				t.Fatalf("failed to create source cluster: %v", err)
+			}
+
+			params := InstanceParameters{RestoreFromInstance: sourceId, RestoreMethod: method, Owner: owner}
+			if _, err := client.CreateCluster(ctx, cnpgtest.InstanceID, cnpgtest.ServiceID, cnpgtest.DevSmall, params); err != nil {
+				t.Fatalf("failed to create restored cluster: %v", err)
+			}
+			copiedSecrets := []string{"db-" + sourceId + "-replication", "db-" + sourceId + "-ca"}
+			if method == RestoreMethodRecovery {
+				copiedSecrets = []string{"db-" + sourceId + "-backup-credentials"}
+			}
+			for _, name := range copiedSecrets {
+				if _, err := clientset.CoreV1().Secrets(cnpgtest.InstanceID).Get(ctx, name, metav1.GetOptions{}); err != nil {
+					t.Fatalf("expected secret %s of the source to be copied: %v", name, err)
+				}
+			}
+			objectStores := dynClient.Resource(cnpgtest.ObjectStoreResource).Namespace(cnpgtest.InstanceID)
+			copiedObjectStore := "db-" + sourceId + "-backup"
+			if _, err := objectStores.Get(ctx, copiedObjectStore, metav1.GetOptions{}); (err == nil) != (method == RestoreMethodRecovery) {
+				t.Fatalf("expected the object store of the source to be copied for a recovery only, got %v", err)
+			}
+
+			// the copies are removed once the bootstrap finished
+			cnpgtest.SetReady(t, dynClient)
+			result, err := client.ReconcileInstance(ctx, cnpgtest.InstanceID)
+			if err != nil {
+				t.Fatalf("failed to reconcile: %v", err)
+			}
+			if len(result.Skipped) > 0 {
+				t.Fatalf("expected the instance to be reconciled, skipped: %v", result.Skipped)
+			}
+			for _, name := range copiedSecrets {
+				if _, err := clientset.CoreV1().Secrets(cnpgtest.InstanceID).Get(ctx, name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+					t.Errorf("expected the copy of secret %s to be deleted, got %v", name, err)
+				}
+				if _, err := clientset.CoreV1().Secrets(sourceId).Get(ctx, name, metav1.GetOptions{}); err != nil {
+					t.Errorf("expected secret %s of the source to be kept: %v", name, err)
+				}
+			}
+			if _, err := objectStores.Get(ctx, copiedObjectStore, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+				t.Errorf("expected the copy of the object store to be deleted, got %v", err)
+			}
+
+			// the instance keeps archiving to its own object store
+			if _, err := objectStores.Get(ctx, "db-"+cnpgtest.InstanceID+"-backup", metav1.GetOptions{}); err != nil {
+				t.Errorf("expected the object store of the instance to be kept: %v", err)
+			}
+			if _, err := clientset.CoreV1().Secrets(cnpgtest.InstanceID).Get(ctx, "db-"+cnpgtest.InstanceID+"-backup-credentials", metav1.GetOptions{}); err != nil {
+				t.Errorf("expected the object store credentials of the instance to be kept: %v", err)
+			}
+		})
+	}
+}
@@ -1,27 +1,134 @@
 package cnpg
 
+import "time"
+
 type ClusterInfo struct {
-	Exists         bool              `json:"exists"`
-	InstanceID     string            `json:"instance_id"`
-	ServiceID      string            `json:"service_id"`
-	PlanID         string            `json:"plan_id"`
-	Namespace      string            `json:"namespace"`
-	Name           string            `json:"name"`
-	TotalInstances int64             `json:"total_instances"`
-	ReadyInstances int64             `json:"ready_instances"`
-	Phase          string            `json:"phase"`
-	IsReady        bool              `json:"is_ready"`
-	IsProvisioning bool              `json:"is_provisioning"`
-	IsFailed       bool              `json:"is_failed"`
-	FailureReason  string            `json:"failure_reason,omitempty"`
-	Instances      int64             `json:"instances"`
-	CPU            string            `json:"cpu"`
-	Memory         string            `json:"memory"`
-	Storage        string            `json:"storage"`
-	Labels         map[string]string `json:"labels,omitempty"`
+	Exists         bool               `json:"exists"`
+	InstanceID     string             `json:"instance_id"`
+	ServiceID      string             `json:"service_id"`
+	PlanID         string             `json:"plan_id"`
+	Namespace      string             `json:"namespace"`
+	Name           string             `json:"name"`
+	TotalInstances int64              `json:"total_instances"`
+	ReadyInstances int64              `json:"ready_instances"`
+	Phase          string             `json:"phase"`
+	IsReady        bool               `json:"is_ready"`
+	IsProvisioning bool               `json:"is_provisioning"`
+	IsFailed       bool               `json:"is_failed"`
+	FailureReason  string             `json:"failure_reason,omitempty"`
+	Instances      int64              `json:"instances"`
+	CPU            string             `json:"cpu"`
+	Memory         string             `json:"memory"`
+	Storage        string             `json:"storage"`
+	Labels         map[string]string  `json:"labels,omitempty"`
+	Parameters     InstanceParameters `json:"parameters"`
+	BackupsEnabled bool               `json:"backups_enabled"`
+	// PostgresVersion is the PostgreSQL major version of the data directory, empty for the default image of the operator
+	PostgresVersion string `json:"postgres_version,omitempty"`
+	// Generation is the generation of the Cluster spec, ObservedGeneration the one its Ready condition refers to,
+	// or 0 if the operator does not report it
+	Generation         int64     `json:"generation"`
+	ObservedGeneration int64     `json:"observed_generation"`
+	CreatedAt          time.Time `json:"created_at"`
+	// Poolers are only reported for a single instance, see Client.GetPoolers
+	Poolers []PoolerStatus `json:"poolers,omitempty"`
+}
+
+// PoolerStatus is the state of a PgBouncer Pooler of an instance
+type PoolerStatus struct {
+	Name            string `json:"name"`
+	Type            string `json:"type"`
+	PoolMode        string `json:"pool_mode"`
+	DefaultPoolSize string `json:"default_pool_size,omitempty"`
+	MaxClientConn   string `json:"max_client_conn,omitempty"`
+	Instances       int64  `json:"instances"`
+	// CurrentInstances is the number of PgBouncer pods as reported by the operator
+	CurrentInstances int64 `json:"current_instances"`
+	IsReady          bool  `json:"is_ready"`
 }
 
 type NamespaceStatus struct {
 	Exists        bool `json:"exists"`
 	IsTerminating bool `json:"is_terminating"`
 }
+
+// InstanceParameters are the provision and update parameters of a service instance,
+// as defined by the JSON schemas of its plan
+type InstanceParameters struct {
+	PostgresVersion      string            `json:"postgres_version,omitempty"`
+	PostgresqlParameters map[string]string `json:"postgresql_parameters,omitempty"`
+	Extensions           []string          `json:"extensions,omitempty"`
+	Timezone             string            `json:"timezone,omitempty"`
+	RestoreFromInstance  string            `json:"restore_from_instance,omitempty"`
+	RestoreMethod        string            `json:"restore_method,omitempty"`
+	TargetTime           string            `json:"target_time,omitempty"`
+	TargetLSN            string            `json:"target_lsn,omitempty"`
+	Pooler               *PoolerParameters `json:"pooler,omitempty"`
+	// Owner is the platform context the instance is provisioned in, see Owner. It is not a parameter.
+	Owner string `json:"-"`
+}
+
+// PoolerParameters are the PgBouncer settings of an instance, they take precedence over those of its plan
+type PoolerParameters struct {
+	Enabled         *bool  `json:"enabled,omitempty"`
+	PoolMode        string `json:"pool_mode,omitempty"`
+	DefaultPoolSize int    `json:"default_pool_size,omitempty"`
+	MaxClientConn   int    `json:"max_client_conn,omitempty"`
+	Instances       int64  `json:"instances,omitempty"`
+}
+
+// BindingParameters are the parameters accepted when creating a binding
+type BindingParameters struct {
+	SecretNamespace string `json:"secret_namespace,omitempty"`
+	SecretName      string `json:"secret_name,omitempty"`
+}
+
+// ProjectedSecret references the servicebinding.io Secret the credentials of a binding are projected to
+type ProjectedSecret struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// Operation is an entry of the operation journal of a service instance
+type Operation struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	BindingID   string     `json:"binding_id,omitempty"`
+	PlanID      string     `json:"plan_id,omitempty"`
+	State       string     `json:"state"`
+	Description string     `json:"description,omitempty"`
+	Identity    string     `json:"identity,omitempty"`
+	Generation  int64      `json:"generation,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	// PostgresVersion is the target of a major upgrade, empty for updates keeping the version
+	PostgresVersion string `json:"postgres_version,omitempty"`
+}
+
+// BindingStatus is the state of the login role of a binding, as reconciled by CNPG
+type BindingStatus struct {
+	SecretExists bool
+	// Ensure is the ensure setting of the managed role, RoleDisabled for the role of an unbound binding
+	// kept without login, or empty if the role is not managed
+	Ensure  string
+	State   string
+	Message string
+	// ProjectedSecret is the Secret the credentials are projected to, or nil if there is none
+	ProjectedSecret *ProjectedSecret
+}
+
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Phase     string    `json:"phase"`
+	Method    string    `json:"method"`
+	Scheduled bool      `json:"scheduled"`
+	BackupID  string    `json:"backup_id,omitempty"`
+	BeginWal  string    `json:"begin_wal,omitempty"`
+	EndWal    string    `json:"end_wal,omitempty"`
+	BeginLSN  string    `json:"begin_lsn,omitempty"`
+	EndLSN    string    `json:"end_lsn,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	StartedAt string    `json:"started_at,omitempty"`
+	StoppedAt string    `json:"stopped_at,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
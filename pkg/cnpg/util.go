@@ -1,9 +1,60 @@
 package cnpg
 
 import (
+	"context"
 	"fmt"
+	"strings"
+
+	"github.com/cnpg-broker/pkg/identity"
 )
 
 func clusterName(instanceId string) string {
 	return fmt.Sprintf("db-%s", instanceId)
 }
+
+func bindingSecretName(instanceId, bindingId string) string {
+	return fmt.Sprintf("%s-binding-%s", clusterName(instanceId), bindingId)
+}
+
+// bindingRoleName returns the PostgreSQL role name for a binding, hyphens are replaced so the
+// name does not need to be quoted when used in SQL
+func bindingRoleName(bindingId string) string {
+	return fmt.Sprintf("binding_%s", strings.ReplaceAll(bindingId, "-", "_"))
+}
+
+// backupName is the name of the ObjectStore and ScheduledBackup of an instance
+func backupName(instanceId string) string {
+	return fmt.Sprintf("%s-backup", clusterName(instanceId))
+}
+
+// backupCredentialsName is the name of the Secret with the object store credentials of an instance in the
+// credentials namespace of the broker
+func backupCredentialsName(instanceId string) string {
+	return fmt.Sprintf("backup-%s", instanceId)
+}
+
+// Owner returns the owner of an instance provisioned with an OSB context: the organization and space on
+// Cloud Foundry, the namespace on Kubernetes. It is empty for other platforms and requests without context.
+func Owner(osbContext map[string]any) string {
+	platform, _ := osbContext["platform"].(string)
+	switch platform {
+	case "cloudfoundry":
+		org, _ := osbContext["organization_guid"].(string)
+		space, _ := osbContext["space_guid"].(string)
+		if len(org) > 0 && len(space) > 0 {
+			return fmt.Sprintf("cloudfoundry/%s/%s", org, space)
+		}
+	case "kubernetes":
+		if namespace, _ := osbContext["namespace"].(string); len(namespace) > 0 {
+			return fmt.Sprintf("kubernetes/%s", namespace)
+		}
+	}
+	return ""
+}
+
+// setOriginatingIdentity records the platform user who requested an operation under key in annotations
+func setOriginatingIdentity(ctx context.Context, annotations map[string]string, key string) {
+	if id := identity.FromContext(ctx); id != nil {
+		annotations[key] = id.String()
+	}
+}
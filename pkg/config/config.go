@@ -3,7 +3,9 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Config struct {
@@ -11,7 +13,98 @@ type Config struct {
 	Username     string
 	Password     string
 	LogLevel     string
+	LogFormat    string
 	LogTimestamp bool
+	// RBACStrict makes the broker refuse to start if it lacks permissions needed by enabled features
+	RBACStrict bool
+	// DefaultPlanID is the plan used for unknown plan IDs of its service, no fallback if empty
+	DefaultPlanID string
+	Catalog       CatalogConfig
+	Backup        BackupConfig
+	Cache         CacheConfig
+	Audit         AuditConfig
+	Health        HealthConfig
+	Operator      OperatorConfig
+	Reconciler    ReconcilerConfig
+	Orphans       OrphansConfig
+	Upgrade       UpgradeConfig
+	Projection    ProjectionConfig
+}
+
+// CatalogConfig locates the service catalog, which is read from a file unless a ConfigMap is configured
+type CatalogConfig struct {
+	Path string
+	// ConfigMap is namespace/name of a ConfigMap holding the catalog YAML in Key
+	ConfigMap    string
+	Key          string
+	PollInterval time.Duration
+}
+
+// HealthConfig controls the readiness checks
+type HealthConfig struct {
+	// CacheTTL is how long the result of the readiness checks is reused
+	CacheTTL time.Duration
+}
+
+// OperatorConfig locates the deployment of the CNPG operator
+type OperatorConfig struct {
+	Namespace  string
+	Deployment string
+}
+
+// ReconcilerConfig controls the background reconciler repairing drift of instance objects
+type ReconcilerConfig struct {
+	Enabled  bool
+	Interval time.Duration
+	// LeaseNamespace/LeaseName is the Lease electing the replica that runs the reconciler
+	LeaseNamespace string
+	LeaseName      string
+}
+
+// OrphansConfig controls the detection of orphaned objects
+type OrphansConfig struct {
+	// GracePeriod is the age below which objects are not reported, they may belong to a provision in progress
+	GracePeriod time.Duration
+}
+
+// UpgradeConfig controls the checks before a major upgrade of an instance
+type UpgradeConfig struct {
+	// BackupMaxAge is the maximum age of the last completed backup of an instance to be upgraded
+	BackupMaxAge time.Duration
+}
+
+// ProjectionConfig controls where binding credentials may be projected to as Secrets
+type ProjectionConfig struct {
+	// Namespaces are the namespaces bindings from platforms other than Kubernetes may project to,
+	// none if empty. Bindings from Kubernetes always project to the namespace of their context.
+	Namespaces []string
+}
+
+// AuditConfig selects the sinks audit entries of state-changing operations are written to
+type AuditConfig struct {
+	// Sinks is a list of stdout, file and event
+	Sinks []string
+	File  string
+	// HMACKey is the key the hash chain of the entries is computed with, plain SHA-256 if empty
+	HMACKey string
+}
+
+// CacheConfig controls the informer cache reads of clusters, secrets and services are served from
+type CacheConfig struct {
+	Enabled        bool
+	ResyncInterval time.Duration
+}
+
+// BackupConfig is the object store all instance backups are written to, plans can override the destination path
+type BackupConfig struct {
+	DestinationPath string
+	EndpointURL     string
+	Region          string
+	// CredentialsNamespace holds the object store credentials Secret of the broker, CredentialsSecret, which is
+	// copied to the namespace of each instance. A Secret backup-<instance id> there overrides it for one instance,
+	// e.g. with credentials scoped to the backups of that instance.
+	CredentialsNamespace string
+	CredentialsSecret    string
 }
 
 var (
@@ -39,12 +132,130 @@ func load() *Config {
 		logTimestamp = true
 	}
 
+	rbacStrict := false
+	if os.Getenv("BROKER_RBAC_STRICT") == "true" {
+		rbacStrict = true
+	}
+
+	cacheEnabled := true
+	if os.Getenv("BROKER_CACHE_ENABLED") == "false" {
+		cacheEnabled = false
+	}
+
+	cacheResync := 10 * time.Minute
+	if r := os.Getenv("BROKER_CACHE_RESYNC_INTERVAL"); r != "" {
+		if parsed, err := time.ParseDuration(r); err == nil {
+			cacheResync = parsed
+		}
+	}
+
+	catalogPollInterval := 10 * time.Second
+	if i := os.Getenv("BROKER_CATALOG_POLL_INTERVAL"); i != "" {
+		if parsed, err := time.ParseDuration(i); err == nil {
+			catalogPollInterval = parsed
+		}
+	}
+
+	healthCacheTTL := 5 * time.Second
+	if t := os.Getenv("BROKER_HEALTH_CACHE_TTL"); t != "" {
+		if parsed, err := time.ParseDuration(t); err == nil {
+			healthCacheTTL = parsed
+		}
+	}
+
+	reconcilerEnabled := true
+	if os.Getenv("BROKER_RECONCILER_ENABLED") == "false" {
+		reconcilerEnabled = false
+	}
+
+	reconcileInterval := 5 * time.Minute
+	if i := os.Getenv("BROKER_RECONCILE_INTERVAL"); i != "" {
+		if parsed, err := time.ParseDuration(i); err == nil {
+			reconcileInterval = parsed
+		}
+	}
+
+	orphanGracePeriod := time.Hour
+	if p := os.Getenv("BROKER_ORPHAN_GRACE_PERIOD"); p != "" {
+		if parsed, err := time.ParseDuration(p); err == nil {
+			orphanGracePeriod = parsed
+		}
+	}
+
+	upgradeBackupMaxAge := 24 * time.Hour
+	if a := os.Getenv("BROKER_UPGRADE_BACKUP_MAX_AGE"); a != "" {
+		if parsed, err := time.ParseDuration(a); err == nil {
+			upgradeBackupMaxAge = parsed
+		}
+	}
+
+	var auditSinks []string
+	for _, sink := range strings.Split(getEnvOrDefault("BROKER_AUDIT_SINKS", "stdout"), ",") {
+		if sink = strings.TrimSpace(sink); len(sink) > 0 {
+			auditSinks = append(auditSinks, sink)
+		}
+	}
+
+	var projectionNamespaces []string
+	for _, namespace := range strings.Split(getEnvOrDefault("BROKER_PROJECTION_NAMESPACES", ""), ",") {
+		if namespace = strings.TrimSpace(namespace); len(namespace) > 0 {
+			projectionNamespaces = append(projectionNamespaces, namespace)
+		}
+	}
+
 	return &Config{
-		Port:         port,
-		Username:     getEnvOrDefault("BROKER_USERNAME", ""),
-		Password:     getEnvOrDefault("BROKER_PASSWORD", ""),
-		LogLevel:     getEnvOrDefault("BROKER_LOG_LEVEL", "info"),
-		LogTimestamp: logTimestamp,
+		Port:          port,
+		Username:      getEnvOrDefault("BROKER_USERNAME", ""),
+		Password:      getEnvOrDefault("BROKER_PASSWORD", ""),
+		LogLevel:      getEnvOrDefault("BROKER_LOG_LEVEL", "info"),
+		LogFormat:     getEnvOrDefault("BROKER_LOG_FORMAT", "text"),
+		LogTimestamp:  logTimestamp,
+		RBACStrict:    rbacStrict,
+		DefaultPlanID: getEnvOrDefault("BROKER_DEFAULT_PLAN_ID", ""),
+		Catalog: CatalogConfig{
+			Path:         getEnvOrDefault("BROKER_CATALOG_PATH", "catalog.yaml"),
+			ConfigMap:    getEnvOrDefault("BROKER_CATALOG_CONFIGMAP", ""),
+			Key:          getEnvOrDefault("BROKER_CATALOG_CONFIGMAP_KEY", "catalog.yaml"),
+			PollInterval: catalogPollInterval,
+		},
+		Backup: BackupConfig{
+			DestinationPath:      getEnvOrDefault("BROKER_BACKUP_DESTINATION_PATH", ""),
+			EndpointURL:          getEnvOrDefault("BROKER_BACKUP_ENDPOINT_URL", ""),
+			Region:               getEnvOrDefault("BROKER_BACKUP_REGION", ""),
+			CredentialsNamespace: getEnvOrDefault("BROKER_BACKUP_CREDENTIALS_NAMESPACE", getEnvOrDefault("POD_NAMESPACE", "default")),
+			CredentialsSecret:    getEnvOrDefault("BROKER_BACKUP_CREDENTIALS_SECRET", "cnpg-broker-backup"),
+		},
+		Cache: CacheConfig{
+			Enabled:        cacheEnabled,
+			ResyncInterval: cacheResync,
+		},
+		Audit: AuditConfig{
+			Sinks:   auditSinks,
+			File:    getEnvOrDefault("BROKER_AUDIT_FILE", "audit.log"),
+			HMACKey: getEnvOrDefault("BROKER_AUDIT_HMAC_KEY", ""),
+		},
+		Health: HealthConfig{
+			CacheTTL: healthCacheTTL,
+		},
+		Operator: OperatorConfig{
+			Namespace:  getEnvOrDefault("BROKER_OPERATOR_NAMESPACE", "cnpg-system"),
+			Deployment: getEnvOrDefault("BROKER_OPERATOR_DEPLOYMENT", "cnpg-controller-manager"),
+		},
+		Reconciler: ReconcilerConfig{
+			Enabled:        reconcilerEnabled,
+			Interval:       reconcileInterval,
+			LeaseNamespace: getEnvOrDefault("BROKER_LEASE_NAMESPACE", getEnvOrDefault("POD_NAMESPACE", "default")),
+			LeaseName:      getEnvOrDefault("BROKER_LEASE_NAME", "cnpg-broker"),
+		},
+		Orphans: OrphansConfig{
+			GracePeriod: orphanGracePeriod,
+		},
+		Upgrade: UpgradeConfig{
+			BackupMaxAge: upgradeBackupMaxAge,
+		},
+		Projection: ProjectionConfig{
+			Namespaces: projectionNamespaces,
+		},
 	}
 }
 
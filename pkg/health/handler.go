@@ -2,88 +2,141 @@ package health
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/cnpg-broker/pkg/catalog"
+	"github.com/cnpg-broker/pkg/cnpg"
+	"github.com/cnpg-broker/pkg/config"
 	"github.com/cnpg-broker/pkg/logger"
 	"github.com/labstack/echo/v4"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
-type Handler struct {
-	client dynamic.Interface
+// check is a named readiness check
+type check struct {
+	name string
+	run  func(ctx context.Context) error
 }
 
-func New() *Handler {
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		config, err = clientcmd.BuildConfigFromFlags("", clientcmd.RecommendedHomeFile)
-		if err != nil {
-			logger.Warn("failed to create k8s config for health checks: %v", err)
-			return &Handler{client: nil}
-		}
-	}
+// result is the outcome of the readiness checks at a point in time
+type result struct {
+	time   time.Time
+	ready  bool
+	checks map[string]string
+}
 
-	dynClient, err := dynamic.NewForConfig(config)
-	if err != nil {
-		logger.Warn("failed to create k8s client for health checks: %v", err)
-		return &Handler{client: nil}
-	}
+type Handler struct {
+	checks []check
+	ttl    time.Duration
+
+	mu   sync.Mutex
+	last *result
+}
 
-	return &Handler{client: dynClient}
+func New(client cnpg.ClusterBackend) *Handler {
+	cfg := config.Get()
+	return &Handler{
+		ttl: cfg.Health.CacheTTL,
+		checks: []check{
+			{name: "crds", run: client.CheckCRDs},
+			{name: "operator", run: func(ctx context.Context) error {
+				return client.CheckOperator(ctx, cfg.Operator.Namespace, cfg.Operator.Deployment)
+			}},
+			{name: "rbac", run: client.CheckRBAC},
+			// not ready to serve requests until the informer cache has synced
+			{name: "cache", run: func(context.Context) error {
+				if !client.HasSynced() {
+					return errors.New("informer cache is syncing")
+				}
+				return nil
+			}},
+			{name: "catalog", run: func(context.Context) error {
+				if !catalog.Loaded() {
+					return errors.New("no catalog loaded")
+				}
+				return nil
+			}},
+		},
+	}
 }
 
 func (h *Handler) RegisterRoutes(e *echo.Echo) {
 	g := e.Group("")
 
-	g.GET("/health", h.healthz)
-	g.GET("/healthz", h.healthz)
-}
+	g.GET("/livez", h.livez)
+	g.GET("/readyz", h.readyz)
 
-func (h *Handler) healthz(c echo.Context) error {
-	if h.client == nil {
-		return c.JSON(http.StatusServiceUnavailable, map[string]any{
-			"status": "unhealthy",
-			"checks": map[string]string{
-				"kubernetes": "unchecked",
-			},
-		})
-	}
+	// deprecated, same as /readyz
+	g.GET("/health", h.readyz)
+	g.GET("/healthz", h.readyz)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// livez only reports that the process is serving requests, it does not depend on the API server,
+// so an unreachable API server does not get the broker restarted
+func (h *Handler) livez(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]any{
+		"status": "ok",
+	})
+}
 
-	checks := make(map[string]string)
-	healthy := true
-
-	clusterResource := schema.GroupVersionResource{
-		Group:    "postgresql.cnpg.io",
-		Version:  "v1",
-		Resource: "clusters",
-	}
-	_, err := h.client.Resource(clusterResource).List(ctx, metav1.ListOptions{Limit: 1})
-	if err != nil {
-		checks["kubernetes"] = "unhealthy"
-		checks["error"] = err.Error()
-		healthy = false
-		logger.Error("health check failed: %v", err)
-	} else {
-		checks["kubernetes"] = "healthy"
-	}
+// readyz runs the readiness checks, or reuses their result if it is younger than the configured TTL.
+// With the verbose query parameter the outcome of each check is listed.
+func (h *Handler) readyz(c echo.Context) error {
+	res := h.run(c.Request().Context())
 
 	status := "ok"
 	httpStatus := http.StatusOK
-	if !healthy {
+	if !res.ready {
 		status = "unhealthy"
 		httpStatus = http.StatusServiceUnavailable
 	}
 
-	return c.JSON(httpStatus, map[string]any{
+	body := map[string]any{
 		"status": status,
-		"checks": checks,
-	})
+	}
+	if c.QueryParams().Has("verbose") {
+		body["checks"] = res.checks
+		body["checked_at"] = res.time
+	}
+	return c.JSON(httpStatus, body)
+}
+
+func (h *Handler) run(ctx context.Context) *result {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.last != nil && time.Since(h.last.time) < h.ttl {
+		return h.last
+	}
+
+	// a probe giving up early must not fail the checks of the result that is cached
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+
+	res := &result{
+		time:   time.Now().UTC(),
+		ready:  true,
+		checks: make(map[string]string, len(h.checks)),
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, chk := range h.checks {
+		wg.Go(func() {
+			err := chk.run(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				res.ready = false
+				res.checks[chk.name] = err.Error()
+				logger.ErrorContext(ctx, "readiness check %s failed: %v", chk.name, err)
+				return
+			}
+			res.checks[chk.name] = "ok"
+		})
+	}
+	wg.Wait()
+
+	h.last = res
+	return res
 }
@@ -0,0 +1,70 @@
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Header is the OSB header carrying the identity of the user that initiated a request at the platform
+const Header = "X-Broker-API-Originating-Identity"
+
+// Identity is the decoded originating identity of a request, as defined by the OSB API spec
+type Identity struct {
+	Platform string
+	Value    map[string]any
+}
+
+type contextKey struct{}
+
+// Parse decodes an originating identity header value of the form "<platform> <base64 encoded JSON>"
+func Parse(header string) (*Identity, error) {
+	platform, encoded, found := strings.Cut(strings.TrimSpace(header), " ")
+	if !found || len(platform) == 0 || len(encoded) == 0 {
+		return nil, fmt.Errorf("must be of the form '<platform> <value>'")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("value is not base64 encoded: %w", err)
+	}
+	value := make(map[string]any)
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("value is not a JSON object: %w", err)
+	}
+	return &Identity{
+		Platform: strings.ToLower(platform),
+		Value:    value,
+	}, nil
+}
+
+// User returns the user the identity refers to, as far as the platform is known
+func (i *Identity) User() string {
+	for _, key := range []string{"user_id", "username", "uid"} {
+		if user, ok := i.Value[key].(string); ok && len(user) > 0 {
+			return user
+		}
+	}
+	return "unknown"
+}
+
+// String returns the identity in the form "<platform>/<user>"
+func (i *Identity) String() string {
+	if i == nil {
+		return "anonymous"
+	}
+	return fmt.Sprintf("%s/%s", i.Platform, i.User())
+}
+
+// NewContext returns a copy of ctx carrying the identity
+func NewContext(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// FromContext returns the identity carried by ctx, or nil if there is none
+func FromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(contextKey{}).(*Identity)
+	return identity
+}
@@ -0,0 +1,43 @@
+package identity
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	encode := func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{"cloudfoundry", "cloudfoundry " + encode(`{"user_id":"683ea748-3092-4ff4-b656-39cacc4d5360"}`), "cloudfoundry/683ea748-3092-4ff4-b656-39cacc4d5360", false},
+		{"kubernetes", "Kubernetes " + encode(`{"username":"alice","uid":"1000"}`), "kubernetes/alice", false},
+		{"unknown user", "kubernetes " + encode(`{"groups":["admin"]}`), "kubernetes/unknown", false},
+		{"surrounding whitespace", "  kubernetes   " + encode(`{"uid":"1000"}`) + " ", "kubernetes/1000", false},
+		{"no value", "kubernetes", "", true},
+		{"not base64", "kubernetes not-base64", "", true},
+		{"not an object", "kubernetes " + encode(`["alice"]`), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := Parse(tt.header)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if identity.String() != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, identity.String())
+			}
+		})
+	}
+}
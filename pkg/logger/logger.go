@@ -1,78 +1,170 @@
 package logger
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"strings"
 
 	"github.com/cnpg-broker/pkg/config"
 )
 
-type Level int
-
-const (
-	DEBUG Level = iota
-	INFO
-	WARN
-	ERROR
-	FATAL
-)
+// LevelFatal is logged right before the process exits
+const LevelFatal = slog.Level(12)
 
 var (
-	logger       *log.Logger
-	currentLevel Level
+	logger = newLogger(os.Stdout, "text", false)
+	level  = new(slog.LevelVar)
 )
 
-func init() {
-	logger = log.New(os.Stdout, "", log.LstdFlags)
-}
+type contextKey struct{}
 
+// Init configures level, format and timestamps of the logger from the broker config
 func Init() {
 	cfg := config.Get()
-	currentLevel = parseLevel(cfg.LogLevel)
+	level.Set(parseLevel(cfg.LogLevel))
+	logger = newLogger(os.Stdout, cfg.LogFormat, cfg.LogTimestamp)
+}
+
+func newLogger(w io.Writer, format string, timestamp bool) *slog.Logger {
+	options := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.TimeKey:
+				// don't show timestamp unless specifically configured
+				if !timestamp {
+					return slog.Attr{}
+				}
+			case slog.LevelKey:
+				if l, ok := a.Value.Any().(slog.Level); ok && l == LevelFatal {
+					a.Value = slog.StringValue("FATAL")
+				}
+			}
+			return a
+		},
+	}
+	if strings.ToLower(format) == "json" {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
 }
 
-func parseLevel(level string) Level {
-	switch strings.ToLower(level) {
+func parseLevel(l string) slog.Level {
+	switch strings.ToLower(l) {
 	case "debug":
-		return DEBUG
+		return slog.LevelDebug
 	case "info":
-		return INFO
+		return slog.LevelInfo
 	case "warn", "warning":
-		return WARN
+		return slog.LevelWarn
 	case "error":
-		return ERROR
+		return slog.LevelError
 	case "fatal":
-		return FATAL
+		return LevelFatal
 	default:
-		return INFO
+		return slog.LevelInfo
 	}
 }
 
-func Debug(format string, v ...interface{}) {
-	if currentLevel <= DEBUG {
-		logger.Printf("[DEBUG] "+format, v...)
+// With returns a copy of ctx carrying the given key-value pairs, which are added to every line
+// logged with it, e.g. logger.With(ctx, "instance_id", instanceId)
+func With(ctx context.Context, args ...any) context.Context {
+	attrs := append([]slog.Attr{}, attrsFromContext(ctx)...)
+	for len(args) > 0 {
+		var attr slog.Attr
+		attr, args = argsToAttr(args)
+		attrs = replaceAttr(attrs, attr)
 	}
+	return context.WithValue(ctx, contextKey{}, attrs)
 }
 
-func Info(format string, v ...interface{}) {
-	if currentLevel <= INFO {
-		logger.Printf("[INFO] "+format, v...)
+func attrsFromContext(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(contextKey{}).([]slog.Attr)
+	return attrs
+}
+
+// replaceAttr sets attr in attrs, replacing an existing attribute with the same key
+func replaceAttr(attrs []slog.Attr, attr slog.Attr) []slog.Attr {
+	for i := range attrs {
+		if attrs[i].Key == attr.Key {
+			attrs[i] = attr
+			return attrs
+		}
 	}
+	return append(attrs, attr)
 }
 
-func Warn(format string, v ...interface{}) {
-	if currentLevel <= WARN {
-		logger.Printf("[WARN] "+format, v...)
+func argsToAttr(args []any) (slog.Attr, []any) {
+	switch key := args[0].(type) {
+	case slog.Attr:
+		return key, args[1:]
+	case string:
+		if len(args) == 1 {
+			return slog.String("!BADKEY", key), nil
+		}
+		return slog.Any(key, args[1]), args[2:]
+	default:
+		return slog.Any("!BADKEY", key), args[1:]
 	}
 }
 
-func Error(format string, v ...interface{}) {
-	if currentLevel <= ERROR {
-		logger.Printf("[ERROR] "+format, v...)
+func log(ctx context.Context, l slog.Level, msg string, attrs ...slog.Attr) {
+	if !logger.Enabled(ctx, l) {
+		return
 	}
+	logger.LogAttrs(ctx, l, msg, append(attrsFromContext(ctx), attrs...)...)
+}
+
+func logf(ctx context.Context, l slog.Level, format string, v ...interface{}) {
+	if !logger.Enabled(ctx, l) {
+		return
+	}
+	logger.LogAttrs(ctx, l, fmt.Sprintf(format, v...), attrsFromContext(ctx)...)
+}
+
+func Debug(format string, v ...interface{}) {
+	logf(context.Background(), slog.LevelDebug, format, v...)
+}
+
+func Info(format string, v ...interface{}) {
+	logf(context.Background(), slog.LevelInfo, format, v...)
+}
+
+func Warn(format string, v ...interface{}) {
+	logf(context.Background(), slog.LevelWarn, format, v...)
+}
+
+func Error(format string, v ...interface{}) {
+	logf(context.Background(), slog.LevelError, format, v...)
 }
 
 func Fatal(format string, v ...interface{}) {
-	logger.Fatalf("[FATAL] "+format, v...)
+	logf(context.Background(), LevelFatal, format, v...)
+	os.Exit(1)
+}
+
+// DebugContext logs with the attributes carried by ctx, see With
+func DebugContext(ctx context.Context, format string, v ...interface{}) {
+	logf(ctx, slog.LevelDebug, format, v...)
+}
+
+// InfoContext logs with the attributes carried by ctx, see With
+func InfoContext(ctx context.Context, format string, v ...interface{}) {
+	logf(ctx, slog.LevelInfo, format, v...)
+}
+
+// WarnContext logs with the attributes carried by ctx, see With
+func WarnContext(ctx context.Context, format string, v ...interface{}) {
+	logf(ctx, slog.LevelWarn, format, v...)
+}
+
+// ErrorContext logs with the attributes carried by ctx, see With
+func ErrorContext(ctx context.Context, format string, v ...interface{}) {
+	logf(ctx, slog.LevelError, format, v...)
 }
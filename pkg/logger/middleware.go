@@ -0,0 +1,72 @@
+package logger
+
+import (
+	"log/slog"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// RequestID accepts the X-Request-ID of a request or generates one, echoes it in the response
+// and adds it as request_id to the request context
+func RequestID() echo.MiddlewareFunc {
+	return middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		RequestIDHandler: func(c echo.Context, id string) {
+			c.SetRequest(c.Request().WithContext(With(c.Request().Context(), "request_id", id)))
+		},
+	})
+}
+
+// RouteParams adds the given path parameters of a request, if present, to the request context
+func RouteParams(names ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			args := make([]any, 0, 2*len(names))
+			for _, name := range names {
+				if value := c.Param(name); len(value) > 0 {
+					args = append(args, name, value)
+				}
+			}
+			if len(args) > 0 {
+				c.SetRequest(c.Request().WithContext(With(c.Request().Context(), args...)))
+			}
+			return next(c)
+		}
+	}
+}
+
+// AccessLog logs every request once it has been handled, along with the attributes its handlers
+// added to the request context
+func AccessLog() echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogRemoteIP:     true,
+		LogHost:         true,
+		LogMethod:       true,
+		LogURI:          true,
+		LogUserAgent:    true,
+		LogStatus:       true,
+		LogError:        true,
+		LogLatency:      true,
+		LogResponseSize: true,
+		HandleError:     true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			attrs := []slog.Attr{
+				slog.String("remote_ip", v.RemoteIP),
+				slog.String("host", v.Host),
+				slog.String("method", v.Method),
+				slog.String("uri", v.URI),
+				slog.String("user_agent", v.UserAgent),
+				slog.Int("status", v.Status),
+				slog.Duration("latency", v.Latency),
+				slog.Int64("bytes_out", v.ResponseSize),
+			}
+			l := slog.LevelInfo
+			if v.Error != nil {
+				attrs = append(attrs, slog.String("error", v.Error.Error()))
+				l = slog.LevelError
+			}
+			log(c.Request().Context(), l, "request handled", attrs...)
+			return nil
+		},
+	})
+}
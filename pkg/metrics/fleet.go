@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/cnpg-broker/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fleetTimeout bounds how long a scrape waits for the fleet state
+const fleetTimeout = 10 * time.Second
+
+// FleetInstance is the state of a service instance as exposed by the fleet metrics
+type FleetInstance struct {
+	InstanceID     string
+	ServiceID      string
+	PlanID         string
+	Phase          string
+	Instances      int64
+	ReadyInstances int64
+	Failed         bool
+	Provisioning   bool
+	CreatedAt      time.Time
+	Bindings       int
+	// PendingLoadBalancers is the number of LoadBalancer services still waiting for an ingress address
+	PendingLoadBalancers int
+}
+
+// FleetLister lists the state of all service instances, it is called on every scrape
+type FleetLister interface {
+	FleetInstances(ctx context.Context) ([]FleetInstance, error)
+}
+
+var (
+	instancesDesc = prometheus.NewDesc(namespace+"_instances",
+		"Number of service instances by service, plan and cluster phase.",
+		[]string{"service_id", "plan_id", "phase"}, nil)
+	clusterInstancesDesc = prometheus.NewDesc(namespace+"_cluster_instances",
+		"Number of PostgreSQL instances of a cluster.",
+		[]string{"instance_id", "plan_id"}, nil)
+	clusterReadyInstancesDesc = prometheus.NewDesc(namespace+"_cluster_ready_instances",
+		"Number of ready PostgreSQL instances of a cluster.",
+		[]string{"instance_id", "plan_id"}, nil)
+	clusterFailedDesc = prometheus.NewDesc(namespace+"_cluster_failed",
+		"Whether the cluster of a service instance is in a failed phase.",
+		[]string{"instance_id", "plan_id"}, nil)
+	clusterProvisioningDesc = prometheus.NewDesc(namespace+"_cluster_provisioning_seconds",
+		"Time since creation of clusters that are not ready yet, e.g. to alert on instances stuck provisioning.",
+		[]string{"instance_id", "plan_id"}, nil)
+	bindingsDesc = prometheus.NewDesc(namespace+"_bindings",
+		"Number of service bindings of a service instance.",
+		[]string{"instance_id"}, nil)
+	pendingLoadBalancersDesc = prometheus.NewDesc(namespace+"_loadbalancer_services_pending",
+		"Number of LoadBalancer services of a service instance without ingress address.",
+		[]string{"instance_id"}, nil)
+	fleetErrorsDesc = prometheus.NewDesc(namespace+"_fleet_scrape_error",
+		"Whether listing the fleet state failed on the last scrape.",
+		nil, nil)
+)
+
+// fleetCollector computes the fleet gauges from the cluster listing on every scrape
+type fleetCollector struct {
+	lister FleetLister
+}
+
+func (f *fleetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- instancesDesc
+	ch <- clusterInstancesDesc
+	ch <- clusterReadyInstancesDesc
+	ch <- clusterFailedDesc
+	ch <- clusterProvisioningDesc
+	ch <- bindingsDesc
+	ch <- pendingLoadBalancersDesc
+	ch <- fleetErrorsDesc
+}
+
+func (f *fleetCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), fleetTimeout)
+	defer cancel()
+
+	fleet, err := f.lister.FleetInstances(ctx)
+	if err != nil {
+		logger.Error("failed to list fleet for metrics: %v", err)
+		ch <- prometheus.MustNewConstMetric(fleetErrorsDesc, prometheus.GaugeValue, 1)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(fleetErrorsDesc, prometheus.GaugeValue, 0)
+
+	type planPhase struct{ serviceId, planId, phase string }
+	counts := make(map[planPhase]int)
+	for _, instance := range fleet {
+		counts[planPhase{instance.ServiceID, instance.PlanID, instance.Phase}]++
+
+		ch <- prometheus.MustNewConstMetric(clusterInstancesDesc, prometheus.GaugeValue,
+			float64(instance.Instances), instance.InstanceID, instance.PlanID)
+		ch <- prometheus.MustNewConstMetric(clusterReadyInstancesDesc, prometheus.GaugeValue,
+			float64(instance.ReadyInstances), instance.InstanceID, instance.PlanID)
+		ch <- prometheus.MustNewConstMetric(clusterFailedDesc, prometheus.GaugeValue,
+			boolValue(instance.Failed), instance.InstanceID, instance.PlanID)
+		if instance.Provisioning && !instance.CreatedAt.IsZero() {
+			ch <- prometheus.MustNewConstMetric(clusterProvisioningDesc, prometheus.GaugeValue,
+				time.Since(instance.CreatedAt).Seconds(), instance.InstanceID, instance.PlanID)
+		}
+		ch <- prometheus.MustNewConstMetric(bindingsDesc, prometheus.GaugeValue,
+			float64(instance.Bindings), instance.InstanceID)
+		ch <- prometheus.MustNewConstMetric(pendingLoadBalancersDesc, prometheus.GaugeValue,
+			float64(instance.PendingLoadBalancers), instance.InstanceID)
+	}
+	for key, count := range counts {
+		ch <- prometheus.MustNewConstMetric(instancesDesc, prometheus.GaugeValue,
+			float64(count), key.serviceId, key.planId, key.phase)
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -2,12 +2,23 @@ package metrics
 
 import (
 	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Handler struct{}
 
-func New() *Handler {
+// Backend provides the fleet state and the orphan counts
+type Backend interface {
+	FleetLister
+	OrphanCounter
+}
+
+// New registers the Kubernetes request metrics, and the fleet and orphan gauges computed from backend
+func New(backend Backend) *Handler {
+	registerKubernetesMetrics()
+	prometheus.MustRegister(&fleetCollector{lister: backend})
+	prometheus.MustRegister(&orphanCollector{counter: backend})
 	return &Handler{}
 }
 
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cnpg-broker/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// orphansTTL is how long the orphan counts are reused, finding orphans lists volumes cluster-wide
+const orphansTTL = time.Minute
+
+// OrphanCounter counts the orphaned objects per category
+type OrphanCounter interface {
+	OrphanCounts(ctx context.Context) (map[string]int, error)
+}
+
+var orphansDesc = prometheus.NewDesc(namespace+"_orphans",
+	"Number of orphaned objects and inconsistencies between instances and the cluster by category.",
+	[]string{"category"}, nil)
+
+// orphanCollector exposes the orphan counts, which are computed at most every orphansTTL
+type orphanCollector struct {
+	counter OrphanCounter
+
+	mu      sync.Mutex
+	counted time.Time
+	counts  map[string]int
+}
+
+func (o *orphanCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- orphansDesc
+}
+
+func (o *orphanCollector) Collect(ch chan<- prometheus.Metric) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if time.Since(o.counted) >= orphansTTL {
+		ctx, cancel := context.WithTimeout(context.Background(), fleetTimeout)
+		defer cancel()
+		counts, err := o.counter.OrphanCounts(ctx)
+		if err != nil {
+			logger.Error("failed to count orphans for metrics: %v", err)
+			return
+		}
+		o.counts, o.counted = counts, time.Now()
+	}
+	for category, count := range o.counts {
+		ch <- prometheus.MustNewConstMetric(orphansDesc, prometheus.GaugeValue, float64(count), category)
+	}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	reconcileInstances = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_instances_total",
+		Help:      "Number of instance reconciliations by result, one of unchanged, repaired, skipped and failed.",
+	}, []string{"result"})
+
+	reconcileChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_changes_total",
+		Help:      "Number of objects created or updated by the reconciler by kind and action.",
+	}, []string{"kind", "action"})
+
+	reconcileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of a reconciliation of all instances.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+
+	reconcileLastRun = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reconcile_last_run_timestamp_seconds",
+		Help:      "Time the last reconciliation of all instances finished.",
+	})
+
+	reconcileLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reconcile_leader",
+		Help:      "Whether this replica holds the reconciler lease.",
+	})
+)
+
+// ReconciledInstance counts the reconciliation of an instance
+func ReconciledInstance(result string) {
+	reconcileInstances.WithLabelValues(result).Inc()
+}
+
+// ReconcileChange counts an object changed by the reconciler
+func ReconcileChange(kind, action string) {
+	reconcileChanges.WithLabelValues(kind, action).Inc()
+}
+
+// ReconcileRun records a finished reconciliation of all instances
+func ReconcileRun(duration time.Duration) {
+	reconcileDuration.Observe(duration.Seconds())
+	reconcileLastRun.SetToCurrentTime()
+}
+
+// ReconcileLeader records whether this replica is leading the reconciler
+func ReconcileLeader(leading bool) {
+	reconcileLeader.Set(boolValue(leading))
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	k8smetrics "k8s.io/client-go/tools/metrics"
+)
+
+const namespace = "cnpg_broker"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of handled broker API requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of broker API requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	kubernetesRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kubernetes_requests_total",
+		Help:      "Number of Kubernetes API requests by verb and status code.",
+	}, []string{"verb", "code"})
+
+	kubernetesRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "kubernetes_request_duration_seconds",
+		Help:      "Latency of Kubernetes API requests by verb and resource.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"verb", "resource"})
+)
+
+// Middleware counts and times every request by its route, e.g. /v2/service_instances/:instance_id
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+
+			status := c.Response().Status
+			if httpErr, ok := err.(*echo.HTTPError); ok {
+				status = httpErr.Code
+			}
+			route, method := c.Path(), c.Request().Method
+			httpRequests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+			httpRequestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
+
+// registerKubernetesMetrics hooks into the request metrics of client-go, covering the typed and the dynamic client
+func registerKubernetesMetrics() {
+	k8smetrics.Register(k8smetrics.RegisterOpts{
+		RequestLatency: kubernetesLatency{},
+		RequestResult:  kubernetesResult{},
+	})
+}
+
+type kubernetesLatency struct{}
+
+func (kubernetesLatency) Observe(_ context.Context, verb string, u url.URL, latency time.Duration) {
+	kubernetesRequestDuration.WithLabelValues(verb, resourceFromPath(u.Path)).Observe(latency.Seconds())
+}
+
+type kubernetesResult struct{}
+
+func (kubernetesResult) Increment(_ context.Context, code, method, _ string) {
+	kubernetesRequests.WithLabelValues(method, code).Inc()
+}
+
+// resourceFromPath returns the resource of a Kubernetes API path, e.g. secrets for
+// /api/v1/namespaces/x/secrets/y and clusters for /apis/postgresql.cnpg.io/v1/namespaces/x/clusters
+func resourceFromPath(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(segments) >= 3 && segments[0] == "api":
+		segments = segments[2:]
+	case len(segments) >= 4 && segments[0] == "apis":
+		segments = segments[3:]
+	default:
+		return "unknown"
+	}
+	// namespaced resources other than namespaces themselves
+	if len(segments) >= 3 && segments[0] == "namespaces" {
+		segments = segments[2:]
+	}
+	return segments[0]
+}
@@ -0,0 +1,24 @@
+package metrics
+
+import "testing"
+
+func TestResourceFromPath(t *testing.T) {
+	tests := map[string]string{
+		"/api/v1/namespaces/x/secrets/y":                             "secrets",
+		"/api/v1/namespaces/x/secrets":                               "secrets",
+		"/api/v1/namespaces/x":                                       "namespaces",
+		"/api/v1/namespaces":                                         "namespaces",
+		"/api/v1/nodes":                                              "nodes",
+		"/apis/postgresql.cnpg.io/v1/namespaces/x/clusters":          "clusters",
+		"/apis/postgresql.cnpg.io/v1/namespaces/x/clusters/y/status": "clusters",
+		"/apis/postgresql.cnpg.io/v1/clusters":                       "clusters",
+		"/api/v1":                                                    "unknown",
+		"/apis/postgresql.cnpg.io/v1":                                "unknown",
+		"/healthz":                                                   "unknown",
+	}
+	for path, want := range tests {
+		if resource := resourceFromPath(path); resource != want {
+			t.Errorf("expected %s for %s, got %s", want, path, resource)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cnpg-broker/pkg/cnpg"
+	"github.com/cnpg-broker/pkg/config"
+	"github.com/cnpg-broker/pkg/logger"
+	"github.com/cnpg-broker/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// instanceTimeout bounds the reconciliation of a single instance
+const instanceTimeout = time.Minute
+
+// Reconciler periodically applies the desired state of every instance, re-creating missing objects,
+// repairing drifted ones and finishing interrupted provisions. Only the replica holding the Lease runs it.
+type Reconciler struct {
+	client   *cnpg.Client
+	interval time.Duration
+	identity string
+}
+
+func New(client *cnpg.Client) *Reconciler {
+	identity, err := os.Hostname()
+	if err != nil {
+		identity = fmt.Sprintf("cnpg-broker-%d", os.Getpid())
+	}
+	return &Reconciler{
+		client:   client,
+		interval: config.Get().Reconciler.Interval,
+		identity: identity,
+	}
+}
+
+// Run takes part in the leader election and reconciles all instances while leading, until ctx is done
+func (r *Reconciler) Run(ctx context.Context) {
+	cfg := config.Get().Reconciler
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: cfg.LeaseNamespace,
+			Name:      cfg.LeaseName,
+		},
+		Client:     r.client.Clientset().CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: r.identity},
+	}
+	// a lost lease ends RunOrDie, so keep campaigning for it until ctx is done
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   30 * time.Second,
+			RenewDeadline:   20 * time.Second,
+			RetryPeriod:     5 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					logger.Info("leading the reconciler as %s, reconciling every %s", r.identity, r.interval)
+					metrics.ReconcileLeader(true)
+					r.loop(ctx)
+				},
+				OnStoppedLeading: func() {
+					logger.Info("stopped leading the reconciler")
+					metrics.ReconcileLeader(false)
+				},
+				OnNewLeader: func(identity string) {
+					if identity != r.identity {
+						logger.Info("reconciler is led by %s", identity)
+					}
+				},
+			},
+		})
+	}
+}
+
+func (r *Reconciler) loop(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.ReconcileAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReconcileAll reconciles every instance once, failures are logged and reported as Events
+func (r *Reconciler) ReconcileAll(ctx context.Context) {
+	start := time.Now()
+	instances, err := r.client.ListInstances(ctx)
+	if err != nil {
+		logger.Error("failed to list instances to reconcile: %v", err)
+		return
+	}
+	var repaired, failed int
+	for _, instanceId := range instances {
+		if ctx.Err() != nil {
+			return
+		}
+		switch r.reconcile(ctx, instanceId) {
+		case "repaired":
+			repaired++
+		case "failed":
+			failed++
+		}
+	}
+	metrics.ReconcileRun(time.Since(start))
+	logger.Info("reconciled %d instance(s) in %s, %d repaired, %d failed", len(instances), time.Since(start).Round(time.Millisecond), repaired, failed)
+}
+
+// reconcile reconciles an instance and returns the result reported in the metrics
+func (r *Reconciler) reconcile(ctx context.Context, instanceId string) string {
+	ctx, cancel := context.WithTimeout(ctx, instanceTimeout)
+	defer cancel()
+
+	result, err := r.client.ReconcileInstance(ctx, instanceId)
+	if result != nil {
+		for _, change := range result.Changes {
+			metrics.ReconcileChange(change.Kind, change.Action)
+			logger.WarnContext(ctx, "reconciler %s %s %s of instance %s", change.Action, change.Kind, change.Name, instanceId)
+			r.event(ctx, instanceId, corev1.ObjectReference{
+				APIVersion: change.APIVersion,
+				Kind:       change.Kind,
+				Namespace:  change.Namespace,
+				Name:       change.Name,
+			}, corev1.EventTypeNormal, reason(change), message(change))
+		}
+	}
+
+	switch {
+	case errors.Is(err, cnpg.ErrNoDesiredState):
+		logger.DebugContext(ctx, "not reconciling instance %s: %v", instanceId, err)
+		metrics.ReconciledInstance("skipped")
+		return "skipped"
+	case err != nil:
+		logger.ErrorContext(ctx, "failed to reconcile instance %s: %v", instanceId, err)
+		metrics.ReconciledInstance("failed")
+		r.event(ctx, instanceId, corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Name: instanceId},
+			corev1.EventTypeWarning, "ReconcileFailed", err.Error())
+		return "failed"
+	case len(result.Skipped) > 0:
+		logger.DebugContext(ctx, "not reconciling instance %s: %s", instanceId, result.Skipped)
+		metrics.ReconciledInstance("skipped")
+		return "skipped"
+	case len(result.Changes) > 0:
+		metrics.ReconciledInstance("repaired")
+		return "repaired"
+	default:
+		metrics.ReconciledInstance("unchanged")
+		return "unchanged"
+	}
+}
+
+func reason(change cnpg.Change) string {
+	if change.Action == cnpg.ChangeCreated {
+		return "ObjectRecreated"
+	}
+	return "DriftRepaired"
+}
+
+func message(change cnpg.Change) string {
+	if change.Action == cnpg.ChangeCreated {
+		return fmt.Sprintf("%s %s was missing and has been created", change.Kind, change.Name)
+	}
+	return fmt.Sprintf("%s %s had drifted from the plan of the instance and has been updated", change.Kind, change.Name)
+}
+
+// event records an Event in the namespace of the instance, failures are only logged
+func (r *Reconciler) event(ctx context.Context, instanceId string, object corev1.ObjectReference, eventType, reason, message string) {
+	now := time.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "cnpg-broker-reconciler-",
+			Namespace:    instanceId,
+			Labels: map[string]string{
+				"cnpg-broker.io/instance-id": instanceId,
+			},
+		},
+		InvolvedObject:      object,
+		Reason:              reason,
+		Message:             message,
+		Type:                eventType,
+		Source:              corev1.EventSource{Component: "cnpg-broker"},
+		ReportingController: "cnpg-broker.io/reconciler",
+		ReportingInstance:   r.identity,
+		Action:              "Reconcile",
+		FirstTimestamp:      metav1.NewTime(now),
+		LastTimestamp:       metav1.NewTime(now),
+		EventTime:           metav1.NewMicroTime(now.Truncate(time.Microsecond)),
+		Count:               1,
+	}
+	if _, err := r.client.Clientset().CoreV1().Events(instanceId).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		logger.WarnContext(ctx, "failed to record reconciler event for instance %s: %v", instanceId, err)
+	}
+}
@@ -1,11 +1,21 @@
 package router
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/cnpg-broker/pkg/audit"
 	"github.com/cnpg-broker/pkg/broker"
+	"github.com/cnpg-broker/pkg/catalog"
+	"github.com/cnpg-broker/pkg/cnpg"
+	"github.com/cnpg-broker/pkg/config"
 	"github.com/cnpg-broker/pkg/health"
+	"github.com/cnpg-broker/pkg/logger"
 	"github.com/cnpg-broker/pkg/metrics"
+	"github.com/cnpg-broker/pkg/reconciler"
 	"github.com/cnpg-broker/pkg/ui"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -17,6 +27,7 @@ type Router struct {
 	metrics *metrics.Handler
 	broker  *broker.Handler
 	ui      *ui.Handler
+	auditor *audit.Auditor
 }
 
 func New() *Router {
@@ -29,16 +40,33 @@ func New() *Router {
 	// middlewares
 	e.Pre(middleware.RemoveTrailingSlash())
 	e.Use(middleware.Secure())
+	e.Use(logger.RequestID())
 	// e.Use(middleware.Recover()) // don't recover, let platform deal with panics
 	e.Use(middleware.Static("static"))
 
+	// shared k8s client, with informer cache if enabled
+	client, err := cnpg.NewClient()
+	if err != nil {
+		logger.Fatal("failed to create k8s client: %v", err)
+	}
+	loadCatalog(client)
+	checkPermissions(client)
+	if cfg := config.Get(); cfg.Cache.Enabled {
+		client.StartCache(context.Background(), cfg.Cache.ResyncInterval)
+	}
+	if config.Get().Reconciler.Enabled {
+		go reconciler.New(client).Run(context.Background())
+	}
+
 	// setup router
+	auditor := newAuditor(client)
 	r := &Router{
 		echo:    e,
-		health:  health.New(),
-		metrics: metrics.New(),
-		broker:  broker.New(),
-		ui:      ui.New(),
+		health:  health.New(client),
+		metrics: metrics.New(client),
+		broker:  broker.New(client, auditor),
+		ui:      ui.New(client),
+		auditor: auditor,
 	}
 
 	// setup health route
@@ -61,3 +89,94 @@ func New() *Router {
 func (r *Router) Start(port int) error {
 	return r.echo.Start(fmt.Sprintf(":%d", port))
 }
+
+// Shutdown stops accepting requests, waits for those in flight and writes their queued audit entries to the sinks
+func (r *Router) Shutdown(ctx context.Context) error {
+	err := r.echo.Shutdown(ctx)
+	r.auditor.Close()
+	return err
+}
+
+// loadCatalog loads the catalog from the configured file or ConfigMap and keeps reloading it when it changes
+func loadCatalog(client *cnpg.Client) {
+	cfg := config.Get().Catalog
+	var source catalog.Source = &catalog.FileSource{Path: cfg.Path, Interval: cfg.PollInterval}
+	if len(cfg.ConfigMap) > 0 {
+		namespace, name, found := strings.Cut(cfg.ConfigMap, "/")
+		if !found {
+			logger.Fatal("invalid catalog ConfigMap [%s], expected namespace/name", cfg.ConfigMap)
+		}
+		source = &catalog.ConfigMapSource{Clientset: client.Clientset(), Namespace: namespace, Name: name, Key: cfg.Key}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	data, err := source.Read(ctx)
+	if err != nil {
+		logger.Fatal("failed to load catalog: %v", err)
+	}
+	if _, err := catalog.Update(ctx, data, source.String(), client.PlanUsage); err != nil {
+		logger.Fatal("failed to load catalog: %v", err)
+	}
+	go catalog.Watch(context.Background(), source, client.PlanUsage)
+}
+
+// checkPermissions reviews the RBAC permissions needed by the enabled features, missing ones are
+// reported as a table and are fatal in strict mode
+func checkPermissions(client *cnpg.Client) {
+	strict := config.Get().RBACStrict
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	results, err := client.CheckPermissions(ctx, cnpg.RequiredPermissions())
+	if err != nil {
+		if strict {
+			logger.Fatal("failed to check permissions: %v", err)
+		}
+		logger.Error("failed to check permissions: %v", err)
+		return
+	}
+	missing := cnpg.MissingPermissions(results)
+	if len(missing) == 0 {
+		logger.Info("all %d required permissions are granted", len(results))
+		return
+	}
+
+	_ = cnpg.WritePermissions(os.Stderr, missing)
+	if strict {
+		logger.Fatal("missing %d of %d required permissions", len(missing), len(results))
+	}
+	logger.Warn("missing %d of %d required permissions, features listed above will fail", len(missing), len(results))
+}
+
+// newAuditor creates the auditor writing to the configured audit sinks
+func newAuditor(client *cnpg.Client) *audit.Auditor {
+	cfg := config.Get()
+	sinks := make([]audit.Sink, 0, len(cfg.Audit.Sinks))
+	for _, name := range cfg.Audit.Sinks {
+		switch name {
+		case "stdout":
+			sinks = append(sinks, audit.NewWriterSink(os.Stdout))
+		case "file":
+			sink, err := audit.NewFileSink(cfg.Audit.File)
+			if err != nil {
+				logger.Fatal("failed to create audit sink: %v", err)
+			}
+			sinks = append(sinks, sink)
+		case "event":
+			sinks = append(sinks, audit.NewEventSink(client.Clientset()))
+		default:
+			logger.Fatal("unknown audit sink [%s], expected stdout, file or event", name)
+		}
+	}
+	logger.Info("writing audit entries to %v", cfg.Audit.Sinks)
+	if len(cfg.Audit.HMACKey) == 0 {
+		logger.Warn("BROKER_AUDIT_HMAC_KEY is not set, the audit hash chain can be recomputed after altering entries")
+	}
+
+	auditor := audit.New([]byte(cfg.Audit.HMACKey), sinks...)
+	if err := auditor.VerifySinks(); err != nil {
+		logger.Error("audit log failed verification: %v", err)
+	}
+	return auditor
+}
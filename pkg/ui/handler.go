@@ -1,7 +1,6 @@
 package ui
 
 import (
-	"context"
 	"crypto/subtle"
 	"errors"
 	"net/http"
@@ -14,12 +13,11 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 )
 
-type Handler struct{
-	client *cnpg.Client
+type Handler struct {
+	client cnpg.ClusterBackend
 }
 
 type Page struct {
-
 	Title    string
 	Clusters []cnpg.ClusterInfo
 	Error    struct {
@@ -29,9 +27,9 @@ type Page struct {
 	}
 }
 
-func New() *Handler {
+func New(client cnpg.ClusterBackend) *Handler {
 	return &Handler{
-		client: cnpg.NewClient(),
+		client: client,
 	}
 }
 
@@ -39,16 +37,8 @@ func (h *Handler) RegisterRoutes(e *echo.Echo) {
 	g := e.Group("")
 	cfg := config.Get()
 
-	// don't show timestamp unless specifically configured
-	format := `remote_ip="${remote_ip}", host="${host}", method=${method}, uri=${uri}, user_agent="${user_agent}", ` +
-		`status=${status}, error="${error}", latency_human="${latency_human}", bytes_out=${bytes_out}` + "\n"
-	if cfg.LogTimestamp {
-		format = `time="${time_rfc3339}", ` + format
-	}
 	// add logger middleware
-	g.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-		Format: format,
-	}))
+	g.Use(logger.AccessLog())
 
 	// add auth middleware
 	if cfg.Username != "" && cfg.Password != "" {
@@ -63,6 +53,7 @@ func (h *Handler) RegisterRoutes(e *echo.Echo) {
 
 	g.GET("/", h.IndexHandler)
 	g.GET("/json", h.JSONDataHandler)
+	g.GET("/orphans", h.OrphansHandler)
 
 	e.HTTPErrorHandler = h.ErrorHandler
 }
@@ -85,7 +76,7 @@ func (h *Handler) ErrorHandler(err error, c echo.Context) {
 	page.Error.Message = message
 	page.Error.Time = time.Now()
 
-	logger.Error("%v", err)
+	logger.ErrorContext(c.Request().Context(), "%v", err)
 	_ = c.Render(code, "error.html", page)
 }
 
@@ -106,9 +97,9 @@ func (h *Handler) IndexHandler(c echo.Context) error {
 }
 
 func (h *Handler) JSONDataHandler(c echo.Context) error {
-	clusters, err := h.client.ListClusters(context.Background())
+	clusters, err := h.client.ListClusters(c.Request().Context())
 	if err != nil {
-		logger.Error("failed to list clusters: %v", err)
+		logger.ErrorContext(c.Request().Context(), "failed to list clusters: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": err.Error(),
 		})
@@ -116,3 +107,7 @@ func (h *Handler) JSONDataHandler(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, clusters)
 }
+
+func (h *Handler) OrphansHandler(c echo.Context) error {
+	return c.Render(http.StatusOK, "orphans.html", h.newPage("Orphans"))
+}
@@ -0,0 +1,79 @@
+package validation
+
+import (
+	"sort"
+	"strings"
+)
+
+// tunableParameters are the PostgreSQL settings instances can set through postgresql_parameters.
+// Settings the operator manages (port, ssl_*, archive_command, shared_preload_libraries, ...) and
+// settings bound to the resources of the plan (shared_buffers, max_connections, ...) are left out.
+var tunableParameters = map[string]bool{
+	// memory and planner
+	"work_mem":                         true,
+	"maintenance_work_mem":             true,
+	"hash_mem_multiplier":              true,
+	"effective_cache_size":             true,
+	"random_page_cost":                 true,
+	"seq_page_cost":                    true,
+	"effective_io_concurrency":         true,
+	"default_statistics_target":        true,
+	"jit":                              true,
+	"max_parallel_workers_per_gather":  true,
+	"max_parallel_maintenance_workers": true,
+	"temp_file_limit":                  true,
+	// write ahead log and checkpoints
+	"checkpoint_timeout":           true,
+	"checkpoint_completion_target": true,
+	"max_wal_size":                 true,
+	"min_wal_size":                 true,
+	"wal_compression":              true,
+	// vacuum
+	"autovacuum_naptime":                    true,
+	"autovacuum_vacuum_scale_factor":        true,
+	"autovacuum_vacuum_threshold":           true,
+	"autovacuum_vacuum_insert_scale_factor": true,
+	"autovacuum_vacuum_insert_threshold":    true,
+	"autovacuum_analyze_scale_factor":       true,
+	"autovacuum_analyze_threshold":          true,
+	"autovacuum_vacuum_cost_delay":          true,
+	"autovacuum_vacuum_cost_limit":          true,
+	"vacuum_cost_delay":                     true,
+	"vacuum_cost_limit":                     true,
+	// sessions and locale
+	"statement_timeout":                   true,
+	"lock_timeout":                        true,
+	"idle_in_transaction_session_timeout": true,
+	"idle_session_timeout":                true,
+	"deadlock_timeout":                    true,
+	"default_transaction_isolation":       true,
+	"datestyle":                           true,
+	"intervalstyle":                       true,
+	"lc_monetary":                         true,
+	"lc_numeric":                          true,
+	"lc_time":                             true,
+	"default_text_search_config":          true,
+	// logging and statistics
+	"log_min_duration_statement":  true,
+	"log_statement":               true,
+	"log_lock_waits":              true,
+	"log_temp_files":              true,
+	"log_autovacuum_min_duration": true,
+	"track_io_timing":             true,
+	"track_activity_query_size":   true,
+}
+
+// ValidatePostgresqlParameters checks that postgresql_parameters only sets tunable PostgreSQL settings
+func ValidatePostgresqlParameters(params map[string]string) []*ValidationError {
+	var errs []*ValidationError
+	for key := range params {
+		if !tunableParameters[strings.ToLower(key)] {
+			errs = append(errs, &ValidationError{
+				Field:   "parameters.postgresql_parameters." + key,
+				Message: "is not a tunable parameter",
+			})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
@@ -0,0 +1,36 @@
+package validation
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidatePostgresqlParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		wantFields []string
+	}{
+		{"none", nil, nil},
+		{"tunable", map[string]string{"work_mem": "8MB", "Statement_Timeout": "30s"}, nil},
+		{"managed by the operator", map[string]string{"port": "5433", "ssl_min_protocol_version": "TLSv1", "archive_command": "true"}, []string{
+			"parameters.postgresql_parameters.archive_command",
+			"parameters.postgresql_parameters.port",
+			"parameters.postgresql_parameters.ssl_min_protocol_version",
+		}},
+		{"bound to the plan", map[string]string{"shared_buffers": "4GB", "work_mem": "8MB"}, []string{
+			"parameters.postgresql_parameters.shared_buffers",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fields []string
+			for _, err := range ValidatePostgresqlParameters(tt.parameters) {
+				fields = append(fields, err.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("expected errors for %v, got %v", tt.wantFields, fields)
+			}
+		})
+	}
+}
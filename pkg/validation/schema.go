@@ -0,0 +1,199 @@
+package validation
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ValidateParameters validates OSB parameters against a JSON schema as published in the catalog.
+// Only the subset of JSON schema used by the catalog is supported: type, properties, required,
+// additionalProperties, enum, pattern, format (date-time), minLength/maxLength,
+// minimum/maximum, items, minItems/maxItems and uniqueItems.
+func ValidateParameters(schema map[string]any, parameters map[string]any) []*ValidationError {
+	if schema == nil {
+		if len(parameters) > 0 {
+			return []*ValidationError{{"parameters", "not supported by this plan"}}
+		}
+		return nil
+	}
+	if parameters == nil {
+		parameters = map[string]any{}
+	}
+
+	var errs []*ValidationError
+	validateValue(schema, parameters, "parameters", &errs)
+	return errs
+}
+
+func validateValue(schema map[string]any, value any, field string, errs *[]*ValidationError) {
+	addError := func(format string, v ...any) {
+		*errs = append(*errs, &ValidationError{field, fmt.Sprintf(format, v...)})
+	}
+
+	if typ, ok := schema["type"].(string); ok && !matchesType(typ, value) {
+		addError("must be of type %s", typ)
+		return
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if equalValues(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			allowed := make([]string, 0, len(enum))
+			for _, e := range enum {
+				allowed = append(allowed, fmt.Sprintf("%v", e))
+			}
+			addError("must be one of [%s]", strings.Join(allowed, ", "))
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		if minLength, ok := toFloat(schema["minLength"]); ok && float64(len(v)) < minLength {
+			addError("must be at least %v characters long", minLength)
+		}
+		if maxLength, ok := toFloat(schema["maxLength"]); ok && float64(len(v)) > maxLength {
+			addError("must be at most %v characters long", maxLength)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				addError("invalid pattern in schema: %v", err)
+			} else if !re.MatchString(v) {
+				addError("must match pattern %s", pattern)
+			}
+		}
+		if format, ok := schema["format"].(string); ok && format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				addError("must be a RFC3339 date-time")
+			}
+		}
+
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		if required, ok := schema["required"].([]any); ok {
+			for _, r := range required {
+				if name, ok := r.(string); ok {
+					if _, found := v[name]; !found {
+						*errs = append(*errs, &ValidationError{field + "." + name, "required"})
+					}
+				}
+			}
+		}
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if propSchema, ok := properties[key].(map[string]any); ok {
+				validateValue(propSchema, v[key], field+"."+key, errs)
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					*errs = append(*errs, &ValidationError{field + "." + key, "unknown parameter"})
+				}
+			case map[string]any:
+				validateValue(additional, v[key], field+"."+key, errs)
+			}
+		}
+
+	case []any:
+		if minItems, ok := toFloat(schema["minItems"]); ok && float64(len(v)) < minItems {
+			addError("must contain at least %v item(s)", minItems)
+		}
+		if maxItems, ok := toFloat(schema["maxItems"]); ok && float64(len(v)) > maxItems {
+			addError("must contain at most %v item(s)", maxItems)
+		}
+		if unique, ok := schema["uniqueItems"].(bool); ok && unique {
+		duplicates:
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if equalValues(v[i], v[j]) {
+						addError("must not contain duplicate items")
+						break duplicates
+					}
+				}
+			}
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				validateValue(items, item, fmt.Sprintf("%s[%d]", field, i), errs)
+			}
+		}
+
+	default:
+		if number, ok := toFloat(value); ok {
+			if minimum, ok := toFloat(schema["minimum"]); ok && number < minimum {
+				addError("must be greater than or equal to %v", minimum)
+			}
+			if maximum, ok := toFloat(schema["maximum"]); ok && number > maximum {
+				addError("must be less than or equal to %v", maximum)
+			}
+		}
+	}
+}
+
+func matchesType(typ string, value any) bool {
+	switch typ {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := toFloat(value)
+		return ok
+	case "integer":
+		number, ok := toFloat(value)
+		return ok && number == math.Trunc(number)
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+// toFloat converts the numeric types produced by encoding/json and yaml.v3 to float64
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func equalValues(a, b any) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,74 @@
+package validation
+
+import "testing"
+
+func TestValidateParameters(t *testing.T) {
+	schema := map[string]any{
+		"type":                 "object",
+		"additionalProperties": false,
+		"required":             []any{"postgres_version"},
+		"properties": map[string]any{
+			"postgres_version": map[string]any{"type": "string", "enum": []any{"16", "17"}},
+			"timezone":         map[string]any{"type": "string", "pattern": "^[A-Za-z_/]+$", "maxLength": 8},
+			"restore_point":    map[string]any{"type": "string", "format": "date-time"},
+			"max_connections":  map[string]any{"type": "integer", "minimum": 10, "maximum": 1000},
+			"extensions": map[string]any{
+				"type":        "array",
+				"maxItems":    2,
+				"uniqueItems": true,
+				"items":       map[string]any{"type": "string"},
+			},
+			"postgresql_parameters": map[string]any{
+				"type":                 "object",
+				"additionalProperties": map[string]any{"type": "string"},
+			},
+		},
+	}
+	tests := []struct {
+		name       string
+		parameters map[string]any
+		wantFields []string
+	}{
+		{"valid", map[string]any{
+			"postgres_version":      "17",
+			"timezone":              "UTC",
+			"restore_point":         "2026-01-02T03:04:05Z",
+			"max_connections":       float64(100),
+			"extensions":            []any{"pgvector", "postgis"},
+			"postgresql_parameters": map[string]any{"work_mem": "8MB"},
+		}, nil},
+		{"missing required", map[string]any{}, []string{"parameters.postgres_version"}},
+		{"not in enum", map[string]any{"postgres_version": "9"}, []string{"parameters.postgres_version"}},
+		{"unknown parameter", map[string]any{"postgres_version": "17", "locale": "C"}, []string{"parameters.locale"}},
+		{"wrong type", map[string]any{"postgres_version": float64(17)}, []string{"parameters.postgres_version"}},
+		{"pattern and length", map[string]any{"postgres_version": "17", "timezone": "Europe/Zurich+1"},
+			[]string{"parameters.timezone", "parameters.timezone"}},
+		{"date-time", map[string]any{"postgres_version": "17", "restore_point": "yesterday"}, []string{"parameters.restore_point"}},
+		{"not an integer", map[string]any{"postgres_version": "17", "max_connections": 10.5}, []string{"parameters.max_connections"}},
+		{"out of range", map[string]any{"postgres_version": "17", "max_connections": float64(5)}, []string{"parameters.max_connections"}},
+		{"array", map[string]any{"postgres_version": "17", "extensions": []any{"postgis", "postgis", float64(1)}},
+			[]string{"parameters.extensions", "parameters.extensions", "parameters.extensions[2]"}},
+		{"additional properties schema", map[string]any{"postgres_version": "17", "postgresql_parameters": map[string]any{"work_mem": float64(8)}},
+			[]string{"parameters.postgresql_parameters.work_mem"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := ValidateParameters(schema, tt.parameters)
+			if len(errs) != len(tt.wantFields) {
+				t.Fatalf("expected %d error(s), got %v", len(tt.wantFields), errs)
+			}
+			for i, err := range errs {
+				if err.Field != tt.wantFields[i] {
+					t.Errorf("expected an error for %s, got %v", tt.wantFields[i], err)
+				}
+			}
+		})
+	}
+
+	if errs := ValidateParameters(nil, map[string]any{"timezone": "UTC"}); len(errs) != 1 {
+		t.Errorf("expected parameters to be rejected without schema, got %v", errs)
+	}
+	if errs := ValidateParameters(nil, nil); len(errs) != 0 {
+		t.Errorf("expected no parameters to be accepted without schema, got %v", errs)
+	}
+}
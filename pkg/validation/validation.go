@@ -1,6 +1,7 @@
 package validation
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 
@@ -13,8 +14,8 @@ var (
 )
 
 type ValidationError struct {
-	Field   string
-	Message string
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
 
 func (e *ValidationError) Error() string {
@@ -82,17 +83,11 @@ func ValidatePlanID(serviceId, planId string) error {
 		return &ValidationError{"plan_id", "must be valid UUID"}
 	}
 
-	cat := catalog.GetCatalog()
-	services := cat["services"].([]catalog.Service)
-	for _, svc := range services {
-		if svc.ID == serviceId {
-			for _, plan := range svc.Plans {
-				if plan.ID == planId {
-					return nil
-				}
-			}
-			return &ValidationError{"plan_id", "not found for this service"}
+	if _, err := catalog.GetPlan(serviceId, planId); err != nil {
+		if errors.Is(err, catalog.ErrServiceNotFound) {
+			return &ValidationError{"plan_id", "service not found"}
 		}
+		return &ValidationError{"plan_id", "not found for this service"}
 	}
-	return &ValidationError{"plan_id", "service not found"}
+	return nil
 }